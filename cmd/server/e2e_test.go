@@ -0,0 +1,400 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+
+	"example.com/go-chat/internal/core"
+	"example.com/go-chat/internal/core/usecases"
+	"example.com/go-chat/internal/drivers"
+	"example.com/go-chat/internal/server"
+)
+
+// frameTimeout is how long a client waits for a frame it expects.
+const frameTimeout = 2 * time.Second
+
+// harness runs the router from main on an httptest.Server, with in-memory
+// repositories and the local broker, and talks to it like a real client.
+type harness struct {
+	t   *testing.T
+	srv *httptest.Server
+}
+
+func newHarness(t *testing.T) *harness {
+	gin.SetMode(gin.TestMode)
+	store, err := drivers.NewLocalStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	repos, cluster := drivers.NewMemory(), drivers.NewLocalBroker()
+	thumbs := usecases.NewThumbnailWorker(repos, cluster, store)
+	srv := httptest.NewServer(newRouter(repos, cluster, drivers.NewJWTManager("e2e secret"), store, thumbs))
+	t.Cleanup(srv.Close)
+	return &harness{t: t, srv: srv}
+}
+
+type user struct {
+	ID    uuid.UUID
+	Email string
+	// token is the access token of the first login
+	token string
+}
+
+// do sends a JSON request and decodes the response into out unless it is nil.
+func (h *harness) do(method, path, token string, body, out any) int {
+	h.t.Helper()
+	var buf bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&buf).Encode(body); err != nil {
+			h.t.Fatal(err)
+		}
+	}
+	req, err := http.NewRequest(method, h.srv.URL+path, &buf)
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := h.srv.Client().Do(req)
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if out != nil && resp.StatusCode < 300 {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			h.t.Fatalf("%s %s: %v", method, path, err)
+		}
+	}
+	return resp.StatusCode
+}
+
+// mustDo is do for requests that have to succeed.
+func (h *harness) mustDo(method, path, token string, body, out any) {
+	h.t.Helper()
+	if status := h.do(method, path, token, body, out); status >= 300 {
+		h.t.Fatalf("%s %s: status %d", method, path, status)
+	}
+}
+
+// signUp registers a user and logs them in once.
+func (h *harness) signUp(name string) *user {
+	h.t.Helper()
+	u := &user{Email: name + "@example.com"}
+	var created core.User
+	h.mustDo(http.MethodPost, "/api/auth/signup", "", gin.H{"username": name, "email": u.Email, "password": "password"}, &created)
+	u.ID = created.ID
+	u.token = h.login(u)
+	return u
+}
+
+// login opens a new session for u, as a further device would.
+func (h *harness) login(u *user) string {
+	h.t.Helper()
+	var resp struct{ Token string }
+	h.mustDo(http.MethodPost, "/api/auth/login", "", gin.H{"email": u.Email, "password": "password"}, &resp)
+	return resp.Token
+}
+
+func (h *harness) createGroup(owner *user, name string) uuid.UUID {
+	h.t.Helper()
+	var g core.Group
+	h.mustDo(http.MethodPost, "/api/groups", owner.token, gin.H{"name": name, "visibility": core.VisibilityPublic}, &g)
+	return g.ID
+}
+
+func (h *harness) joinGroup(u *user, group uuid.UUID) {
+	h.t.Helper()
+	h.mustDo(http.MethodPost, "/api/groups/"+group.String()+"/join", u.token, nil, nil)
+}
+
+func (h *harness) privateHistory(u, other *user) []core.Message {
+	h.t.Helper()
+	var page core.MessagePage
+	h.mustDo(http.MethodGet, "/api/messages?user_id="+other.ID.String(), u.token, nil, &page)
+	return page.Messages
+}
+
+// client is one websocket connection. Frames are read in the background so
+// that waiting for one frame never loses the others.
+type client struct {
+	t       *testing.T
+	conn    *websocket.Conn
+	frames  chan server.Envelope
+	pending []server.Envelope
+	seq     int
+}
+
+// connect opens a websocket with token and returns once the server delivers
+// the events of u to it.
+func (h *harness) connect(u *user, token string) *client {
+	h.t.Helper()
+	url := "ws" + strings.TrimPrefix(h.srv.URL, "http") + "/ws?token=" + token
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	c := &client{t: h.t, conn: conn, frames: make(chan server.Envelope, 256)}
+	h.t.Cleanup(c.close)
+	go c.read()
+	// the server handles frames only once the connection is registered
+	if env := c.request(server.FrameTypingStop, server.TypingPayload{To: &u.ID}); env.Type != server.FrameAck {
+		h.t.Fatalf("connecting: got %+v", env)
+	}
+	return c
+}
+
+func (c *client) read() {
+	defer close(c.frames)
+	for {
+		var env server.Envelope
+		if err := c.conn.ReadJSON(&env); err != nil {
+			return
+		}
+		c.frames <- env
+	}
+}
+
+func (c *client) close() { c.conn.Close() }
+
+// request sends a frame and returns the ack or error frame replying to it.
+func (c *client) request(typ string, payload any) server.Envelope {
+	c.t.Helper()
+	c.seq++
+	id := fmt.Sprint(c.seq)
+	p, err := json.Marshal(payload)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	if err := c.conn.WriteJSON(server.Envelope{V: server.ProtocolVersion, Type: typ, ID: id, Payload: p}); err != nil {
+		c.t.Fatal(err)
+	}
+	return c.await(func(env server.Envelope) bool { return env.ID == id })
+}
+
+// send sends a message and returns it as acknowledged by the server.
+func (c *client) send(p server.SendMessagePayload) core.Message {
+	c.t.Helper()
+	env := c.request(server.FrameMessageSend, p)
+	if env.Type != server.FrameAck {
+		c.t.Fatalf("message.send: got %s %s", env.Type, env.Payload)
+	}
+	var m core.Message
+	if err := json.Unmarshal(env.Payload, &m); err != nil {
+		c.t.Fatal(err)
+	}
+	return m
+}
+
+// await returns the first frame match accepts, keeping the others for later calls.
+func (c *client) await(match func(server.Envelope) bool) server.Envelope {
+	c.t.Helper()
+	for i, env := range c.pending {
+		if match(env) {
+			c.pending = append(c.pending[:i], c.pending[i+1:]...)
+			return env
+		}
+	}
+	timeout := time.After(frameTimeout)
+	for {
+		select {
+		case env, ok := <-c.frames:
+			if !ok {
+				c.t.Fatal("connection closed")
+			}
+			if match(env) {
+				return env
+			}
+			c.pending = append(c.pending, env)
+		case <-timeout:
+			c.t.Fatal("no matching frame")
+		}
+	}
+}
+
+// message returns the next message.new event.
+func (c *client) message() core.Message {
+	c.t.Helper()
+	env := c.await(func(env server.Envelope) bool { return env.Type == core.EventMessageNew })
+	var m core.Message
+	if err := json.Unmarshal(env.Payload, &m); err != nil {
+		c.t.Fatal(err)
+	}
+	return m
+}
+
+// receive checks that the next message.new event is m.
+func (c *client) receive(m core.Message) {
+	c.t.Helper()
+	if got := c.message(); got.ID != m.ID || got.Content != m.Content || got.SenderID != m.SenderID {
+		c.t.Fatalf("got message %q from %s, want %q from %s", got.Content, got.SenderID, m.Content, m.SenderID)
+	}
+}
+
+// receiveNothing checks that no message.new event arrives for a while.
+func (c *client) receiveNothing() {
+	c.t.Helper()
+	for _, env := range c.pending {
+		if env.Type == core.EventMessageNew {
+			c.t.Fatalf("unexpected message %s", env.Payload)
+		}
+	}
+	timeout := time.After(100 * time.Millisecond)
+	for {
+		select {
+		case env, ok := <-c.frames:
+			if !ok {
+				return
+			}
+			if env.Type == core.EventMessageNew {
+				c.t.Fatalf("unexpected message %s", env.Payload)
+			}
+			c.pending = append(c.pending, env)
+		case <-timeout:
+			return
+		}
+	}
+}
+
+func TestE2EPrivateMessages(t *testing.T) {
+	h := newHarness(t)
+	alice, bob, carol := h.signUp("alice"), h.signUp("bob"), h.signUp("carol")
+	a, b, c := h.connect(alice, alice.token), h.connect(bob, bob.token), h.connect(carol, carol.token)
+
+	m := a.send(server.SendMessagePayload{To: &bob.ID, Content: "hi bob"})
+	if m.SenderID != alice.ID || m.RecipientID == nil || *m.RecipientID != bob.ID {
+		t.Fatalf("acknowledged %+v", m)
+	}
+	b.receive(m)
+	// the sender's own connections see the message too
+	a.receive(m)
+	c.receiveNothing()
+
+	reply := b.send(server.SendMessagePayload{To: &alice.ID, Content: "hi alice"})
+	a.receive(reply)
+	b.receive(reply)
+	c.receiveNothing()
+
+	unknown := uuid.New()
+	for to, code := range map[uuid.UUID]string{alice.ID: server.ErrCodeBadRequest, unknown: server.ErrCodeNotFound} {
+		env := a.request(server.FrameMessageSend, server.SendMessagePayload{To: &to, Content: "anyone?"})
+		var p server.ErrorPayload
+		if err := json.Unmarshal(env.Payload, &p); err != nil || env.Type != server.FrameError || p.Code != code {
+			t.Errorf("sending to %s: got %s %s, want %s", to, env.Type, env.Payload, code)
+		}
+	}
+}
+
+func TestE2EGroupMessages(t *testing.T) {
+	h := newHarness(t)
+	alice, bob, carol, dave := h.signUp("alice"), h.signUp("bob"), h.signUp("carol"), h.signUp("dave")
+	group := h.createGroup(alice, "team")
+	h.joinGroup(bob, group)
+
+	a, b, c, d := h.connect(alice, alice.token), h.connect(bob, bob.token), h.connect(carol, carol.token), h.connect(dave, dave.token)
+
+	// carol joins while connected and is subscribed once told about it
+	h.joinGroup(carol, group)
+	c.await(func(env server.Envelope) bool { return env.Type == core.EventGroupMembership })
+
+	m := a.send(server.SendMessagePayload{GroupID: &group, Content: "hello team"})
+	for _, member := range []*client{a, b, c} {
+		member.receive(m)
+	}
+	d.receiveNothing()
+
+	if env := d.request(server.FrameMessageSend, server.SendMessagePayload{GroupID: &group, Content: "let me in"}); env.Type != server.FrameError {
+		t.Fatalf("non-member sent to the group: %+v", env)
+	}
+	for _, member := range []*client{a, b, c} {
+		member.receiveNothing()
+	}
+}
+
+func TestE2ERemovedMembersStopReceiving(t *testing.T) {
+	h := newHarness(t)
+	alice, bob, carol, dave := h.signUp("alice"), h.signUp("bob"), h.signUp("carol"), h.signUp("dave")
+	group := h.createGroup(alice, "team")
+	for _, u := range []*user{bob, carol, dave} {
+		h.joinGroup(u, group)
+	}
+	path := "/api/groups/" + group.String() + "/members/"
+	h.mustDo(http.MethodPut, path+bob.ID.String()+"/role", alice.token, gin.H{"role": core.RoleAdmin}, nil)
+
+	a, b, c, d := h.connect(alice, alice.token), h.connect(bob, bob.token), h.connect(carol, carol.token), h.connect(dave, dave.token)
+
+	// bob removes carol as an admin and dave leaves; both stay connected
+	h.mustDo(http.MethodDelete, path+carol.ID.String(), bob.token, nil, nil)
+	h.mustDo(http.MethodDelete, path+"me", dave.token, nil, nil)
+	for _, removed := range []*client{c, d} {
+		env := removed.await(func(env server.Envelope) bool { return env.Type == core.EventGroupMembership })
+		var ev usecases.MembershipEvent
+		if err := json.Unmarshal(env.Payload, &ev); err != nil || ev.GroupID != group || ev.Joined {
+			t.Fatalf("membership event: got %s, %v", env.Payload, err)
+		}
+	}
+
+	m := a.send(server.SendMessagePayload{GroupID: &group, Content: "just us"})
+	a.receive(m)
+	b.receive(m)
+	c.receiveNothing()
+	d.receiveNothing()
+}
+
+func TestE2EReconnect(t *testing.T) {
+	h := newHarness(t)
+	alice, bob := h.signUp("alice"), h.signUp("bob")
+	a := h.connect(alice, alice.token)
+	b := h.connect(bob, bob.token)
+
+	first := a.send(server.SendMessagePayload{To: &bob.ID, Content: "first"})
+	b.receive(first)
+	b.close()
+
+	// what is sent while bob is away is only in the history
+	missed := a.send(server.SendMessagePayload{To: &bob.ID, Content: "while you were away"})
+	b = h.connect(bob, bob.token)
+	b.receiveNothing()
+	history := h.privateHistory(bob, alice)
+	if len(history) != 2 || history[0].ID != missed.ID || history[1].ID != first.ID {
+		t.Fatalf("history after reconnecting: %+v", history)
+	}
+
+	last := a.send(server.SendMessagePayload{To: &bob.ID, Content: "welcome back"})
+	b.receive(last)
+}
+
+func TestE2EMultiDevice(t *testing.T) {
+	h := newHarness(t)
+	alice, bob := h.signUp("alice"), h.signUp("bob")
+	phone := h.connect(alice, alice.token)
+	laptop := h.connect(alice, h.login(alice))
+	b := h.connect(bob, bob.token)
+
+	m := b.send(server.SendMessagePayload{To: &alice.ID, Content: "to all of alice's devices"})
+	phone.receive(m)
+	laptop.receive(m)
+	b.receive(m)
+
+	// what one device sends shows up on the others
+	reply := phone.send(server.SendMessagePayload{To: &bob.ID, Content: "from the phone"})
+	b.receive(reply)
+	laptop.receive(reply)
+	phone.receive(reply)
+
+	// closing one device leaves the others connected
+	phone.close()
+	later := b.send(server.SendMessagePayload{To: &alice.ID, Content: "still there?"})
+	laptop.receive(later)
+}
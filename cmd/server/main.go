@@ -2,20 +2,30 @@ package main
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"log"
 	"os"
+	"strconv"
+	"strings"
 
 	"github.com/joho/godotenv"
 
-	"github.com/gin-gonic/gin"
-
+	"example.com/go-chat/internal/core"
+	"example.com/go-chat/internal/core/usecases"
 	"example.com/go-chat/internal/drivers"
-	"example.com/go-chat/internal/server"
 )
 
 func main() {
 	_ = godotenv.Load()
 
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := runMigrate(context.Background(), os.Args[2:]); err != nil {
+			log.Fatalf("migrate: %v", err)
+		}
+		return
+	}
+
 	port := os.Getenv("PORT")
 	if port == "" {
 		port = "8080"
@@ -23,41 +33,142 @@ func main() {
 
 	ctx := context.Background()
 
-	pg, err := drivers.NewPostgres(ctx, os.Getenv("DATABASE_URL"))
+	repos, closeRepos, err := newRepositories(ctx)
 	if err != nil {
-		log.Fatalf("pg connect: %v", err)
+		log.Fatalf("repositories: %v", err)
 	}
-	defer pg.Close(ctx)
+	defer closeRepos()
 
-	rds := drivers.NewRedis(os.Getenv("REDIS_ADDR"))
-	defer rds.Close()
+	cluster, closeCluster, err := newCluster()
+	if err != nil {
+		log.Fatalf("broker: %v", err)
+	}
+	defer closeCluster()
 
-	jwtMgr := drivers.NewJWTManager(os.Getenv("JWT_SECRET"))
+	jwtMgr, err := newJWTManager()
+	if err != nil {
+		log.Fatalf("jwt keys: %v", err)
+	}
 
-	repos := drivers.NewRepositories(pg)
+	store, err := newAttachmentStore(ctx)
+	if err != nil {
+		log.Fatalf("attachment store: %v", err)
+	}
 
-	h := server.NewHandler(repos, rds, jwtMgr)
+	thumbs := usecases.NewThumbnailWorker(repos, cluster, store)
+	go thumbs.Run(ctx)
 
-	r := gin.Default()
+	r := newRouter(repos, cluster, jwtMgr, store, thumbs)
 
-	r.POST("/api/auth/signup", h.SignUp)
-	r.POST("/api/auth/login", h.Login)
+	log.Printf("listening on :%s", port)
+	r.Run(":" + port)
+}
 
-	// protected
-	auth := r.Group("/api")
-	auth.Use(server.AuthMiddleware(jwtMgr))
-	{
-		auth.GET("/me", h.Me)
-		auth.POST("/groups", h.CreateGroup)
-		auth.GET("/groups", h.MyGroups)
-		auth.POST("/groups/:id/join", h.JoinGroup)
-		auth.GET("/groups/:id/members", h.ListGroupMembers)
-		auth.GET("/messages", h.GetPrivateHistory)
-		auth.GET("/groups/:id/messages", h.GetGroupHistory)
+// newJWTManager signs with HMAC JWT_SECRET unless JWT_KEYS lists PEM keys as
+// "kid=path,kid=path". JWT_ACTIVE_KID picks the signing key (default: the first
+// one); the others only verify, which lets keys rotate. When both are set,
+// JWT_SECRET keeps verifying tokens issued before the switch. With neither set
+// no token could be verified, so it fails.
+func newJWTManager() (*drivers.JWTManager, error) {
+	spec := os.Getenv("JWT_KEYS")
+	if spec == "" {
+		secret := os.Getenv("JWT_SECRET")
+		if secret == "" {
+			return nil, errors.New("set JWT_SECRET or JWT_KEYS")
+		}
+		return drivers.NewJWTManager(secret), nil
 	}
+	var keys []*drivers.JWTKey
+	for _, entry := range strings.Split(spec, ",") {
+		kid, path, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		if !ok || kid == "" || path == "" {
+			return nil, fmt.Errorf("invalid JWT_KEYS entry %q", entry)
+		}
+		k, err := drivers.LoadPEMKey(kid, path)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	active := os.Getenv("JWT_ACTIVE_KID")
+	if active == "" {
+		active = keys[0].ID
+	}
+	return drivers.NewJWTManagerFromKeys(keys, active, os.Getenv("JWT_SECRET"))
+}
 
-	r.GET("/ws", server.WSHandler(rds, jwtMgr, repos))
+// newRepositories uses the Postgres database at DATABASE_URL unless
+// STORE=memory, which keeps everything in memory until the server stops. The
+// returned func closes the connection.
+func newRepositories(ctx context.Context) (core.Repositories, func(), error) {
+	switch kind := os.Getenv("STORE"); kind {
+	case "", "postgres":
+		pg, err := drivers.NewPostgres(ctx, os.Getenv("DATABASE_URL"))
+		if err != nil {
+			return nil, nil, err
+		}
+		// migrations are applied by the migrate subcommand, never on startup
+		migrator, err := drivers.NewMigrator(pg)
+		if err != nil {
+			pg.Close(ctx)
+			return nil, nil, err
+		}
+		version, err := migrator.Version(ctx)
+		if err != nil {
+			pg.Close(ctx)
+			return nil, nil, fmt.Errorf("schema version: %w", err)
+		}
+		if version != migrator.Latest() {
+			pg.Close(ctx)
+			return nil, nil, fmt.Errorf("database schema is at version %d, this build needs %d: run `server migrate up`", version, migrator.Latest())
+		}
+		return drivers.NewRepositories(pg), func() { pg.Close(ctx) }, nil
+	case "memory":
+		log.Println("STORE=memory: nothing is kept once the server stops")
+		return drivers.NewMemory(), func() {}, nil
+	default:
+		return nil, nil, fmt.Errorf("unknown STORE %q", kind)
+	}
+}
 
-	log.Printf("listening on :%s", port)
-	r.Run(":" + port)
+// newCluster shares pub/sub, presence and revoked tokens through the Redis at
+// REDIS_ADDR unless BROKER=local, which keeps them in process. The returned
+// func closes the connection.
+func newCluster() (core.Cluster, func(), error) {
+	switch kind := os.Getenv("BROKER"); kind {
+	case "", "redis":
+		rds := drivers.NewRedis(os.Getenv("REDIS_ADDR"))
+		return rds, func() { rds.Close() }, nil
+	case "local":
+		log.Println("BROKER=local: only run a single instance")
+		return drivers.NewLocalBroker(), func() {}, nil
+	default:
+		return nil, nil, fmt.Errorf("unknown BROKER %q", kind)
+	}
+}
+
+// newAttachmentStore keeps uploads on disk under ATTACHMENT_DIR unless
+// ATTACHMENT_STORE=s3, which uses the S3-compatible service at S3_ENDPOINT
+// (S3_ACCESS_KEY, S3_SECRET_KEY, S3_BUCKET, S3_REGION, S3_USE_SSL).
+func newAttachmentStore(ctx context.Context) (core.AttachmentStore, error) {
+	switch kind := os.Getenv("ATTACHMENT_STORE"); kind {
+	case "", "local":
+		dir := os.Getenv("ATTACHMENT_DIR")
+		if dir == "" {
+			dir = "./data/attachments"
+		}
+		return drivers.NewLocalStore(dir)
+	case "s3":
+		useSSL, _ := strconv.ParseBool(os.Getenv("S3_USE_SSL"))
+		return drivers.NewS3Store(ctx, drivers.S3Config{
+			Endpoint:  os.Getenv("S3_ENDPOINT"),
+			AccessKey: os.Getenv("S3_ACCESS_KEY"),
+			SecretKey: os.Getenv("S3_SECRET_KEY"),
+			Bucket:    os.Getenv("S3_BUCKET"),
+			Region:    os.Getenv("S3_REGION"),
+			UseSSL:    useSSL,
+		})
+	default:
+		return nil, fmt.Errorf("unknown ATTACHMENT_STORE %q", kind)
+	}
 }
@@ -0,0 +1,15 @@
+package main
+
+import "testing"
+
+func TestNewJWTManagerNeedsAKey(t *testing.T) {
+	t.Setenv("JWT_KEYS", "")
+	t.Setenv("JWT_SECRET", "")
+	if _, err := newJWTManager(); err == nil {
+		t.Fatal("started without a signing key")
+	}
+	t.Setenv("JWT_SECRET", "secret")
+	if _, err := newJWTManager(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+
+	"example.com/go-chat/internal/drivers"
+)
+
+const migrateUsage = `usage: server migrate [command]
+
+commands:
+  up [n]     apply the next n pending migrations, all of them by default
+  down [n]   revert the last n applied migrations, 1 by default
+  version    print the schema version of the database`
+
+// runMigrate implements the migrate subcommand against DATABASE_URL.
+func runMigrate(ctx context.Context, args []string) error {
+	cmd := "up"
+	if len(args) > 0 {
+		cmd, args = args[0], args[1:]
+	}
+	steps := 0
+	if cmd == "down" {
+		steps = 1
+	}
+	if len(args) > 0 {
+		n, err := strconv.Atoi(args[0])
+		if err != nil || n <= 0 || len(args) > 1 {
+			return errors.New(migrateUsage)
+		}
+		steps = n
+	}
+
+	pg, err := drivers.NewPostgres(ctx, os.Getenv("DATABASE_URL"))
+	if err != nil {
+		return fmt.Errorf("pg connect: %w", err)
+	}
+	defer pg.Close(ctx)
+	m, err := drivers.NewMigrator(pg)
+	if err != nil {
+		return err
+	}
+
+	switch cmd {
+	case "up":
+		applied, err := m.Up(ctx, steps)
+		for _, mig := range applied {
+			log.Printf("applied %04d_%s", mig.Version, mig.Name)
+		}
+		if err != nil {
+			return err
+		}
+		if len(applied) == 0 {
+			log.Printf("schema is up to date")
+		}
+	case "down":
+		reverted, err := m.Down(ctx, steps)
+		for _, mig := range reverted {
+			log.Printf("reverted %04d_%s", mig.Version, mig.Name)
+		}
+		if err != nil {
+			return err
+		}
+	case "version":
+		if len(args) > 0 {
+			return errors.New(migrateUsage)
+		}
+		v, err := m.Version(ctx)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%d (latest %d)\n", v, m.Latest())
+	default:
+		return errors.New(migrateUsage)
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"github.com/gin-gonic/gin"
+
+	"example.com/go-chat/internal/core"
+	"example.com/go-chat/internal/core/usecases"
+	"example.com/go-chat/internal/drivers"
+	"example.com/go-chat/internal/server"
+)
+
+// newRouter serves the REST API, the websocket endpoint and the JWKS document.
+func newRouter(repos core.Repositories, cluster core.Cluster, jwtMgr *drivers.JWTManager, store core.AttachmentStore, thumbs *usecases.ThumbnailWorker) *gin.Engine {
+	h := server.NewHandler(repos, cluster, jwtMgr, store, thumbs)
+	r := gin.Default()
+
+	r.POST("/api/auth/signup", h.SignUp)
+	r.POST("/api/auth/login", h.Login)
+	r.POST("/api/auth/refresh", h.Refresh)
+	r.POST("/api/auth/logout", h.Logout)
+
+	// protected
+	auth := r.Group("/api")
+	auth.Use(server.AuthMiddleware(jwtMgr, cluster))
+	{
+		auth.GET("/me", h.Me)
+		auth.GET("/sessions", h.ListSessions)
+		auth.DELETE("/sessions/:id", h.RevokeSession)
+		auth.GET("/users/:id/presence", h.GetPresence)
+		auth.GET("/presence", h.BatchPresence)
+		auth.POST("/groups", h.CreateGroup)
+		auth.GET("/groups", h.MyGroups)
+		auth.POST("/groups/:id/join", h.JoinGroup)
+		auth.PATCH("/groups/:id", h.UpdateGroup)
+		auth.DELETE("/groups/:id", h.DeleteGroup)
+		auth.POST("/groups/:id/owner", h.TransferGroupOwnership)
+		auth.GET("/groups/:id/members", h.ListGroupMembers)
+		auth.PUT("/groups/:id/members/:user_id/role", h.SetMemberRole)
+		auth.DELETE("/groups/:id/members/:user_id", h.RemoveGroupMember)
+		auth.POST("/groups/:id/invites", h.CreateInvite)
+		auth.GET("/groups/:id/invites", h.ListInvites)
+		auth.DELETE("/groups/:id/invites/:token", h.RevokeInvite)
+		auth.POST("/invites/:token/join", h.AcceptInvite)
+		auth.GET("/groups/:id/join-requests", h.ListJoinRequests)
+		auth.POST("/groups/:id/join-requests/:user_id/approve", h.ApproveJoinRequest)
+		auth.POST("/groups/:id/join-requests/:user_id/reject", h.RejectJoinRequest)
+		auth.GET("/conversations", h.ListConversations)
+		auth.GET("/search/messages", h.SearchMessages)
+		auth.GET("/messages", h.GetPrivateHistory)
+		auth.GET("/groups/:id/messages", h.GetGroupHistory)
+		auth.PATCH("/messages/:id", h.EditMessage)
+		auth.DELETE("/messages/:id", h.DeleteMessage)
+		auth.GET("/messages/:id/edits", h.ListMessageEdits)
+		auth.POST("/messages/:id/replies", h.ReplyToMessage)
+		auth.GET("/messages/:id/thread", h.GetThread)
+		auth.GET("/messages/:id/receipts", h.ListReceipts)
+		auth.PUT("/messages/:id/reactions/:emoji", h.AddReaction)
+		auth.DELETE("/messages/:id/reactions/:emoji", h.RemoveReaction)
+		auth.POST("/attachments", h.UploadAttachment)
+		auth.GET("/attachments/:id/content", h.DownloadAttachment)
+		auth.GET("/attachments/:id/thumbnail", h.DownloadThumbnail)
+	}
+
+	r.GET("/ws", server.WSHandler(cluster, jwtMgr, repos, store))
+	r.GET("/.well-known/jwks.json", server.JWKSHandler(jwtMgr))
+
+	return r
+}
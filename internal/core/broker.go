@@ -0,0 +1,69 @@
+package core
+
+import (
+	"context"
+	"time"
+)
+
+// BrokerMessage is a payload received on a subscribed channel.
+type BrokerMessage struct {
+	Channel string
+	Payload string
+}
+
+// Broker relays what is published on a channel to every subscription to that
+// channel, whichever server instance holds it. Delivery is at most once.
+type Broker interface {
+	Publish(ctx context.Context, channel, payload string) error
+	// Subscribe opens a subscription to channels, which is active once it
+	// returns. More channels can be added later.
+	Subscribe(ctx context.Context, channels ...string) Subscription
+}
+
+// Subscription receives the messages of its channels in the order they were
+// published.
+type Subscription interface {
+	// Subscribe returns once messages published on channels from then on are
+	// delivered.
+	Subscribe(ctx context.Context, channels ...string) error
+	Unsubscribe(ctx context.Context, channels ...string) error
+	// Channel delivers the messages until the subscription is closed.
+	Channel() <-chan *BrokerMessage
+	Close() error
+}
+
+// PresenceStore records which server instances hold a connection for a user.
+// An entry counts until its ttl runs out, so an instance that dies without
+// cleaning up stops keeping its users online.
+type PresenceStore interface {
+	// SetPresence adds or extends the instance's entry and reports whether the
+	// user was offline before.
+	SetPresence(ctx context.Context, userID, instance string, ttl time.Duration) (bool, error)
+	// RemovePresence drops the instance's entry. When no other instance holds
+	// a connection the user's last seen time is recorded and true is returned.
+	RemovePresence(ctx context.Context, userID, instance string) (bool, error)
+	// GetPresence looks up several users at once. lastSeen is zero for users
+	// who are online or were never seen.
+	GetPresence(ctx context.Context, userIDs []string) (online []bool, lastSeen []time.Time, err error)
+	// ExpirePresence finds the users whose entries all ran out by now, as
+	// when the instance holding their connections died, and records their
+	// last seen time as when the last entry ran out. Of concurrent calls only
+	// one returns a given user.
+	ExpirePresence(ctx context.Context, now time.Time) (userIDs []string, lastSeen []time.Time, err error)
+}
+
+// TokenDenylist holds revoked access tokens and sessions until their tokens
+// would have expired anyway.
+type TokenDenylist interface {
+	RevokeToken(ctx context.Context, jti string, ttl time.Duration) error
+	RevokeSessionTokens(ctx context.Context, sessionID string, ttl time.Duration) error
+	IsRevoked(ctx context.Context, jti, sessionID string) (bool, error)
+}
+
+// Cluster is the state server instances share. Redis provides it to any number
+// of instances; a single instance can keep it in process.
+type Cluster interface {
+	Broker
+	PresenceStore
+	TokenDenylist
+}
@@ -14,12 +14,23 @@ type User struct {
 	CreatedAt    time.Time `gorm:"autoCreateTime" json:"created_at"`
 }
 
+// GroupVisibility controls how users join: anyone may join a public group,
+// a private group needs an invite or an approved join request.
+type GroupVisibility string
+
+const (
+	VisibilityPublic  GroupVisibility = "public"
+	VisibilityPrivate GroupVisibility = "private"
+)
+
+func (v GroupVisibility) Valid() bool { return v == VisibilityPublic || v == VisibilityPrivate }
 
 type Group struct {
-	ID        uuid.UUID `gorm:"type:uuid;default:gen_random_uuid();primaryKey" json:"id"`
-	Name      string    `gorm:"type:varchar(100);not null" json:"name"`
-	OwnerID   uuid.UUID `gorm:"type:uuid;not null" json:"owner_id"`
-	CreatedAt time.Time `gorm:"autoCreateTime" json:"created_at"`
+	ID         uuid.UUID       `gorm:"type:uuid;default:gen_random_uuid();primaryKey" json:"id"`
+	Name       string          `gorm:"type:varchar(100);not null" json:"name"`
+	OwnerID    uuid.UUID       `gorm:"type:uuid;not null" json:"owner_id"`
+	Visibility GroupVisibility `gorm:"type:varchar(20);not null;default:public" json:"visibility"`
+	CreatedAt  time.Time       `gorm:"autoCreateTime" json:"created_at"`
 
 	// relationships
 	Owner *User `gorm:"foreignKey:OwnerID;references:ID" json:"owner"`
@@ -27,25 +38,278 @@ type Group struct {
 
 type Message struct {
 	ID          uuid.UUID  `gorm:"type:uuid;default:gen_random_uuid();primaryKey" json:"id"`
-	SenderID    uuid.UUID  `gorm:"type:uuid;not null" json:"sender_id"`
-	RecipientID *uuid.UUID `gorm:"type:uuid" json:"recipient_id,omitempty"`
-	GroupID     *uuid.UUID `gorm:"type:uuid" json:"group_id,omitempty"`
+	SenderID    uuid.UUID  `gorm:"type:uuid;not null;index:idx_messages_private,priority:2;index:idx_messages_sender,priority:1" json:"sender_id"`
+	RecipientID *uuid.UUID `gorm:"type:uuid;index:idx_messages_private,priority:1;index:idx_messages_sender,priority:2" json:"recipient_id,omitempty"`
+	GroupID     *uuid.UUID `gorm:"type:uuid;index:idx_messages_group,priority:1" json:"group_id,omitempty"`
 	Content     string     `gorm:"type:text;not null" json:"content"`
-	CreatedAt   time.Time  `gorm:"autoCreateTime" json:"created_at"`
+	CreatedAt   time.Time  `gorm:"autoCreateTime;index:idx_messages_private,priority:3;index:idx_messages_sender,priority:3;index:idx_messages_group,priority:2;index:idx_messages_thread,priority:2" json:"created_at"`
+	EditedAt    *time.Time `json:"edited_at,omitempty"`
+	// a deleted message stays in history as a tombstone without content
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+	DeletedBy *uuid.UUID `gorm:"type:uuid" json:"deleted_by,omitempty"`
+
+	// ReplyToID is the message this one quotes; ThreadRootID the first message of its thread
+	ReplyToID    *uuid.UUID `gorm:"type:uuid" json:"reply_to_id,omitempty"`
+	ThreadRootID *uuid.UUID `gorm:"type:uuid;index:idx_messages_thread,priority:1" json:"thread_root_id,omitempty"`
+	// ReplyCount counts the replies in the thread this message is the root of
+	ReplyCount int `gorm:"not null;default:0" json:"reply_count"`
+
+	// Reactions is filled in by history queries, it is not a column
+	Reactions   []ReactionCount `gorm:"-" json:"reactions,omitempty"`
+	Attachments []Attachment    `gorm:"foreignKey:MessageID" json:"attachments,omitempty"`
 
 	// relationships
-	Sender    *User  `gorm:"foreignKey:SenderID; references:ID" json:"sender"`
-	Recipient *User  `gorm:"foreignKey:RecipientID; references:ID" json:"recipient"`
-	Group     *Group `gorm:"foreignKey:GroupID; references:ID" json:"group"`
+	Sender    *User    `gorm:"foreignKey:SenderID; references:ID" json:"sender"`
+	Recipient *User    `gorm:"foreignKey:RecipientID; references:ID" json:"recipient"`
+	Group     *Group   `gorm:"foreignKey:GroupID; references:ID" json:"group"`
+	ReplyTo   *Message `gorm:"foreignKey:ReplyToID; references:ID" json:"reply_to,omitempty"`
+}
+
+type GroupRole string
+
+const (
+	RoleOwner  GroupRole = "owner"
+	RoleAdmin  GroupRole = "admin"
+	RoleMember GroupRole = "member"
+)
+
+func (r GroupRole) rank() int {
+	switch r {
+	case RoleOwner:
+		return 3
+	case RoleAdmin:
+		return 2
+	case RoleMember:
+		return 1
+	}
+	return 0
 }
 
+// AtLeast reports whether r grants every privilege of other.
+func (r GroupRole) AtLeast(other GroupRole) bool { return r.rank() >= other.rank() }
+
+// Outranks reports whether r is strictly more privileged than other.
+func (r GroupRole) Outranks(other GroupRole) bool { return r.rank() > other.rank() }
 
 type GroupMember struct {
-    GroupID  uuid.UUID `gorm:"type:uuid;primaryKey" json:"group_id"`
-    UserID   uuid.UUID `gorm:"type:uuid;primaryKey" json:"user_id"`
-    JoinedAt time.Time `gorm:"autoCreateTime" json:"joined_at"`
-
-    // relationships
-    Group *Group `gorm:"foreignKey:GroupID"`
-    User  *User  `gorm:"foreignKey:UserID"`
-}
\ No newline at end of file
+	GroupID  uuid.UUID `gorm:"type:uuid;primaryKey" json:"group_id"`
+	UserID   uuid.UUID `gorm:"type:uuid;primaryKey" json:"user_id"`
+	Role     GroupRole `gorm:"type:varchar(20);not null;default:member" json:"role"`
+	JoinedAt time.Time `gorm:"autoCreateTime" json:"joined_at"`
+
+	// relationships
+	Group *Group `gorm:"foreignKey:GroupID" json:"group,omitempty"`
+	User  *User  `gorm:"foreignKey:UserID" json:"user,omitempty"`
+}
+
+// GroupInvite is a shareable token granting membership of a group. MaxUses of
+// zero means unlimited and a nil ExpiresAt never expires.
+type GroupInvite struct {
+	Token     string     `gorm:"type:varchar(64);primaryKey" json:"token"`
+	GroupID   uuid.UUID  `gorm:"type:uuid;not null;index" json:"group_id"`
+	CreatedBy uuid.UUID  `gorm:"type:uuid;not null" json:"created_by"`
+	MaxUses   int        `gorm:"not null;default:0" json:"max_uses"`
+	Uses      int        `gorm:"not null;default:0" json:"uses"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	CreatedAt time.Time  `gorm:"autoCreateTime" json:"created_at"`
+}
+
+type JoinRequestStatus string
+
+const (
+	JoinRequestPending  JoinRequestStatus = "pending"
+	JoinRequestApproved JoinRequestStatus = "approved"
+	JoinRequestRejected JoinRequestStatus = "rejected"
+)
+
+// GroupJoinRequest is a user's request to join a private group. A user has at
+// most one request per group; asking again reopens it.
+type GroupJoinRequest struct {
+	GroupID   uuid.UUID         `gorm:"type:uuid;primaryKey" json:"group_id"`
+	UserID    uuid.UUID         `gorm:"type:uuid;primaryKey" json:"user_id"`
+	Status    JoinRequestStatus `gorm:"type:varchar(20);not null;index" json:"status"`
+	DecidedBy *uuid.UUID        `gorm:"type:uuid" json:"decided_by,omitempty"`
+	DecidedAt *time.Time        `json:"decided_at,omitempty"`
+	CreatedAt time.Time         `json:"created_at"`
+
+	// relationships
+	User *User `gorm:"foreignKey:UserID" json:"user,omitempty"`
+}
+
+// Session is a logged in device. It outlives individual access tokens and is
+// kept alive by rotating refresh tokens.
+type Session struct {
+	ID         uuid.UUID  `gorm:"type:uuid;primaryKey" json:"id"`
+	UserID     uuid.UUID  `gorm:"type:uuid;not null;index" json:"user_id"`
+	UserAgent  string     `gorm:"type:varchar(255)" json:"user_agent"`
+	IP         string     `gorm:"type:varchar(64)" json:"ip"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt time.Time  `json:"last_used_at"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+
+	// Current marks the session of the request that listed it
+	Current bool `gorm:"-" json:"current"`
+}
+
+func (s *Session) Active(now time.Time) bool { return s.RevokedAt == nil && now.Before(s.ExpiresAt) }
+
+// RefreshToken is the hash of an opaque refresh token. Each token can be used
+// once; a used token presented again signals theft and revokes its session.
+type RefreshToken struct {
+	Hash      string    `gorm:"type:char(64);primaryKey"`
+	SessionID uuid.UUID `gorm:"type:uuid;not null;index"`
+	ExpiresAt time.Time `gorm:"not null"`
+	UsedAt    *time.Time
+	CreatedAt time.Time
+}
+
+// Presence is a user's online state. LastSeen is set for offline users that
+// have connected before.
+type Presence struct {
+	UserID   uuid.UUID  `json:"user_id"`
+	Online   bool       `json:"online"`
+	LastSeen *time.Time `json:"last_seen,omitempty"`
+}
+
+// Typing tells a conversation that a user started or stopped typing. Exactly
+// one of To and GroupID is set. A started indicator lapses after ExpiresIn
+// seconds unless it is refreshed.
+type Typing struct {
+	UserID    uuid.UUID  `json:"user_id"`
+	To        *uuid.UUID `json:"to,omitempty"`
+	GroupID   *uuid.UUID `json:"group_id,omitempty"`
+	Typing    bool       `json:"typing"`
+	ExpiresIn int        `json:"expires_in,omitempty"`
+}
+
+// Attachment is an uploaded file. It belongs to its uploader until it is sent
+// with a message, after which everyone in the conversation can download it.
+type Attachment struct {
+	ID          uuid.UUID  `gorm:"type:uuid;primaryKey" json:"id"`
+	UploaderID  uuid.UUID  `gorm:"type:uuid;not null;index" json:"uploader_id"`
+	MessageID   *uuid.UUID `gorm:"type:uuid;index" json:"message_id,omitempty"`
+	FileName    string     `gorm:"type:varchar(255);not null" json:"file_name"`
+	ContentType string     `gorm:"type:varchar(127);not null" json:"content_type"`
+	Size        int64      `gorm:"not null" json:"size"`
+	// StorageKey locates the content in the AttachmentStore
+	StorageKey string `gorm:"type:varchar(255);not null" json:"-"`
+	// Width and Height of an image, and whether its thumbnail can be fetched,
+	// are filled in the background after the upload
+	Width     int       `gorm:"not null;default:0" json:"width,omitempty"`
+	Height    int       `gorm:"not null;default:0" json:"height,omitempty"`
+	Thumbnail bool      `gorm:"not null;default:false" json:"thumbnail"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// ThumbnailKey locates the thumbnail of an image in the AttachmentStore.
+func (a *Attachment) ThumbnailKey() string {
+	return a.StorageKey + ".thumb"
+}
+
+// Reaction is an emoji a user put on a message. A user can react to a message
+// with several emoji, but with each one only once.
+type Reaction struct {
+	MessageID uuid.UUID `gorm:"type:uuid;primaryKey" json:"message_id"`
+	UserID    uuid.UUID `gorm:"type:uuid;primaryKey" json:"user_id"`
+	Emoji     string    `gorm:"type:varchar(64);primaryKey" json:"emoji"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// ReactionCount aggregates the reactions to a message with one emoji. Me
+// tells whether the user asking reacted with it.
+type ReactionCount struct {
+	Emoji string `json:"emoji"`
+	Count int    `json:"count"`
+	Me    bool   `json:"me"`
+}
+
+// ReactionChange is published when a user adds or removes a reaction. Count is
+// the number of reactions with Emoji after the change.
+type ReactionChange struct {
+	MessageID uuid.UUID  `json:"message_id"`
+	GroupID   *uuid.UUID `json:"group_id,omitempty"`
+	UserID    uuid.UUID  `json:"user_id"`
+	Emoji     string     `json:"emoji"`
+	Added     bool       `json:"added"`
+	Count     int        `json:"count"`
+}
+
+// MessageEdit keeps the content a message had before an edit.
+type MessageEdit struct {
+	ID        uuid.UUID `gorm:"type:uuid;default:gen_random_uuid();primaryKey" json:"id"`
+	MessageID uuid.UUID `gorm:"type:uuid;not null;index" json:"message_id"`
+	Content   string    `gorm:"type:text;not null" json:"content"`
+	// EditedAt is when this content was replaced
+	EditedAt time.Time `json:"edited_at"`
+}
+
+// Conversation is an inbox entry: either a private conversation with Peer or
+// a Group. LastMessage is nil for groups nobody has written in yet.
+type Conversation struct {
+	Peer         *User     `json:"peer,omitempty"`
+	Group        *Group    `json:"group,omitempty"`
+	LastMessage  *Message  `json:"last_message,omitempty"`
+	UnreadCount  int       `json:"unread_count"`
+	LastActivity time.Time `json:"last_activity"`
+}
+
+// MessageReceipt records when a recipient received and read a message.
+type MessageReceipt struct {
+	MessageID   uuid.UUID  `gorm:"type:uuid;primaryKey" json:"message_id"`
+	UserID      uuid.UUID  `gorm:"type:uuid;primaryKey" json:"user_id"`
+	DeliveredAt *time.Time `json:"delivered_at,omitempty"`
+	ReadAt      *time.Time `json:"read_at,omitempty"`
+
+	// relationships
+	User *User `gorm:"foreignKey:UserID" json:"user,omitempty"`
+}
+
+// ReadCursor is the newest message a user has read in a conversation. The
+// conversation is the other user of a private conversation, or the group.
+type ReadCursor struct {
+	UserID           uuid.UUID `gorm:"type:uuid;primaryKey"`
+	ConversationID   uuid.UUID `gorm:"type:uuid;primaryKey"`
+	MessageID        uuid.UUID `gorm:"type:uuid;not null"`
+	MessageCreatedAt time.Time `gorm:"not null"`
+	UpdatedAt        time.Time
+}
+
+// ConversationOf returns the id user knows m's conversation by: the group, or
+// the other user of a private conversation.
+func ConversationOf(m *Message, user uuid.UUID) uuid.UUID {
+	switch {
+	case m.GroupID != nil:
+		return *m.GroupID
+	case m.SenderID == user:
+		return *m.RecipientID
+	default:
+		return m.SenderID
+	}
+}
+
+type ReceiptStatus string
+
+const (
+	ReceiptDelivered ReceiptStatus = "delivered"
+	ReceiptRead      ReceiptStatus = "read"
+)
+
+// ReceiptCounts aggregates the receipts of a group message.
+type ReceiptCounts struct {
+	Delivered int `json:"delivered"`
+	Read      int `json:"read"`
+}
+
+// ReceiptUpdate tells a sender that a message was delivered or read. For a
+// private message UserID is the recipient and a read update covers every
+// earlier message of the conversation too; for a group message Counts holds
+// how many members received and read it.
+type ReceiptUpdate struct {
+	MessageID uuid.UUID      `json:"message_id"`
+	GroupID   *uuid.UUID     `json:"group_id,omitempty"`
+	UserID    *uuid.UUID     `json:"user_id,omitempty"`
+	Status    ReceiptStatus  `json:"status"`
+	At        time.Time      `json:"at"`
+	Counts    *ReceiptCounts `json:"counts,omitempty"`
+}
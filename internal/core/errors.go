@@ -0,0 +1,64 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrForbidden is returned by usecases when the caller may not perform the
+// requested operation. More specific errors wrap it.
+var ErrForbidden = errors.New("forbidden")
+
+var ErrNotFound = errors.New("not found")
+
+// ErrInvalidInput is returned for requests that are well formed but carry values the usecase rejects.
+var ErrInvalidInput = errors.New("invalid input")
+
+var (
+	ErrNotGroupMember   = fmt.Errorf("%w: not a member of this group", ErrForbidden)
+	ErrInsufficientRole = fmt.Errorf("%w: insufficient group role", ErrForbidden)
+)
+
+var ErrNotContact = fmt.Errorf("%w: no conversation or group shared with this user", ErrForbidden)
+
+var (
+	ErrNotMessageSender = fmt.Errorf("%w: not the sender of this message", ErrForbidden)
+	ErrMessageDeleted   = fmt.Errorf("%w: message was deleted", ErrNotFound)
+)
+
+var (
+	ErrInvalidInvite = fmt.Errorf("%w: invite is invalid or expired", ErrNotFound)
+	ErrNoJoinRequest = fmt.Errorf("%w: no pending join request", ErrNotFound)
+)
+
+var (
+	ErrInvalidAttachment    = fmt.Errorf("%w: attachments must be your own and not sent yet", ErrInvalidInput)
+	ErrTooManyAttachments   = fmt.Errorf("%w: too many attachments", ErrInvalidInput)
+	ErrAttachmentTooLarge   = fmt.Errorf("%w: attachment too large", ErrInvalidInput)
+	ErrUnsupportedMediaType = fmt.Errorf("%w: unsupported attachment type", ErrInvalidInput)
+)
+
+var ErrInvalidEmoji = fmt.Errorf("%w: invalid emoji", ErrInvalidInput)
+
+var ErrInvalidSearch = fmt.Errorf("%w: search text is empty or too long", ErrInvalidInput)
+
+var ErrInvalidRecipient = fmt.Errorf("%w: recipient must be another user", ErrInvalidInput)
+
+var ErrInvalidReply = fmt.Errorf("%w: can only reply to a message of the same conversation", ErrInvalidInput)
+
+var (
+	ErrInvalidRole       = fmt.Errorf("%w: invalid role", ErrInvalidInput)
+	ErrInvalidVisibility = fmt.Errorf("%w: invalid visibility", ErrInvalidInput)
+)
+
+// ErrUnauthorized is returned when credentials are missing, invalid or revoked.
+var ErrUnauthorized = errors.New("unauthorized")
+
+var (
+	ErrInvalidRefreshToken = fmt.Errorf("%w: invalid refresh token", ErrUnauthorized)
+	ErrRefreshTokenReused  = fmt.Errorf("%w: refresh token reused, session revoked", ErrUnauthorized)
+	ErrTokenRevoked        = fmt.Errorf("%w: token revoked", ErrUnauthorized)
+	ErrInvalidCredentials  = fmt.Errorf("%w: invalid credentials", ErrUnauthorized)
+)
+
+var ErrEmailTaken = fmt.Errorf("%w: email is already registered", ErrInvalidInput)
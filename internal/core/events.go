@@ -0,0 +1,42 @@
+package core
+
+import (
+	"encoding/json"
+
+	"github.com/google/uuid"
+)
+
+// Event types pushed from the server to websocket clients.
+const (
+	EventMessageNew      = "message.new"
+	EventMessageUpdated  = "message.updated"
+	EventMessageDeleted  = "message.deleted"
+	EventGroupMembership = "group.membership"
+	EventPresenceUpdate  = "presence.update"
+	EventReactionChanged = "reaction.changed"
+	EventTypingUpdate    = "typing.update"
+	EventReceiptUpdate   = "receipt.update"
+)
+
+// Event is the payload published on pub/sub channels. The hub forwards it to
+// every local client subscribed to the channel.
+type Event struct {
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+// NewEvent encodes payload into a serialized Event ready to be published.
+func NewEvent(typ string, payload any) (string, error) {
+	p, err := json.Marshal(payload)
+	if err != nil {
+		return "", err
+	}
+	b, err := json.Marshal(Event{Type: typ, Payload: p})
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+func PrivateChannel(userID uuid.UUID) string { return "private:" + userID.String() }
+func GroupChannel(groupID uuid.UUID) string  { return "group:" + groupID.String() }
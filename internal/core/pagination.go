@@ -0,0 +1,94 @@
+package core
+
+import (
+	"encoding/base64"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// Cursor is a position in message history, keyed on (created_at, id) so that
+// messages sharing a timestamp are still strictly ordered.
+type Cursor struct {
+	CreatedAt time.Time
+	ID        uuid.UUID
+}
+
+func CursorOf(m *Message) *Cursor { return &Cursor{CreatedAt: m.CreatedAt, ID: m.ID} }
+
+// Encode returns the opaque string handed out to clients.
+func (c Cursor) Encode() string {
+	raw := c.CreatedAt.UTC().Format(time.RFC3339Nano) + "|" + c.ID.String()
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func ParseCursor(s string) (*Cursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	ts, id, ok := strings.Cut(string(raw), "|")
+	if !ok {
+		return nil, ErrInvalidCursor
+	}
+	t, err := time.Parse(time.RFC3339Nano, ts)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	uid, err := uuid.Parse(id)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	return &Cursor{CreatedAt: t, ID: uid}, nil
+}
+
+// HistoryQuery selects a page of history. Before returns messages older than
+// the cursor, After messages newer than it; at most one of them is set.
+// Without a cursor the most recent messages are returned.
+type HistoryQuery struct {
+	Before *Cursor
+	After  *Cursor
+	Limit  int
+}
+
+// MessagePage is a page of messages, newest first. NextCursor continues in the
+// same direction as the query and is empty once there is nothing left.
+type MessagePage struct {
+	Messages   []Message `json:"messages"`
+	NextCursor string    `json:"next_cursor,omitempty"`
+}
+
+// ThreadPage is a page of replies in the thread started by Root.
+type ThreadPage struct {
+	Root *Message `json:"root"`
+	MessagePage
+}
+
+// SearchQuery selects messages matching Text, in web search syntax, among
+// those the searcher can see. The optional filters narrow it down to a sender,
+// a group and a creation time in [Since, Until). It pages like history.
+type SearchQuery struct {
+	Text     string
+	SenderID *uuid.UUID
+	GroupID  *uuid.UUID
+	Since    *time.Time
+	Until    *time.Time
+	HistoryQuery
+}
+
+// SearchHit is a message matching a search. Snippet is an excerpt of its
+// content, HTML escaped, with the matching words wrapped in <mark> tags.
+type SearchHit struct {
+	Message Message `json:"message"`
+	Snippet string  `json:"snippet"`
+}
+
+// SearchPage is a page of search hits, newest first.
+type SearchPage struct {
+	Hits       []SearchHit `json:"hits"`
+	NextCursor string      `json:"next_cursor,omitempty"`
+}
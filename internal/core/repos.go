@@ -2,6 +2,7 @@ package core
 
 import (
 	"context"
+	"time"
 
 	"github.com/google/uuid"
 )
@@ -13,19 +14,117 @@ type UserRepository interface {
 	GetUserByEmail(ctx context.Context, email string) (*User, error)
 	GetUserByID(ctx context.Context, id uuid.UUID) (*User, error)
 	VerifyPassword(ctx context.Context, email, plain string) (*User, error)
+	// ListContacts returns the users sharing a group or a private conversation with userID
+	ListContacts(ctx context.Context, userID uuid.UUID) ([]uuid.UUID, error)
 }
 
 type GroupRepository interface {
 	CreateGroup(ctx context.Context, g *Group) error
+	GetGroup(ctx context.Context, id uuid.UUID) (*Group, error)
+	UpdateGroup(ctx context.Context, g *Group) error
+	// DeleteGroup removes the group together with its members and messages
+	DeleteGroup(ctx context.Context, id uuid.UUID) error
 	MyGroups(ctx context.Context, userId uuid.UUID) ([]Group, error)
-	AddGroupMember(ctx context.Context, groupID, userID uuid.UUID) error
-	ListGroupMembers(ctx context.Context, groupID uuid.UUID) ([]User, error)
+	AddGroupMember(ctx context.Context, groupID, userID uuid.UUID, role GroupRole) error
+	RemoveGroupMember(ctx context.Context, groupID, userID uuid.UUID) error
+	GetMember(ctx context.Context, groupID, userID uuid.UUID) (*GroupMember, error)
+	SetMemberRole(ctx context.Context, groupID, userID uuid.UUID, role GroupRole) error
+	// TransferOwnership makes userID the owner and demotes the previous owner to admin
+	TransferOwnership(ctx context.Context, groupID, userID uuid.UUID) error
+	// ListGroupMembers returns members with their user loaded, oldest member first
+	ListGroupMembers(ctx context.Context, groupID uuid.UUID) ([]GroupMember, error)
+	IsMember(ctx context.Context, groupID, userID uuid.UUID) (bool, error)
+
+	CreateInvite(ctx context.Context, inv *GroupInvite) error
+	ListInvites(ctx context.Context, groupID uuid.UUID) ([]GroupInvite, error)
+	DeleteInvite(ctx context.Context, groupID uuid.UUID, token string) error
+	// GetInvite looks an invite up without using it; an unknown token is ErrInvalidInvite
+	GetInvite(ctx context.Context, token string) (*GroupInvite, error)
+	// UseInvite atomically counts one use of a valid invite, or returns ErrInvalidInvite
+	UseInvite(ctx context.Context, token string, now time.Time) (*GroupInvite, error)
+
+	// SaveJoinRequest creates the request or resets an existing one to r's status
+	SaveJoinRequest(ctx context.Context, r *GroupJoinRequest) error
+	ListJoinRequests(ctx context.Context, groupID uuid.UUID, status JoinRequestStatus) ([]GroupJoinRequest, error)
+	// DecideJoinRequest moves a pending request to status, or returns ErrNoJoinRequest
+	DecideJoinRequest(ctx context.Context, groupID, userID, decidedBy uuid.UUID, status JoinRequestStatus) error
 }
 
 type MessageRepository interface {
+	// SaveMessage stores m and links m.Attachments to it. It fails with
+	// ErrInvalidAttachment unless they are the sender's and not sent yet.
 	SaveMessage(ctx context.Context, m *Message) error
-	GetPrivateHistory(ctx context.Context, a, b uuid.UUID, limit int) ([]Message, error)
-	GetGroupHistory(ctx context.Context, groupID uuid.UUID, limit int) ([]Message, error)
+	GetMessage(ctx context.Context, id uuid.UUID) (*Message, error)
+	// EditMessage replaces the content of a message that isn't deleted,
+	// keeping the previous content in its edit history
+	EditMessage(ctx context.Context, m *Message, content string, at time.Time) error
+	// DeleteMessage turns the message into a tombstone and drops its edit
+	// history, reactions and attachments
+	DeleteMessage(ctx context.Context, m *Message, by uuid.UUID, at time.Time) error
+	// ListEdits returns the previous contents of a message, oldest first
+	ListEdits(ctx context.Context, messageID uuid.UUID) ([]MessageEdit, error)
+	// history is returned newest first
+	GetPrivateHistory(ctx context.Context, a, b uuid.UUID, q HistoryQuery) ([]Message, error)
+	GetGroupHistory(ctx context.Context, groupID uuid.UUID, q HistoryQuery) ([]Message, error)
+	GetThread(ctx context.Context, rootID uuid.UUID, q HistoryQuery) ([]Message, error)
+	// ListConversations returns the user's private conversations and groups,
+	// most recently active first. Messages after the user's read cursor that
+	// others sent count as unread.
+	ListConversations(ctx context.Context, userID uuid.UUID) ([]Conversation, error)
+	// SearchMessages returns the messages matching q in the user's private
+	// conversations and groups, newest first. Deleted messages never match.
+	SearchMessages(ctx context.Context, userID uuid.UUID, q SearchQuery) ([]SearchHit, error)
+}
+
+type AttachmentRepository interface {
+	CreateAttachment(ctx context.Context, a *Attachment) error
+	GetAttachment(ctx context.Context, id uuid.UUID) (*Attachment, error)
+	// ListAttachments returns the attachments with the given ids that exist
+	ListAttachments(ctx context.Context, ids []uuid.UUID) ([]Attachment, error)
+	MessageAttachments(ctx context.Context, messageID uuid.UUID) ([]Attachment, error)
+	// GroupAttachments returns the attachments of every message in the group
+	GroupAttachments(ctx context.Context, groupID uuid.UUID) ([]Attachment, error)
+	// SetAttachmentPreview records the dimensions and thumbnail of an image
+	// and returns the updated attachment
+	SetAttachmentPreview(ctx context.Context, id uuid.UUID, width, height int, thumbnail bool) (*Attachment, error)
+}
+
+type ReactionRepository interface {
+	// AddReaction reports false when the user already reacted with that emoji
+	AddReaction(ctx context.Context, r *Reaction) (bool, error)
+	// RemoveReaction reports false when there was no such reaction
+	RemoveReaction(ctx context.Context, messageID, userID uuid.UUID, emoji string) (bool, error)
+	// CountReactions aggregates the reactions of each message, most used emoji
+	// first; Me is set for the emoji viewer reacted with
+	CountReactions(ctx context.Context, messageIDs []uuid.UUID, viewer uuid.UUID) (map[uuid.UUID][]ReactionCount, error)
+}
+
+type ReceiptRepository interface {
+	// MarkDelivered records that userID received the message and reports
+	// whether this is the first time.
+	MarkDelivered(ctx context.Context, messageID, userID uuid.UUID, at time.Time) (bool, error)
+	// MarkRead moves userID's read cursor in m's conversation forward to m and
+	// records read receipts for the messages it passed, up to limit of the
+	// newest ones, which are returned. It returns nothing when the cursor is
+	// already at or past m.
+	MarkRead(ctx context.Context, userID uuid.UUID, m *Message, at time.Time, limit int) ([]Message, error)
+	ListReceipts(ctx context.Context, messageID uuid.UUID) ([]MessageReceipt, error)
+	CountReceipts(ctx context.Context, messageIDs []uuid.UUID) (map[uuid.UUID]ReceiptCounts, error)
+}
+
+type SessionRepository interface {
+	CreateSession(ctx context.Context, s *Session) error
+	GetSession(ctx context.Context, id uuid.UUID) (*Session, error)
+	// ListSessions returns the user's sessions that are neither revoked nor expired
+	ListSessions(ctx context.Context, userID uuid.UUID, now time.Time) ([]Session, error)
+	TouchSession(ctx context.Context, id uuid.UUID, lastUsed, expires time.Time) error
+	RevokeSession(ctx context.Context, id uuid.UUID, now time.Time) error
+
+	SaveRefreshToken(ctx context.Context, t *RefreshToken) error
+	// ConsumeRefreshToken marks an unused token as used and returns it. A token
+	// that was already used is returned along with ErrRefreshTokenReused; an
+	// unknown token yields ErrInvalidRefreshToken.
+	ConsumeRefreshToken(ctx context.Context, hash string, now time.Time) (*RefreshToken, error)
 }
 
 // Repositories groups
@@ -33,4 +132,8 @@ type Repositories interface {
 	UserRepo() UserRepository
 	GroupRepo() GroupRepository
 	MessageRepo() MessageRepository
+	AttachmentRepo() AttachmentRepository
+	ReactionRepo() ReactionRepository
+	ReceiptRepo() ReceiptRepository
+	SessionRepo() SessionRepository
 }
@@ -0,0 +1,21 @@
+package core
+
+import (
+	"context"
+	"io"
+	"time"
+)
+
+// AttachmentStore keeps the content of uploaded attachments under keys chosen
+// by the caller. Get returns ErrNotFound for a key that was never stored.
+type AttachmentStore interface {
+	Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	Delete(ctx context.Context, key string) error
+}
+
+// AttachmentURLSigner is implemented by stores that can hand out short lived
+// download URLs, so clients fetch content from the store directly.
+type AttachmentURLSigner interface {
+	SignedURL(ctx context.Context, key, fileName string, ttl time.Duration) (string, error)
+}
@@ -0,0 +1,187 @@
+package usecases
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"example.com/go-chat/internal/core"
+	"github.com/google/uuid"
+)
+
+const (
+	// MaxAttachmentSize is the largest file that can be uploaded.
+	MaxAttachmentSize = 10 << 20
+	// MaxAttachmentsPerMessage bounds how many files one message can carry.
+	MaxAttachmentsPerMessage = 10
+	// SignedURLTTL is how long a signed download URL stays valid.
+	SignedURLTTL = 5 * time.Minute
+)
+
+// AllowedAttachmentTypes lists the content types accepted for upload. The
+// type is sniffed from the content, whatever the client claims.
+var AllowedAttachmentTypes = map[string]bool{
+	"image/jpeg":      true,
+	"image/png":       true,
+	"image/gif":       true,
+	"image/webp":      true,
+	"application/pdf": true,
+	"text/plain":      true,
+	"application/zip": true,
+	"audio/mpeg":      true,
+	"video/mp4":       true,
+}
+
+// AttachmentUsecase uploads files to the AttachmentStore and guards downloads.
+// Uploaded images are handed to the ThumbnailWorker, when there is one.
+type AttachmentUsecase struct {
+	repos  core.Repositories
+	store  core.AttachmentStore
+	thumbs *ThumbnailWorker
+}
+
+func NewAttachmentUsecase(r core.Repositories, store core.AttachmentStore, thumbs *ThumbnailWorker) *AttachmentUsecase {
+	return &AttachmentUsecase{repos: r, store: store, thumbs: thumbs}
+}
+
+// Upload stores a file of size bytes for user. It can then be sent with a
+// message by its id.
+func (a *AttachmentUsecase) Upload(ctx context.Context, user uuid.UUID, fileName string, size int64, r io.Reader) (*core.Attachment, error) {
+	if size > MaxAttachmentSize {
+		return nil, core.ErrAttachmentTooLarge
+	}
+	br := bufio.NewReaderSize(io.LimitReader(r, size), 512)
+	head, err := br.Peek(512)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	contentType, _, err := mime.ParseMediaType(http.DetectContentType(head))
+	if err != nil || !AllowedAttachmentTypes[contentType] {
+		return nil, core.ErrUnsupportedMediaType
+	}
+
+	att := &core.Attachment{
+		ID:          uuid.New(),
+		UploaderID:  user,
+		FileName:    filepath.Base(fileName),
+		ContentType: contentType,
+		Size:        size,
+	}
+	att.StorageKey = "attachments/" + att.ID.String()
+	if err := a.store.Put(ctx, att.StorageKey, br, size, contentType); err != nil {
+		return nil, err
+	}
+	if err := a.repos.AttachmentRepo().CreateAttachment(ctx, att); err != nil {
+		_ = a.store.Delete(ctx, att.StorageKey)
+		return nil, err
+	}
+	if a.thumbs != nil {
+		a.thumbs.Enqueue(att)
+	}
+	return att, nil
+}
+
+// Download is how a file is served: from URL when the store signs URLs, from
+// Body otherwise. The caller closes Body. Size is -1 when unknown.
+type Download struct {
+	FileName    string
+	ContentType string
+	Size        int64
+	URL         string
+	Body        io.ReadCloser
+}
+
+// Download lets the uploader of an unsent attachment, or anyone in the
+// conversation of the message it was sent with, fetch it.
+func (a *AttachmentUsecase) Download(ctx context.Context, user, id uuid.UUID) (*Download, error) {
+	att, err := a.visible(ctx, user, id)
+	if err != nil {
+		return nil, err
+	}
+	return a.serve(ctx, att.StorageKey, &Download{FileName: att.FileName, ContentType: att.ContentType, Size: att.Size})
+}
+
+// Thumbnail serves the JPEG thumbnail of an image, with the same access as
+// Download. It is not found until the ThumbnailWorker has made it.
+func (a *AttachmentUsecase) Thumbnail(ctx context.Context, user, id uuid.UUID) (*Download, error) {
+	att, err := a.visible(ctx, user, id)
+	if err != nil {
+		return nil, err
+	}
+	if !att.Thumbnail {
+		return nil, core.ErrNotFound
+	}
+	name := strings.TrimSuffix(att.FileName, filepath.Ext(att.FileName)) + "-thumb.jpg"
+	return a.serve(ctx, att.ThumbnailKey(), &Download{FileName: name, ContentType: "image/jpeg", Size: -1})
+}
+
+func (a *AttachmentUsecase) visible(ctx context.Context, user, id uuid.UUID) (*core.Attachment, error) {
+	att, err := a.repos.AttachmentRepo().GetAttachment(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if att.MessageID == nil {
+		if att.UploaderID != user {
+			return nil, core.ErrNotFound
+		}
+	} else if _, err := participantMessage(ctx, a.repos, user, *att.MessageID); err != nil {
+		return nil, err
+	}
+	return att, nil
+}
+
+func (a *AttachmentUsecase) serve(ctx context.Context, key string, d *Download) (*Download, error) {
+	if signer, ok := a.store.(core.AttachmentURLSigner); ok {
+		u, err := signer.SignedURL(ctx, key, d.FileName, SignedURLTTL)
+		if err != nil {
+			return nil, err
+		}
+		d.URL = u
+		return d, nil
+	}
+	body, err := a.store.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	d.Body = body
+	return d, nil
+}
+
+// sendable loads the attachments to send with a message from user.
+func sendable(ctx context.Context, repos core.Repositories, user uuid.UUID, ids []uuid.UUID) ([]core.Attachment, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	if len(ids) > MaxAttachmentsPerMessage {
+		return nil, core.ErrTooManyAttachments
+	}
+	atts, err := repos.AttachmentRepo().ListAttachments(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+	if len(atts) != len(ids) {
+		return nil, core.ErrInvalidAttachment
+	}
+	for _, att := range atts {
+		if att.UploaderID != user || att.MessageID != nil {
+			return nil, core.ErrInvalidAttachment
+		}
+	}
+	return atts, nil
+}
+
+// removeFiles deletes the stored files of attachments whose rows are gone. A
+// file left behind by a failed delete is unreachable, so errors are ignored.
+func removeFiles(ctx context.Context, store core.AttachmentStore, atts []core.Attachment) {
+	for _, att := range atts {
+		_ = store.Delete(ctx, att.StorageKey)
+		if att.Thumbnail {
+			_ = store.Delete(ctx, att.ThumbnailKey())
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package usecases
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"example.com/go-chat/internal/core"
+	"example.com/go-chat/internal/drivers"
+	"github.com/google/uuid"
+)
+
+// stubAttachments keeps attachments in a map; a nil map holds none.
+type stubAttachments map[uuid.UUID]*core.Attachment
+
+func (s stubAttachments) CreateAttachment(ctx context.Context, att *core.Attachment) error {
+	s[att.ID] = att
+	return nil
+}
+
+func (s stubAttachments) GetAttachment(ctx context.Context, id uuid.UUID) (*core.Attachment, error) {
+	att, ok := s[id]
+	if !ok {
+		return nil, core.ErrNotFound
+	}
+	return att, nil
+}
+
+func (s stubAttachments) ListAttachments(ctx context.Context, ids []uuid.UUID) ([]core.Attachment, error) {
+	var atts []core.Attachment
+	for _, id := range ids {
+		if att, ok := s[id]; ok {
+			atts = append(atts, *att)
+		}
+	}
+	return atts, nil
+}
+
+func (s stubAttachments) MessageAttachments(ctx context.Context, messageID uuid.UUID) ([]core.Attachment, error) {
+	var atts []core.Attachment
+	for _, att := range s {
+		if att.MessageID != nil && *att.MessageID == messageID {
+			atts = append(atts, *att)
+		}
+	}
+	return atts, nil
+}
+
+// GroupAttachments finds none: the stub doesn't know which group a message is in.
+func (s stubAttachments) GroupAttachments(ctx context.Context, groupID uuid.UUID) ([]core.Attachment, error) {
+	return nil, nil
+}
+
+func (s stubAttachments) SetAttachmentPreview(ctx context.Context, id uuid.UUID, width, height int, thumbnail bool) (*core.Attachment, error) {
+	att, ok := s[id]
+	if !ok {
+		return nil, core.ErrNotFound
+	}
+	att.Width, att.Height, att.Thumbnail = width, height, thumbnail
+	return att, nil
+}
+
+var pngHeader = []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")
+
+func newAttachmentTest(t *testing.T) (*AttachmentUsecase, *editRepos) {
+	store, err := drivers.NewLocalStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	repos := &editRepos{
+		groups:      &roleGroups{roles: map[uuid.UUID]core.GroupRole{}},
+		messages:    &editableMessages{messageByID{msgs: map[uuid.UUID]*core.Message{}}},
+		attachments: stubAttachments{},
+	}
+	return NewAttachmentUsecase(repos, store, nil), repos
+}
+
+func TestUploadChecksSniffedTypeAndSize(t *testing.T) {
+	ctx := context.Background()
+	a, repos := newAttachmentTest(t)
+	user := uuid.New()
+
+	script := []byte("#!/bin/sh\nrm -rf /\n\x00\x01")
+	if _, err := a.Upload(ctx, user, "cat.png", int64(len(script)), bytes.NewReader(script)); !errors.Is(err, core.ErrUnsupportedMediaType) {
+		t.Fatalf("Upload of a binary named .png: got %v, want ErrUnsupportedMediaType", err)
+	}
+	if _, err := a.Upload(ctx, user, "big.png", MaxAttachmentSize+1, bytes.NewReader(pngHeader)); !errors.Is(err, core.ErrAttachmentTooLarge) {
+		t.Fatalf("Upload over the limit: got %v, want ErrAttachmentTooLarge", err)
+	}
+	if len(repos.attachments) != 0 {
+		t.Fatalf("rejected uploads were recorded")
+	}
+
+	att, err := a.Upload(ctx, user, "../../cat.txt", int64(len(pngHeader)), bytes.NewReader(pngHeader))
+	if err != nil {
+		t.Fatalf("Upload: %v", err)
+	}
+	if att.ContentType != "image/png" || att.FileName != "cat.txt" || att.Size != int64(len(pngHeader)) {
+		t.Fatalf("Upload: got %+v", att)
+	}
+}
+
+func TestDownloadIsLimitedToTheConversation(t *testing.T) {
+	ctx := context.Background()
+	a, repos := newAttachmentTest(t)
+	sender, recipient, outsider := uuid.New(), uuid.New(), uuid.New()
+
+	att, err := a.Upload(ctx, sender, "cat.png", int64(len(pngHeader)), bytes.NewReader(pngHeader))
+	if err != nil {
+		t.Fatalf("Upload: %v", err)
+	}
+	if _, err := a.Download(ctx, recipient, att.ID); !errors.Is(err, core.ErrNotFound) {
+		t.Fatalf("Download of an unsent attachment by another user: got %v, want ErrNotFound", err)
+	}
+
+	m := &core.Message{ID: uuid.New(), SenderID: sender, RecipientID: &recipient}
+	repos.messages.msgs[m.ID] = m
+	att.MessageID = &m.ID
+	if _, err := a.Download(ctx, outsider, att.ID); !errors.Is(err, core.ErrForbidden) {
+		t.Fatalf("Download by outsider: got %v, want ErrForbidden", err)
+	}
+	d, err := a.Download(ctx, recipient, att.ID)
+	if err != nil {
+		t.Fatalf("Download by recipient: %v", err)
+	}
+	defer d.Body.Close()
+	if body, _ := io.ReadAll(d.Body); !bytes.Equal(body, pngHeader) {
+		t.Fatalf("Download: got %q", body)
+	}
+}
+
+func TestSendOnlyOwnUnsentAttachments(t *testing.T) {
+	ctx := context.Background()
+	a, repos := newAttachmentTest(t)
+	chat := NewChatUsecase(repos, nil, a.store)
+	sender, other := uuid.New(), uuid.New()
+
+	att, err := a.Upload(ctx, other, "cat.png", int64(len(pngHeader)), bytes.NewReader(pngHeader))
+	if err != nil {
+		t.Fatalf("Upload: %v", err)
+	}
+	if _, err := chat.SendPrivate(ctx, sender, other, Draft{Attachments: []uuid.UUID{att.ID}}); !errors.Is(err, core.ErrInvalidAttachment) {
+		t.Fatalf("SendPrivate with another user's attachment: got %v, want ErrInvalidAttachment", err)
+	}
+	if _, err := chat.SendPrivate(ctx, sender, other, Draft{}); !errors.Is(err, core.ErrInvalidInput) {
+		t.Fatalf("SendPrivate without content or attachments: got %v, want ErrInvalidInput", err)
+	}
+}
+
+func TestDeleteGroupRemovesFiles(t *testing.T) {
+	ctx := context.Background()
+	repos, broker := drivers.NewMemory(), drivers.NewLocalBroker()
+	store, err := drivers.NewLocalStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	owner := &core.User{Username: "owner", Email: "owner@example.com"}
+	if err := repos.UserRepo().CreateUser(ctx, owner, "password"); err != nil {
+		t.Fatal(err)
+	}
+	groups := NewGroupUsecase(repos, broker, store)
+	g, err := groups.Create(ctx, owner.ID, "team", core.VisibilityPublic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	att, err := NewAttachmentUsecase(repos, store, nil).Upload(ctx, owner.ID, "notes.txt", 5, strings.NewReader("notes"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewChatUsecase(repos, broker, store).SendGroup(ctx, owner.ID, g.ID, Draft{Attachments: []uuid.UUID{att.ID}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := groups.Delete(ctx, owner.ID, g.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Get(ctx, att.StorageKey); err == nil {
+		t.Error("the attachment's file outlived its group")
+	}
+}
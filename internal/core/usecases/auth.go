@@ -2,6 +2,11 @@ package usecases
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
 	"time"
 
 	"example.com/go-chat/internal/core"
@@ -9,12 +14,44 @@ import (
 	"github.com/google/uuid"
 )
 
+const (
+	AccessTokenTTL  = 15 * time.Minute
+	RefreshTokenTTL = 30 * 24 * time.Hour
+)
+
+// RevocationChannel carries revoked tokens and sessions so every Hub instance
+// can disconnect the websocket clients that authenticated with them.
+const RevocationChannel = "revocations"
+
+// RevocationEvent names either a single access token or a whole session.
+type RevocationEvent struct {
+	TokenID   string    `json:"jti,omitempty"`
+	SessionID uuid.UUID `json:"session_id,omitempty"`
+}
+
 type AuthUsecase struct {
-	repos core.Repositories
-	jwt   *drivers.JWTManager
+	repos    core.Repositories
+	jwt      *drivers.JWTManager
+	denylist core.TokenDenylist
+	broker   core.Broker
 }
 
-func NewAuthUsecase(r core.Repositories, j *drivers.JWTManager) *AuthUsecase { return &AuthUsecase{repos: r, jwt: j} }
+func NewAuthUsecase(r core.Repositories, j *drivers.JWTManager, denylist core.TokenDenylist, broker core.Broker) *AuthUsecase {
+	return &AuthUsecase{repos: r, jwt: j, denylist: denylist, broker: broker}
+}
+
+// TokenPair is handed to clients on login and refresh.
+type TokenPair struct {
+	AccessToken  string `json:"token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int    `json:"expires_in"`
+}
+
+// Device describes the client a session was opened from.
+type Device struct {
+	UserAgent string
+	IP        string
+}
 
 func (a *AuthUsecase) SignUp(ctx context.Context, username, email, password string) (*core.User, error) {
 	u := &core.User{Username: username, Email: email}
@@ -24,18 +61,154 @@ func (a *AuthUsecase) SignUp(ctx context.Context, username, email, password stri
 	return u, nil
 }
 
-func (a *AuthUsecase) Login(ctx context.Context, email, password string) (string, *core.User, error) {
+// Login verifies the credentials and opens a new session for the device.
+func (a *AuthUsecase) Login(ctx context.Context, email, password string, device Device) (*TokenPair, *core.User, error) {
 	u, err := a.repos.UserRepo().VerifyPassword(ctx, email, password)
 	if err != nil {
-		return "", nil, err
+		return nil, nil, err
+	}
+	now := time.Now()
+	s := &core.Session{
+		ID:         uuid.New(),
+		UserID:     u.ID,
+		UserAgent:  truncate(device.UserAgent, 255),
+		IP:         device.IP,
+		CreatedAt:  now,
+		LastUsedAt: now,
+		ExpiresAt:  now.Add(RefreshTokenTTL),
 	}
-	token, err := a.jwt.Generate(u.ID, time.Hour*24)
+	if err := a.repos.SessionRepo().CreateSession(ctx, s); err != nil {
+		return nil, nil, err
+	}
+	pair, err := a.issue(ctx, s, now)
 	if err != nil {
-		return "", nil, err
+		return nil, nil, err
 	}
-	return token, u, nil
+	return pair, u, nil
+}
+
+// Refresh rotates a refresh token: the presented token is spent and a new pair
+// is issued for the same session. Presenting a spent token revokes the session.
+func (a *AuthUsecase) Refresh(ctx context.Context, refreshToken string) (*TokenPair, error) {
+	now := time.Now()
+	t, err := a.repos.SessionRepo().ConsumeRefreshToken(ctx, hashToken(refreshToken), now)
+	if errors.Is(err, core.ErrRefreshTokenReused) {
+		_ = a.revokeSession(ctx, t.SessionID, now)
+		return nil, err
+	}
+	if err != nil {
+		return nil, err
+	}
+	if now.After(t.ExpiresAt) {
+		return nil, core.ErrInvalidRefreshToken
+	}
+	s, err := a.repos.SessionRepo().GetSession(ctx, t.SessionID)
+	if err != nil {
+		return nil, err
+	}
+	if !s.Active(now) {
+		return nil, core.ErrInvalidRefreshToken
+	}
+	return a.issue(ctx, s, now)
+}
+
+// Logout revokes the session the refresh token belongs to.
+func (a *AuthUsecase) Logout(ctx context.Context, refreshToken string) error {
+	now := time.Now()
+	t, err := a.repos.SessionRepo().ConsumeRefreshToken(ctx, hashToken(refreshToken), now)
+	if err != nil && !errors.Is(err, core.ErrRefreshTokenReused) {
+		return err
+	}
+	err = a.revokeSession(ctx, t.SessionID, now)
+	if errors.Is(err, core.ErrNotFound) {
+		return nil
+	}
+	return err
+}
+
+// RevokeAccessToken denylists a single access token for the rest of its lifetime.
+func (a *AuthUsecase) RevokeAccessToken(ctx context.Context, claims *drivers.Claims) {
+	if err := a.denylist.RevokeToken(ctx, claims.ID, time.Until(claims.ExpiresAt)); err != nil {
+		log.Println("denylist token", err)
+	}
+	a.publishRevocation(ctx, RevocationEvent{TokenID: claims.ID})
+}
+
+// Sessions lists the active sessions of user, flagging the current one.
+func (a *AuthUsecase) Sessions(ctx context.Context, user, current uuid.UUID) ([]core.Session, error) {
+	sessions, err := a.repos.SessionRepo().ListSessions(ctx, user, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	for i := range sessions {
+		sessions[i].Current = sessions[i].ID == current
+	}
+	return sessions, nil
+}
+
+// RevokeSession signs one of the user's devices out.
+func (a *AuthUsecase) RevokeSession(ctx context.Context, user, session uuid.UUID) error {
+	s, err := a.repos.SessionRepo().GetSession(ctx, session)
+	if err != nil {
+		return err
+	}
+	if s.UserID != user {
+		return core.ErrNotFound
+	}
+	return a.revokeSession(ctx, session, time.Now())
+}
+
+// revokeSession ends a session: its refresh tokens stop working and its
+// access tokens are denylisted until they expire.
+func (a *AuthUsecase) revokeSession(ctx context.Context, session uuid.UUID, now time.Time) error {
+	if err := a.repos.SessionRepo().RevokeSession(ctx, session, now); err != nil {
+		return err
+	}
+	if err := a.denylist.RevokeSessionTokens(ctx, session.String(), AccessTokenTTL); err != nil {
+		log.Println("denylist session", err)
+	}
+	a.publishRevocation(ctx, RevocationEvent{SessionID: session})
+	return nil
+}
+
+func (a *AuthUsecase) publishRevocation(ctx context.Context, ev RevocationEvent) {
+	b, _ := json.Marshal(ev)
+	_ = a.broker.Publish(ctx, RevocationChannel, string(b))
 }
 
 func (a *AuthUsecase) Me(ctx context.Context, id uuid.UUID) (*core.User, error) {
 	return a.repos.UserRepo().GetUserByID(ctx, id)
 }
+
+// issue signs an access token for s and stores a fresh refresh token, sliding the session expiry.
+func (a *AuthUsecase) issue(ctx context.Context, s *core.Session, now time.Time) (*TokenPair, error) {
+	access, err := a.jwt.Generate(s.UserID, s.ID, AccessTokenTTL)
+	if err != nil {
+		return nil, err
+	}
+	refresh, err := randomToken()
+	if err != nil {
+		return nil, err
+	}
+	expires := now.Add(RefreshTokenTTL)
+	t := &core.RefreshToken{Hash: hashToken(refresh), SessionID: s.ID, ExpiresAt: expires, CreatedAt: now}
+	if err := a.repos.SessionRepo().SaveRefreshToken(ctx, t); err != nil {
+		return nil, err
+	}
+	if err := a.repos.SessionRepo().TouchSession(ctx, s.ID, now, expires); err != nil {
+		return nil, err
+	}
+	return &TokenPair{AccessToken: access, RefreshToken: refresh, ExpiresIn: int(AccessTokenTTL.Seconds())}, nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n]
+}
@@ -0,0 +1,142 @@
+package usecases
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"example.com/go-chat/internal/core"
+	"example.com/go-chat/internal/drivers"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/google/uuid"
+)
+
+type authRepos struct {
+	core.Repositories
+	users    *stubUsers
+	sessions *stubSessions
+}
+
+func (r *authRepos) UserRepo() core.UserRepository       { return r.users }
+func (r *authRepos) SessionRepo() core.SessionRepository { return r.sessions }
+
+type stubUsers struct {
+	core.UserRepository
+	user core.User
+}
+
+func (u *stubUsers) VerifyPassword(ctx context.Context, email, plain string) (*core.User, error) {
+	return &u.user, nil
+}
+
+type stubSessions struct {
+	sessions map[uuid.UUID]*core.Session
+	tokens   map[string]*core.RefreshToken
+}
+
+func (s *stubSessions) CreateSession(ctx context.Context, sess *core.Session) error {
+	s.sessions[sess.ID] = sess
+	return nil
+}
+
+func (s *stubSessions) GetSession(ctx context.Context, id uuid.UUID) (*core.Session, error) {
+	sess, ok := s.sessions[id]
+	if !ok {
+		return nil, core.ErrNotFound
+	}
+	return sess, nil
+}
+
+func (s *stubSessions) ListSessions(ctx context.Context, userID uuid.UUID, now time.Time) ([]core.Session, error) {
+	return nil, nil
+}
+
+func (s *stubSessions) TouchSession(ctx context.Context, id uuid.UUID, lastUsed, expires time.Time) error {
+	return nil
+}
+
+func (s *stubSessions) RevokeSession(ctx context.Context, id uuid.UUID, now time.Time) error {
+	s.sessions[id].RevokedAt = &now
+	return nil
+}
+
+func (s *stubSessions) SaveRefreshToken(ctx context.Context, t *core.RefreshToken) error {
+	s.tokens[t.Hash] = t
+	return nil
+}
+
+func (s *stubSessions) ConsumeRefreshToken(ctx context.Context, hash string, now time.Time) (*core.RefreshToken, error) {
+	t, ok := s.tokens[hash]
+	if !ok {
+		return nil, core.ErrInvalidRefreshToken
+	}
+	if t.UsedAt != nil {
+		return t, core.ErrRefreshTokenReused
+	}
+	t.UsedAt = &now
+	return t, nil
+}
+
+func newStubAuth(t *testing.T) *AuthUsecase {
+	repos := &authRepos{
+		users:    &stubUsers{user: core.User{ID: uuid.New()}},
+		sessions: &stubSessions{sessions: map[uuid.UUID]*core.Session{}, tokens: map[string]*core.RefreshToken{}},
+	}
+	rds := drivers.NewRedis(miniredis.RunT(t).Addr())
+	return NewAuthUsecase(repos, drivers.NewJWTManager("test-secret"), rds, rds)
+}
+
+func TestRefreshRotatesTokens(t *testing.T) {
+	ctx := context.Background()
+	auth := newStubAuth(t)
+	first, _, err := auth.Login(ctx, "a@example.com", "pw", Device{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := auth.Refresh(ctx, first.RefreshToken)
+	if err != nil {
+		t.Fatalf("refresh: %v", err)
+	}
+	if second.RefreshToken == first.RefreshToken {
+		t.Fatal("refresh token was not rotated")
+	}
+	if _, err := auth.Refresh(ctx, second.RefreshToken); err != nil {
+		t.Fatalf("refresh with rotated token: %v", err)
+	}
+}
+
+func TestRefreshTokenReuseRevokesSession(t *testing.T) {
+	ctx := context.Background()
+	auth := newStubAuth(t)
+	first, _, err := auth.Login(ctx, "a@example.com", "pw", Device{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := auth.Refresh(ctx, first.RefreshToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := auth.Refresh(ctx, first.RefreshToken); !errors.Is(err, core.ErrRefreshTokenReused) {
+		t.Fatalf("reusing a spent token: got %v, want ErrRefreshTokenReused", err)
+	}
+	// the legitimate holder's current token dies with the session
+	if _, err := auth.Refresh(ctx, second.RefreshToken); !errors.Is(err, core.ErrUnauthorized) {
+		t.Fatalf("refresh after reuse: got %v, want ErrUnauthorized", err)
+	}
+}
+
+func TestLogoutRevokesSession(t *testing.T) {
+	ctx := context.Background()
+	auth := newStubAuth(t)
+	pair, _, err := auth.Login(ctx, "a@example.com", "pw", Device{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := auth.Logout(ctx, pair.RefreshToken); err != nil {
+		t.Fatalf("logout: %v", err)
+	}
+	if _, err := auth.Refresh(ctx, pair.RefreshToken); !errors.Is(err, core.ErrUnauthorized) {
+		t.Fatalf("refresh after logout: got %v, want ErrUnauthorized", err)
+	}
+}
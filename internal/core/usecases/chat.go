@@ -2,47 +2,452 @@ package usecases
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
+	"strings"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"example.com/go-chat/internal/core"
-	"example.com/go-chat/internal/drivers"
 	"github.com/google/uuid"
 )
 
 type ChatUsecase struct {
-	repos core.Repositories
-	rds   *drivers.RedisClient
+	repos  core.Repositories
+	broker core.Broker
+	store  core.AttachmentStore
 }
 
-func NewChatUsecase(r core.Repositories, rds *drivers.RedisClient) *ChatUsecase { return &ChatUsecase{repos: r, rds: rds} }
+func NewChatUsecase(r core.Repositories, broker core.Broker, store core.AttachmentStore) *ChatUsecase {
+	return &ChatUsecase{repos: r, broker: broker, store: store}
+}
+
+// Draft is a message about to be sent. It needs content, attachments or both.
+type Draft struct {
+	Content string
+	// ReplyTo quotes a message of the same conversation; the new message joins its thread
+	ReplyTo *uuid.UUID
+	// Attachments are ids of files the sender uploaded and hasn't sent yet
+	Attachments []uuid.UUID
+}
 
-func (c *ChatUsecase) SendPrivate(ctx context.Context, from, to uuid.UUID, content string) (*core.Message, error) {
-	m := &core.Message{SenderID: from, RecipientID: &to, Content: content, CreatedAt: time.Now()}
+func (c *ChatUsecase) SendPrivate(ctx context.Context, from, to uuid.UUID, d Draft) (*core.Message, error) {
+	if err := requirePeer(ctx, c.repos, from, to); err != nil {
+		return nil, err
+	}
+	m := &core.Message{SenderID: from, RecipientID: &to, Content: d.Content, CreatedAt: time.Now()}
+	if err := c.prepare(ctx, m, d); err != nil {
+		return nil, err
+	}
 	if err := c.repos.MessageRepo().SaveMessage(ctx, m); err != nil {
 		return nil, err
 	}
-	b, _ := json.Marshal(m)
-	channel := "private:" + to.String()
-	_ = c.rds.Publish(ctx, channel, string(b))
+	publishEvent(ctx, c.broker, core.EventMessageNew, m, core.PrivateChannel(to), core.PrivateChannel(from))
 	return m, nil
 }
 
-func (c *ChatUsecase) SendGroup(ctx context.Context, from uuid.UUID, group uuid.UUID, content string) (*core.Message, error) {
-	m := &core.Message{SenderID: from, GroupID: &group, Content: content, CreatedAt: time.Now()}
+func (c *ChatUsecase) SendGroup(ctx context.Context, from uuid.UUID, group uuid.UUID, d Draft) (*core.Message, error) {
+	if err := requireMember(ctx, c.repos, group, from); err != nil {
+		return nil, err
+	}
+	m := &core.Message{SenderID: from, GroupID: &group, Content: d.Content, CreatedAt: time.Now()}
+	if err := c.prepare(ctx, m, d); err != nil {
+		return nil, err
+	}
 	if err := c.repos.MessageRepo().SaveMessage(ctx, m); err != nil {
 		return nil, err
 	}
-	b, _ := json.Marshal(m)
-	channel := "group:" + group.String()
-	_ = c.rds.Publish(ctx, channel, string(b))
+	publishEvent(ctx, c.broker, core.EventMessageNew, m, core.GroupChannel(group))
+	return m, nil
+}
+
+// Edit replaces the content of one of user's messages.
+func (c *ChatUsecase) Edit(ctx context.Context, user, id uuid.UUID, content string) (*core.Message, error) {
+	if content == "" {
+		return nil, core.ErrInvalidInput
+	}
+	m, err := c.repos.MessageRepo().GetMessage(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if m.DeletedAt != nil {
+		return nil, core.ErrMessageDeleted
+	}
+	if m.SenderID != user {
+		return nil, core.ErrNotMessageSender
+	}
+	if err := c.repos.MessageRepo().EditMessage(ctx, m, content, time.Now()); err != nil {
+		return nil, err
+	}
+	publishEvent(ctx, c.broker, core.EventMessageUpdated, m, channelsOf(m)...)
+	return m, nil
+}
+
+// Delete leaves a tombstone in place of a message. Senders delete their own
+// messages; group admins and owners delete any message of their group.
+func (c *ChatUsecase) Delete(ctx context.Context, user, id uuid.UUID) (*core.Message, error) {
+	m, err := c.repos.MessageRepo().GetMessage(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if m.DeletedAt != nil {
+		return nil, core.ErrMessageDeleted
+	}
+	if m.SenderID != user {
+		if m.GroupID == nil {
+			return nil, core.ErrNotMessageSender
+		}
+		if _, err := requireRole(ctx, c.repos, *m.GroupID, user, core.RoleAdmin); err != nil {
+			return nil, err
+		}
+	}
+	atts, err := c.repos.AttachmentRepo().MessageAttachments(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.repos.MessageRepo().DeleteMessage(ctx, m, user, time.Now()); err != nil {
+		return nil, err
+	}
+	removeFiles(ctx, c.store, atts)
+	publishEvent(ctx, c.broker, core.EventMessageDeleted, m, channelsOf(m)...)
+	return m, nil
+}
+
+// Edits returns the earlier contents of a message to anyone in its conversation.
+func (c *ChatUsecase) Edits(ctx context.Context, user, id uuid.UUID) ([]core.MessageEdit, error) {
+	if _, err := participantMessage(ctx, c.repos, user, id); err != nil {
+		return nil, err
+	}
+	edits, err := c.repos.MessageRepo().ListEdits(ctx, id)
+	if edits == nil && err == nil {
+		edits = []core.MessageEdit{}
+	}
+	return edits, err
+}
+
+// participantMessage loads a message from a conversation user takes part in.
+func participantMessage(ctx context.Context, repos core.Repositories, user, id uuid.UUID) (*core.Message, error) {
+	m, err := repos.MessageRepo().GetMessage(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if m.GroupID != nil {
+		if err := requireMember(ctx, repos, *m.GroupID, user); err != nil {
+			return nil, err
+		}
+		return m, nil
+	}
+	if m.SenderID != user && *m.RecipientID != user {
+		return nil, core.ErrForbidden
+	}
 	return m, nil
 }
 
-func (c *ChatUsecase) GetPrivateHistory(ctx context.Context, a, b uuid.UUID, limit int) ([]core.Message, error) {
-	return c.repos.MessageRepo().GetPrivateHistory(ctx, a, b, limit)
+// channelsOf lists the channels m's conversation is published on.
+func channelsOf(m *core.Message) []string {
+	if m.GroupID != nil {
+		return []string{core.GroupChannel(*m.GroupID)}
+	}
+	return []string{core.PrivateChannel(*m.RecipientID), core.PrivateChannel(m.SenderID)}
+}
+
+// Reply answers a message in its own conversation.
+func (c *ChatUsecase) Reply(ctx context.Context, from, parent uuid.UUID, content string) (*core.Message, error) {
+	p, err := participantMessage(ctx, c.repos, from, parent)
+	if err != nil {
+		return nil, err
+	}
+	d := Draft{Content: content, ReplyTo: &parent}
+	if p.GroupID != nil {
+		return c.SendGroup(ctx, from, *p.GroupID, d)
+	}
+	return c.SendPrivate(ctx, from, core.ConversationOf(p, from), d)
+}
+
+// prepare validates a draft and attaches its replied to message and files to m.
+func (c *ChatUsecase) prepare(ctx context.Context, m *core.Message, d Draft) error {
+	if d.Content == "" && len(d.Attachments) == 0 {
+		return core.ErrInvalidInput
+	}
+	if err := c.thread(ctx, m, d.ReplyTo); err != nil {
+		return err
+	}
+	atts, err := sendable(ctx, c.repos, m.SenderID, d.Attachments)
+	if err != nil {
+		return err
+	}
+	m.Attachments = atts
+	return nil
+}
+
+// thread makes m a reply to replyTo, which must belong to the same conversation.
+func (c *ChatUsecase) thread(ctx context.Context, m *core.Message, replyTo *uuid.UUID) error {
+	if replyTo == nil {
+		return nil
+	}
+	p, err := c.repos.MessageRepo().GetMessage(ctx, *replyTo)
+	if errors.Is(err, core.ErrNotFound) {
+		return core.ErrInvalidReply
+	}
+	if err != nil {
+		return err
+	}
+	if !sameConversation(p, m) {
+		return core.ErrInvalidReply
+	}
+	if p.DeletedAt != nil {
+		return core.ErrMessageDeleted
+	}
+	m.ReplyToID = &p.ID
+	m.ThreadRootID = p.ThreadRootID
+	if m.ThreadRootID == nil {
+		m.ThreadRootID = &p.ID
+	}
+	return nil
+}
+
+func sameConversation(a, b *core.Message) bool {
+	if a.GroupID != nil || b.GroupID != nil {
+		return a.GroupID != nil && b.GroupID != nil && *a.GroupID == *b.GroupID
+	}
+	return (a.SenderID == b.SenderID && *a.RecipientID == *b.RecipientID) ||
+		(a.SenderID == *b.RecipientID && *a.RecipientID == b.SenderID)
+}
+
+// Thread returns a page of the replies in the thread of message id, which may
+// be the root or any reply.
+func (c *ChatUsecase) Thread(ctx context.Context, user, id uuid.UUID, q core.HistoryQuery) (*core.ThreadPage, error) {
+	root, err := participantMessage(ctx, c.repos, user, id)
+	if err != nil {
+		return nil, err
+	}
+	if root.ThreadRootID != nil {
+		if root, err = c.repos.MessageRepo().GetMessage(ctx, *root.ThreadRootID); err != nil {
+			return nil, err
+		}
+	}
+	limit := historyLimit(q.Limit)
+	q.Limit = limit + 1
+	msgs, err := c.repos.MessageRepo().GetThread(ctx, root.ID, q)
+	if err != nil {
+		return nil, err
+	}
+	page := &core.ThreadPage{Root: root, MessagePage: *paginate(msgs, q.After != nil, limit)}
+	if err := c.withReactions(ctx, user, append(pointers(page.Messages), root)); err != nil {
+		return nil, err
+	}
+	return page, nil
+}
+
+// requirePeer checks that user can have a private conversation with peer: an
+// existing user other than themselves.
+func requirePeer(ctx context.Context, repos core.Repositories, user, peer uuid.UUID) error {
+	if peer == uuid.Nil || peer == user {
+		return core.ErrInvalidRecipient
+	}
+	_, err := repos.UserRepo().GetUserByID(ctx, peer)
+	return err
+}
+
+// publishEvent sends an event to each channel. Delivery is best effort: the
+// message is already persisted and clients can recover it from history.
+func publishEvent(ctx context.Context, broker core.Broker, typ string, payload any, channels ...string) {
+	ev, err := core.NewEvent(typ, payload)
+	if err != nil {
+		return
+	}
+	for _, ch := range channels {
+		_ = broker.Publish(ctx, ch, ev)
+	}
+}
+
+const (
+	DefaultHistoryLimit = 50
+	MaxHistoryLimit     = 100
+)
+
+func (c *ChatUsecase) GetPrivateHistory(ctx context.Context, a, b uuid.UUID, q core.HistoryQuery) (*core.MessagePage, error) {
+	if err := requirePeer(ctx, c.repos, a, b); err != nil {
+		return nil, err
+	}
+	limit := historyLimit(q.Limit)
+	q.Limit = limit + 1
+	msgs, err := c.repos.MessageRepo().GetPrivateHistory(ctx, a, b, q)
+	if err != nil {
+		return nil, err
+	}
+	page := paginate(msgs, q.After != nil, limit)
+	if err := c.withReactions(ctx, a, pointers(page.Messages)); err != nil {
+		return nil, err
+	}
+	return page, nil
+}
+
+func (c *ChatUsecase) GetGroupHistory(ctx context.Context, user, group uuid.UUID, q core.HistoryQuery) (*core.MessagePage, error) {
+	if err := requireMember(ctx, c.repos, group, user); err != nil {
+		return nil, err
+	}
+	limit := historyLimit(q.Limit)
+	q.Limit = limit + 1
+	msgs, err := c.repos.MessageRepo().GetGroupHistory(ctx, group, q)
+	if err != nil {
+		return nil, err
+	}
+	page := paginate(msgs, q.After != nil, limit)
+	if err := c.withReactions(ctx, user, pointers(page.Messages)); err != nil {
+		return nil, err
+	}
+	return page, nil
+}
+
+// MaxSearchLength bounds the length of search text, in bytes.
+const MaxSearchLength = 256
+
+// Search finds messages in the user's conversations. Filtering on a group the
+// user isn't in is forbidden rather than silently empty.
+func (c *ChatUsecase) Search(ctx context.Context, user uuid.UUID, q core.SearchQuery) (*core.SearchPage, error) {
+	q.Text = strings.TrimSpace(q.Text)
+	if q.Text == "" || len(q.Text) > MaxSearchLength {
+		return nil, core.ErrInvalidSearch
+	}
+	if q.GroupID != nil {
+		if err := requireMember(ctx, c.repos, *q.GroupID, user); err != nil {
+			return nil, err
+		}
+	}
+	limit := historyLimit(q.Limit)
+	q.Limit = limit + 1
+	hits, err := c.repos.MessageRepo().SearchMessages(ctx, user, q)
+	if err != nil {
+		return nil, err
+	}
+	page := &core.SearchPage{}
+	page.Hits, page.NextCursor = trimPage(hits, q.After != nil, limit, func(h *core.SearchHit) *core.Message { return &h.Message })
+	msgs := make([]*core.Message, len(page.Hits))
+	for i := range page.Hits {
+		msgs[i] = &page.Hits[i].Message
+	}
+	if err := c.withReactions(ctx, user, msgs); err != nil {
+		return nil, err
+	}
+	return page, nil
+}
+
+// Conversations lists the user's inbox, most recently active first.
+func (c *ChatUsecase) Conversations(ctx context.Context, user uuid.UUID) ([]core.Conversation, error) {
+	convs, err := c.repos.MessageRepo().ListConversations(ctx, user)
+	if convs == nil && err == nil {
+		convs = []core.Conversation{}
+	}
+	return convs, err
+}
+
+// React adds (or with add false, removes) user's reaction with emoji to a
+// message and tells the conversation about the change.
+func (c *ChatUsecase) React(ctx context.Context, user, id uuid.UUID, emoji string, add bool) error {
+	if !validEmoji(emoji) {
+		return core.ErrInvalidEmoji
+	}
+	m, err := participantMessage(ctx, c.repos, user, id)
+	if err != nil {
+		return err
+	}
+	if m.DeletedAt != nil {
+		return core.ErrMessageDeleted
+	}
+	var changed bool
+	if add {
+		changed, err = c.repos.ReactionRepo().AddReaction(ctx, &core.Reaction{MessageID: id, UserID: user, Emoji: emoji})
+	} else {
+		changed, err = c.repos.ReactionRepo().RemoveReaction(ctx, id, user, emoji)
+	}
+	if err != nil || !changed {
+		return err
+	}
+	counts, err := c.repos.ReactionRepo().CountReactions(ctx, []uuid.UUID{id}, user)
+	if err != nil {
+		return err
+	}
+	ev := core.ReactionChange{MessageID: id, GroupID: m.GroupID, UserID: user, Emoji: emoji, Added: add}
+	for _, rc := range counts[id] {
+		if rc.Emoji == emoji {
+			ev.Count = rc.Count
+		}
+	}
+	publishEvent(ctx, c.broker, core.EventReactionChanged, ev, channelsOf(m)...)
+	return nil
+}
+
+// MaxEmojiLength bounds a reaction in runes; enough for ZWJ sequences such as families.
+const MaxEmojiLength = 16
+
+func validEmoji(emoji string) bool {
+	if emoji == "" || !utf8.ValidString(emoji) || utf8.RuneCountInString(emoji) > MaxEmojiLength {
+		return false
+	}
+	for _, r := range emoji {
+		if unicode.IsSpace(r) || unicode.IsControl(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// withReactions fills in the reactions of msgs as seen by viewer.
+func (c *ChatUsecase) withReactions(ctx context.Context, viewer uuid.UUID, msgs []*core.Message) error {
+	if len(msgs) == 0 {
+		return nil
+	}
+	ids := make([]uuid.UUID, len(msgs))
+	for i, m := range msgs {
+		ids[i] = m.ID
+	}
+	counts, err := c.repos.ReactionRepo().CountReactions(ctx, ids, viewer)
+	if err != nil {
+		return err
+	}
+	for _, m := range msgs {
+		m.Reactions = counts[m.ID]
+	}
+	return nil
+}
+
+func pointers(msgs []core.Message) []*core.Message {
+	ptrs := make([]*core.Message, len(msgs))
+	for i := range msgs {
+		ptrs[i] = &msgs[i]
+	}
+	return ptrs
 }
 
-func (c *ChatUsecase) GetGroupHistory(ctx context.Context, group uuid.UUID, limit int) ([]core.Message, error) {
-	return c.repos.MessageRepo().GetGroupHistory(ctx, group, limit)
+func historyLimit(limit int) int {
+	if limit <= 0 {
+		return DefaultHistoryLimit
+	}
+	return min(limit, MaxHistoryLimit)
+}
+
+// paginate trims msgs (newest first, fetched with one extra row) to limit and
+// sets the cursor continuing in the direction of the query.
+func paginate(msgs []core.Message, forward bool, limit int) *core.MessagePage {
+	page := &core.MessagePage{}
+	page.Messages, page.NextCursor = trimPage(msgs, forward, limit, func(m *core.Message) *core.Message { return m })
+	return page
+}
+
+// trimPage is paginate for any kind of item; message returns the message an
+// item's cursor is taken from. The trimmed items are never nil.
+func trimPage[T any](items []T, forward bool, limit int, message func(*T) *core.Message) ([]T, string) {
+	if items == nil {
+		items = []T{}
+	}
+	if len(items) <= limit {
+		return items, ""
+	}
+	if forward {
+		items = items[1:]
+		return items, core.CursorOf(message(&items[0])).Encode()
+	}
+	items = items[:limit]
+	return items, core.CursorOf(message(&items[limit-1])).Encode()
 }
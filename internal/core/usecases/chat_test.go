@@ -0,0 +1,385 @@
+package usecases
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"example.com/go-chat/internal/core"
+	"example.com/go-chat/internal/drivers"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/google/uuid"
+)
+
+// stubRepos embeds the repository interfaces so tests only implement what they exercise.
+type stubRepos struct {
+	core.Repositories
+	groups   *stubGroups
+	messages *stubMessages
+}
+
+func (r *stubRepos) GroupRepo() core.GroupRepository     { return r.groups }
+func (r *stubRepos) MessageRepo() core.MessageRepository { return r.messages }
+
+type stubGroups struct {
+	core.GroupRepository
+	members map[uuid.UUID]bool
+}
+
+func (g *stubGroups) IsMember(ctx context.Context, groupID, userID uuid.UUID) (bool, error) {
+	return g.members[userID], nil
+}
+
+func (g *stubGroups) ListGroupMembers(ctx context.Context, groupID uuid.UUID) ([]core.GroupMember, error) {
+	return []core.GroupMember{}, nil
+}
+
+type stubMessages struct {
+	core.MessageRepository
+	saved int
+}
+
+func (m *stubMessages) SaveMessage(ctx context.Context, msg *core.Message) error {
+	m.saved++
+	return nil
+}
+
+func (m *stubMessages) GetGroupHistory(ctx context.Context, groupID uuid.UUID, q core.HistoryQuery) ([]core.Message, error) {
+	return nil, nil
+}
+
+func newStubChat(members ...uuid.UUID) (*ChatUsecase, *stubRepos) {
+	repos := &stubRepos{groups: &stubGroups{members: map[uuid.UUID]bool{}}, messages: &stubMessages{}}
+	for _, id := range members {
+		repos.groups.members[id] = true
+	}
+	return NewChatUsecase(repos, nil, nil), repos
+}
+
+func TestGroupAccessDeniedForNonMembers(t *testing.T) {
+	ctx := context.Background()
+	member, outsider, group := uuid.New(), uuid.New(), uuid.New()
+	chat, repos := newStubChat(member)
+
+	if _, err := chat.SendGroup(ctx, outsider, group, Draft{Content: "hi"}); !errors.Is(err, core.ErrForbidden) {
+		t.Fatalf("SendGroup: got %v, want ErrForbidden", err)
+	}
+	if repos.messages.saved != 0 {
+		t.Fatalf("message from non-member was saved")
+	}
+	if _, err := chat.GetGroupHistory(ctx, outsider, group, core.HistoryQuery{}); !errors.Is(err, core.ErrForbidden) {
+		t.Fatalf("GetGroupHistory: got %v, want ErrForbidden", err)
+	}
+	groups := NewGroupUsecase(repos, nil, nil)
+	if _, err := groups.Members(ctx, outsider, group); !errors.Is(err, core.ErrForbidden) {
+		t.Fatalf("Members: got %v, want ErrForbidden", err)
+	}
+}
+
+func TestGroupAccessAllowedForMembers(t *testing.T) {
+	ctx := context.Background()
+	member, group := uuid.New(), uuid.New()
+	chat, repos := newStubChat(member)
+
+	if _, err := chat.GetGroupHistory(ctx, member, group, core.HistoryQuery{}); err != nil {
+		t.Fatalf("GetGroupHistory: %v", err)
+	}
+	if _, err := NewGroupUsecase(repos, nil, nil).Members(ctx, member, group); err != nil {
+		t.Fatalf("Members: %v", err)
+	}
+}
+
+type editRepos struct {
+	core.Repositories
+	groups      *roleGroups
+	messages    *editableMessages
+	reactions   *stubReactions
+	attachments stubAttachments
+}
+
+func (r *editRepos) UserRepo() core.UserRepository             { return anyUsers{} }
+func (r *editRepos) GroupRepo() core.GroupRepository           { return r.groups }
+func (r *editRepos) MessageRepo() core.MessageRepository       { return r.messages }
+func (r *editRepos) ReactionRepo() core.ReactionRepository     { return r.reactions }
+func (r *editRepos) AttachmentRepo() core.AttachmentRepository { return r.attachments }
+
+// anyUsers finds a user for every id.
+type anyUsers struct{ core.UserRepository }
+
+func (anyUsers) GetUserByID(ctx context.Context, id uuid.UUID) (*core.User, error) {
+	return &core.User{ID: id}, nil
+}
+
+type stubReactions struct {
+	core.ReactionRepository
+	set map[core.Reaction]bool
+}
+
+func (r *stubReactions) AddReaction(ctx context.Context, re *core.Reaction) (bool, error) {
+	if r.set[*re] {
+		return false, nil
+	}
+	r.set[*re] = true
+	return true, nil
+}
+
+func (r *stubReactions) RemoveReaction(ctx context.Context, messageID, userID uuid.UUID, emoji string) (bool, error) {
+	re := core.Reaction{MessageID: messageID, UserID: userID, Emoji: emoji}
+	if !r.set[re] {
+		return false, nil
+	}
+	delete(r.set, re)
+	return true, nil
+}
+
+func (r *stubReactions) CountReactions(ctx context.Context, ids []uuid.UUID, viewer uuid.UUID) (map[uuid.UUID][]core.ReactionCount, error) {
+	counts := map[uuid.UUID][]core.ReactionCount{}
+	for re := range r.set {
+		counts[re.MessageID] = append(counts[re.MessageID], core.ReactionCount{Emoji: re.Emoji, Count: 1, Me: re.UserID == viewer})
+	}
+	return counts, nil
+}
+
+type roleGroups struct {
+	core.GroupRepository
+	roles map[uuid.UUID]core.GroupRole
+}
+
+func (g *roleGroups) GetMember(ctx context.Context, groupID, userID uuid.UUID) (*core.GroupMember, error) {
+	role, ok := g.roles[userID]
+	if !ok {
+		return nil, core.ErrNotFound
+	}
+	return &core.GroupMember{GroupID: groupID, UserID: userID, Role: role}, nil
+}
+
+type editableMessages struct {
+	messageByID
+}
+
+func (m *editableMessages) SaveMessage(ctx context.Context, msg *core.Message) error {
+	msg.ID = uuid.New()
+	m.msgs[msg.ID] = msg
+	return nil
+}
+
+func (m *editableMessages) EditMessage(ctx context.Context, msg *core.Message, content string, at time.Time) error {
+	msg.Content, msg.EditedAt = content, &at
+	return nil
+}
+
+func (m *editableMessages) DeleteMessage(ctx context.Context, msg *core.Message, by uuid.UUID, at time.Time) error {
+	msg.Content, msg.DeletedAt, msg.DeletedBy = "", &at, &by
+	return nil
+}
+
+func TestEditAndDeletePermissions(t *testing.T) {
+	ctx := context.Background()
+	sender, member, admin, group := uuid.New(), uuid.New(), uuid.New(), uuid.New()
+	repos := &editRepos{
+		groups:   &roleGroups{roles: map[uuid.UUID]core.GroupRole{sender: core.RoleMember, member: core.RoleMember, admin: core.RoleAdmin}},
+		messages: &editableMessages{messageByID{msgs: map[uuid.UUID]*core.Message{}}},
+	}
+	chat := NewChatUsecase(repos, drivers.NewRedis(miniredis.RunT(t).Addr()), nil)
+	newMessage := func() uuid.UUID {
+		m := &core.Message{ID: uuid.New(), SenderID: sender, GroupID: &group, Content: "hi"}
+		repos.messages.msgs[m.ID] = m
+		return m.ID
+	}
+
+	id := newMessage()
+	if _, err := chat.Edit(ctx, admin, id, "changed"); !errors.Is(err, core.ErrNotMessageSender) {
+		t.Fatalf("Edit by admin: got %v, want ErrNotMessageSender", err)
+	}
+	if m, err := chat.Edit(ctx, sender, id, "changed"); err != nil || m.Content != "changed" || m.EditedAt == nil {
+		t.Fatalf("Edit by sender: got %+v, %v", m, err)
+	}
+	if _, err := chat.Delete(ctx, member, id); !errors.Is(err, core.ErrInsufficientRole) {
+		t.Fatalf("Delete by member: got %v, want ErrInsufficientRole", err)
+	}
+	if m, err := chat.Delete(ctx, admin, id); err != nil || m.DeletedAt == nil || m.Content != "" {
+		t.Fatalf("Delete by admin: got %+v, %v", m, err)
+	}
+	if _, err := chat.Edit(ctx, sender, id, "again"); !errors.Is(err, core.ErrMessageDeleted) {
+		t.Fatalf("Edit of deleted message: got %v, want ErrMessageDeleted", err)
+	}
+	if _, err := chat.Delete(ctx, sender, newMessage()); err != nil {
+		t.Fatalf("Delete by sender: %v", err)
+	}
+}
+
+func TestSendPrivateChecksTheRecipient(t *testing.T) {
+	ctx := context.Background()
+	repos := drivers.NewMemory()
+	chat := NewChatUsecase(repos, drivers.NewLocalBroker(), nil)
+	alice, bob := newMemoryUser(t, repos, "alice"), newMemoryUser(t, repos, "bob")
+
+	for _, to := range []uuid.UUID{uuid.Nil, alice.ID} {
+		if _, err := chat.SendPrivate(ctx, alice.ID, to, Draft{Content: "hi"}); !errors.Is(err, core.ErrInvalidRecipient) {
+			t.Errorf("SendPrivate to %s: got %v, want ErrInvalidRecipient", to, err)
+		}
+	}
+	if _, err := chat.SendPrivate(ctx, alice.ID, uuid.New(), Draft{Content: "hi"}); !errors.Is(err, core.ErrNotFound) {
+		t.Errorf("SendPrivate to an unknown user: got %v, want ErrNotFound", err)
+	}
+	if _, err := chat.SendPrivate(ctx, alice.ID, bob.ID, Draft{Content: "hi"}); err != nil {
+		t.Errorf("SendPrivate to bob: %v", err)
+	}
+}
+
+func TestRepliesJoinTheThreadOfTheirConversation(t *testing.T) {
+	ctx := context.Background()
+	alice, bob, carol := uuid.New(), uuid.New(), uuid.New()
+	repos := &editRepos{messages: &editableMessages{messageByID{msgs: map[uuid.UUID]*core.Message{}}}}
+	chat := NewChatUsecase(repos, drivers.NewRedis(miniredis.RunT(t).Addr()), nil)
+
+	root, err := chat.SendPrivate(ctx, alice, bob, Draft{Content: "root"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply, err := chat.Reply(ctx, bob, root.ID, "reply")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *reply.RecipientID != alice || *reply.ReplyToID != root.ID || *reply.ThreadRootID != root.ID {
+		t.Fatalf("reply: got %+v", reply)
+	}
+	nested, err := chat.SendPrivate(ctx, alice, bob, Draft{Content: "nested", ReplyTo: &reply.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *nested.ReplyToID != reply.ID || *nested.ThreadRootID != root.ID {
+		t.Fatalf("nested reply: got %+v", nested)
+	}
+
+	if _, err := chat.SendPrivate(ctx, carol, bob, Draft{Content: "hi", ReplyTo: &root.ID}); !errors.Is(err, core.ErrInvalidReply) {
+		t.Fatalf("reply from another conversation: got %v, want ErrInvalidReply", err)
+	}
+	if _, err := chat.Reply(ctx, carol, root.ID, "hi"); !errors.Is(err, core.ErrForbidden) {
+		t.Fatalf("Reply by outsider: got %v, want ErrForbidden", err)
+	}
+}
+
+func TestReactionsPublishChanges(t *testing.T) {
+	ctx := context.Background()
+	alice, bob := uuid.New(), uuid.New()
+	rds := drivers.NewRedis(miniredis.RunT(t).Addr())
+	m := &core.Message{ID: uuid.New(), SenderID: alice, RecipientID: &bob}
+	repos := &editRepos{
+		messages:  &editableMessages{messageByID{msgs: map[uuid.UUID]*core.Message{m.ID: m}}},
+		reactions: &stubReactions{set: map[core.Reaction]bool{}},
+	}
+	chat := NewChatUsecase(repos, rds, nil)
+	ps := rds.Subscribe(ctx, core.PrivateChannel(alice))
+	defer ps.Close()
+
+	if err := chat.React(ctx, bob, m.ID, "not an emoji", true); !errors.Is(err, core.ErrInvalidEmoji) {
+		t.Fatalf("React with text: got %v, want ErrInvalidEmoji", err)
+	}
+	for _, add := range []bool{true, true, false} {
+		if err := chat.React(ctx, bob, m.ID, "👍", add); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the repeated add changes nothing and is not published
+	for _, want := range []core.ReactionChange{{Added: true, Count: 1}, {Added: false, Count: 0}} {
+		select {
+		case msg := <-ps.Channel():
+			var ev core.Event
+			var got core.ReactionChange
+			if err := json.Unmarshal([]byte(msg.Payload), &ev); err != nil {
+				t.Fatal(err)
+			}
+			if err := json.Unmarshal(ev.Payload, &got); err != nil {
+				t.Fatal(err)
+			}
+			if ev.Type != core.EventReactionChanged || got.Added != want.Added || got.Count != want.Count || got.UserID != bob {
+				t.Fatalf("got %s %+v, want added=%v count=%d", ev.Type, got, want.Added, want.Count)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("missing reaction event")
+		}
+	}
+	select {
+	case msg := <-ps.Channel():
+		t.Fatalf("unexpected event %s", msg.Payload)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+type searchRepos struct {
+	core.Repositories
+	groups    *stubGroups
+	messages  *searchMessages
+	reactions *stubReactions
+}
+
+func (r *searchRepos) GroupRepo() core.GroupRepository       { return r.groups }
+func (r *searchRepos) MessageRepo() core.MessageRepository   { return r.messages }
+func (r *searchRepos) ReactionRepo() core.ReactionRepository { return r.reactions }
+
+// searchMessages matches every message, newest first.
+type searchMessages struct {
+	core.MessageRepository
+	msgs []core.Message
+	last core.SearchQuery
+}
+
+func (m *searchMessages) SearchMessages(ctx context.Context, userID uuid.UUID, q core.SearchQuery) ([]core.SearchHit, error) {
+	m.last = q
+	var hits []core.SearchHit
+	for _, msg := range m.msgs {
+		if q.Before != nil && !msg.CreatedAt.Before(q.Before.CreatedAt) {
+			continue
+		}
+		if len(hits) < q.Limit {
+			hits = append(hits, core.SearchHit{Message: msg, Snippet: "<mark>" + msg.Content + "</mark>"})
+		}
+	}
+	return hits, nil
+}
+
+func TestSearchValidatesAndPages(t *testing.T) {
+	ctx := context.Background()
+	user, group := uuid.New(), uuid.New()
+	repos := &searchRepos{
+		groups:    &stubGroups{members: map[uuid.UUID]bool{}},
+		messages:  &searchMessages{},
+		reactions: &stubReactions{set: map[core.Reaction]bool{}},
+	}
+	now := time.Now()
+	for i := range 5 {
+		repos.messages.msgs = append(repos.messages.msgs, core.Message{ID: uuid.New(), SenderID: user, Content: "hello", CreatedAt: now.Add(-time.Duration(i) * time.Minute)})
+	}
+	chat := NewChatUsecase(repos, nil, nil)
+
+	for _, text := range []string{"", "   ", string(make([]byte, MaxSearchLength+1))} {
+		if _, err := chat.Search(ctx, user, core.SearchQuery{Text: text}); !errors.Is(err, core.ErrInvalidSearch) {
+			t.Fatalf("Search(%q): got %v, want ErrInvalidSearch", text, err)
+		}
+	}
+	if _, err := chat.Search(ctx, user, core.SearchQuery{Text: "hello", GroupID: &group}); !errors.Is(err, core.ErrForbidden) {
+		t.Fatalf("Search in a group of others: got %v, want ErrForbidden", err)
+	}
+
+	page, err := chat.Search(ctx, user, core.SearchQuery{Text: " hello ", HistoryQuery: core.HistoryQuery{Limit: 3}})
+	if err != nil {
+		t.Fatalf("Search: %v", err)
+	}
+	if repos.messages.last.Text != "hello" || len(page.Hits) != 3 || page.NextCursor == "" {
+		t.Fatalf("first page: got %d hits, cursor %q", len(page.Hits), page.NextCursor)
+	}
+	before, err := core.ParseCursor(page.NextCursor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	page, err = chat.Search(ctx, user, core.SearchQuery{Text: "hello", HistoryQuery: core.HistoryQuery{Before: before, Limit: 3}})
+	if err != nil {
+		t.Fatalf("Search: %v", err)
+	}
+	if len(page.Hits) != 2 || page.NextCursor != "" {
+		t.Fatalf("last page: got %d hits, cursor %q", len(page.Hits), page.NextCursor)
+	}
+}
@@ -0,0 +1,402 @@
+package usecases
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"example.com/go-chat/internal/core"
+	"github.com/google/uuid"
+)
+
+// MembershipChannel carries group membership changes so every Hub instance can
+// adjust the group subscriptions of users it has live connections for.
+const MembershipChannel = "membership"
+
+// MembershipEvent is published on MembershipChannel when a user joins or leaves a group.
+type MembershipEvent struct {
+	UserID  uuid.UUID `json:"user_id"`
+	GroupID uuid.UUID `json:"group_id"`
+	Joined  bool      `json:"joined"`
+}
+
+// GroupUsecase manages groups and their members. Role rules live here so every
+// entrypoint enforces them the same way.
+type GroupUsecase struct {
+	repos  core.Repositories
+	broker core.Broker
+	store  core.AttachmentStore
+}
+
+func NewGroupUsecase(r core.Repositories, broker core.Broker, store core.AttachmentStore) *GroupUsecase {
+	return &GroupUsecase{repos: r, broker: broker, store: store}
+}
+
+func (g *GroupUsecase) Create(ctx context.Context, owner uuid.UUID, name string, visibility core.GroupVisibility) (*core.Group, error) {
+	if visibility == "" {
+		visibility = core.VisibilityPublic
+	}
+	if !visibility.Valid() {
+		return nil, core.ErrInvalidVisibility
+	}
+	grp := &core.Group{Name: name, OwnerID: owner, Visibility: visibility}
+	if err := g.repos.GroupRepo().CreateGroup(ctx, grp); err != nil {
+		return nil, err
+	}
+	if err := g.addMember(ctx, grp.ID, owner, core.RoleOwner); err != nil {
+		return nil, err
+	}
+	return grp, nil
+}
+
+// JoinStatus reports the outcome of a join attempt.
+type JoinStatus string
+
+const (
+	JoinJoined  JoinStatus = "joined"
+	JoinPending JoinStatus = "pending"
+)
+
+// Join adds user to a public group, or to any group when inviteToken is a
+// valid invite for it. Joining a private group without an invite files a join
+// request for the group admins instead.
+func (g *GroupUsecase) Join(ctx context.Context, group, user uuid.UUID, inviteToken string) (JoinStatus, error) {
+	grp, err := g.repos.GroupRepo().GetGroup(ctx, group)
+	if err != nil {
+		return "", err
+	}
+	if ok, err := g.repos.GroupRepo().IsMember(ctx, group, user); err != nil || ok {
+		return JoinJoined, err
+	}
+	if inviteToken != "" {
+		// an invite to another group is rejected without using it up
+		inv, err := g.repos.GroupRepo().GetInvite(ctx, inviteToken)
+		if err != nil {
+			return "", err
+		}
+		if inv.GroupID != group {
+			return "", core.ErrInvalidInvite
+		}
+		if _, err := g.repos.GroupRepo().UseInvite(ctx, inviteToken, time.Now()); err != nil {
+			return "", err
+		}
+		return JoinJoined, g.addMember(ctx, group, user, core.RoleMember)
+	}
+	if grp.Visibility == core.VisibilityPublic {
+		return JoinJoined, g.addMember(ctx, group, user, core.RoleMember)
+	}
+	req := &core.GroupJoinRequest{GroupID: group, UserID: user, Status: core.JoinRequestPending}
+	if err := g.repos.GroupRepo().SaveJoinRequest(ctx, req); err != nil {
+		return "", err
+	}
+	return JoinPending, nil
+}
+
+// JoinWithInvite joins whichever group the invite belongs to. A member
+// opening the invite keeps it for someone else.
+func (g *GroupUsecase) JoinWithInvite(ctx context.Context, user uuid.UUID, token string) (*core.Group, error) {
+	inv, err := g.repos.GroupRepo().GetInvite(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+	grp, err := g.repos.GroupRepo().GetGroup(ctx, inv.GroupID)
+	if err != nil {
+		return nil, err
+	}
+	if ok, err := g.repos.GroupRepo().IsMember(ctx, grp.ID, user); err != nil || ok {
+		return grp, err
+	}
+	if _, err := g.repos.GroupRepo().UseInvite(ctx, token, time.Now()); err != nil {
+		return nil, err
+	}
+	if err := g.addMember(ctx, grp.ID, user, core.RoleMember); err != nil {
+		return nil, err
+	}
+	return grp, nil
+}
+
+// CreateInvite lets admins mint an invite token. ttl and maxUses of zero mean
+// no expiry and unlimited uses.
+func (g *GroupUsecase) CreateInvite(ctx context.Context, actor, group uuid.UUID, ttl time.Duration, maxUses int) (*core.GroupInvite, error) {
+	if ttl < 0 || maxUses < 0 {
+		return nil, core.ErrInvalidInput
+	}
+	if _, err := requireRole(ctx, g.repos, group, actor, core.RoleAdmin); err != nil {
+		return nil, err
+	}
+	token, err := randomToken()
+	if err != nil {
+		return nil, err
+	}
+	inv := &core.GroupInvite{Token: token, GroupID: group, CreatedBy: actor, MaxUses: maxUses}
+	if ttl > 0 {
+		exp := time.Now().Add(ttl)
+		inv.ExpiresAt = &exp
+	}
+	if err := g.repos.GroupRepo().CreateInvite(ctx, inv); err != nil {
+		return nil, err
+	}
+	return inv, nil
+}
+
+func (g *GroupUsecase) Invites(ctx context.Context, actor, group uuid.UUID) ([]core.GroupInvite, error) {
+	if _, err := requireRole(ctx, g.repos, group, actor, core.RoleAdmin); err != nil {
+		return nil, err
+	}
+	return g.repos.GroupRepo().ListInvites(ctx, group)
+}
+
+func (g *GroupUsecase) RevokeInvite(ctx context.Context, actor, group uuid.UUID, token string) error {
+	if _, err := requireRole(ctx, g.repos, group, actor, core.RoleAdmin); err != nil {
+		return err
+	}
+	return g.repos.GroupRepo().DeleteInvite(ctx, group, token)
+}
+
+// JoinRequests lists the pending join requests of a group for its admins.
+func (g *GroupUsecase) JoinRequests(ctx context.Context, actor, group uuid.UUID) ([]core.GroupJoinRequest, error) {
+	if _, err := requireRole(ctx, g.repos, group, actor, core.RoleAdmin); err != nil {
+		return nil, err
+	}
+	return g.repos.GroupRepo().ListJoinRequests(ctx, group, core.JoinRequestPending)
+}
+
+// DecideJoinRequest approves or rejects the pending request of user; approval adds them as a member.
+func (g *GroupUsecase) DecideJoinRequest(ctx context.Context, actor, group, user uuid.UUID, approve bool) error {
+	if _, err := requireRole(ctx, g.repos, group, actor, core.RoleAdmin); err != nil {
+		return err
+	}
+	status := core.JoinRequestRejected
+	if approve {
+		status = core.JoinRequestApproved
+	}
+	if err := g.repos.GroupRepo().DecideJoinRequest(ctx, group, user, actor, status); err != nil {
+		return err
+	}
+	if !approve {
+		return nil
+	}
+	return g.addMember(ctx, group, user, core.RoleMember)
+}
+
+func (g *GroupUsecase) Members(ctx context.Context, user, group uuid.UUID) ([]core.GroupMember, error) {
+	if err := requireMember(ctx, g.repos, group, user); err != nil {
+		return nil, err
+	}
+	return g.repos.GroupRepo().ListGroupMembers(ctx, group)
+}
+
+// GroupChanges lists the group settings to update; nil fields are left unchanged.
+type GroupChanges struct {
+	Name       *string
+	Visibility *core.GroupVisibility
+}
+
+// Update is allowed to admins and the owner.
+func (g *GroupUsecase) Update(ctx context.Context, actor, group uuid.UUID, changes GroupChanges) (*core.Group, error) {
+	if changes.Visibility != nil && !changes.Visibility.Valid() {
+		return nil, core.ErrInvalidVisibility
+	}
+	if changes.Name != nil && *changes.Name == "" {
+		return nil, core.ErrInvalidInput
+	}
+	if _, err := requireRole(ctx, g.repos, group, actor, core.RoleAdmin); err != nil {
+		return nil, err
+	}
+	grp, err := g.repos.GroupRepo().GetGroup(ctx, group)
+	if err != nil {
+		return nil, err
+	}
+	if changes.Name != nil {
+		grp.Name = *changes.Name
+	}
+	if changes.Visibility != nil {
+		grp.Visibility = *changes.Visibility
+	}
+	if err := g.repos.GroupRepo().UpdateGroup(ctx, grp); err != nil {
+		return nil, err
+	}
+	return grp, nil
+}
+
+// Delete removes the group, its members and its history. Only the owner may delete a group.
+func (g *GroupUsecase) Delete(ctx context.Context, actor, group uuid.UUID) error {
+	if _, err := requireRole(ctx, g.repos, group, actor, core.RoleOwner); err != nil {
+		return err
+	}
+	return g.delete(ctx, group)
+}
+
+// SetRole promotes a member to admin or demotes an admin to member. Only the
+// owner may change roles; ownership moves through TransferOwnership.
+func (g *GroupUsecase) SetRole(ctx context.Context, actor, group, target uuid.UUID, role core.GroupRole) error {
+	if role != core.RoleAdmin && role != core.RoleMember {
+		return core.ErrInvalidRole
+	}
+	if _, err := requireRole(ctx, g.repos, group, actor, core.RoleOwner); err != nil {
+		return err
+	}
+	m, err := g.repos.GroupRepo().GetMember(ctx, group, target)
+	if err != nil {
+		return err
+	}
+	if m.Role == core.RoleOwner {
+		return core.ErrInsufficientRole
+	}
+	return g.repos.GroupRepo().SetMemberRole(ctx, group, target, role)
+}
+
+// TransferOwnership makes target the owner; the previous owner becomes an admin.
+func (g *GroupUsecase) TransferOwnership(ctx context.Context, actor, group, target uuid.UUID) error {
+	if _, err := requireRole(ctx, g.repos, group, actor, core.RoleOwner); err != nil {
+		return err
+	}
+	if _, err := g.repos.GroupRepo().GetMember(ctx, group, target); err != nil {
+		return err
+	}
+	return g.repos.GroupRepo().TransferOwnership(ctx, group, target)
+}
+
+// RemoveMember removes target from the group. Actors can only remove members
+// ranked below them, so admins remove members and the owner removes anyone
+// but themselves.
+func (g *GroupUsecase) RemoveMember(ctx context.Context, actor, group, target uuid.UUID) error {
+	if actor == target {
+		return g.Leave(ctx, actor, group)
+	}
+	a, err := requireRole(ctx, g.repos, group, actor, core.RoleAdmin)
+	if err != nil {
+		return err
+	}
+	m, err := g.repos.GroupRepo().GetMember(ctx, group, target)
+	if err != nil {
+		return err
+	}
+	if !a.Role.Outranks(m.Role) {
+		return core.ErrInsufficientRole
+	}
+	return g.removeMember(ctx, group, target)
+}
+
+// Leave removes user from group. When the owner leaves, ownership passes to the
+// longest standing admin, or failing that the longest standing member; a group
+// left without members is deleted.
+func (g *GroupUsecase) Leave(ctx context.Context, user, group uuid.UUID) error {
+	m, err := g.repos.GroupRepo().GetMember(ctx, group, user)
+	if err != nil {
+		if errors.Is(err, core.ErrNotFound) {
+			return core.ErrNotGroupMember
+		}
+		return err
+	}
+	if m.Role == core.RoleOwner {
+		members, err := g.repos.GroupRepo().ListGroupMembers(ctx, group)
+		if err != nil {
+			return err
+		}
+		successor := successorOf(members, user)
+		if successor == nil {
+			return g.delete(ctx, group)
+		}
+		if err := g.repos.GroupRepo().TransferOwnership(ctx, group, successor.UserID); err != nil {
+			return err
+		}
+	}
+	return g.removeMember(ctx, group, user)
+}
+
+// successorOf picks the next owner among members (ordered by join time), skipping leaving.
+func successorOf(members []core.GroupMember, leaving uuid.UUID) *core.GroupMember {
+	var next *core.GroupMember
+	for i := range members {
+		m := &members[i]
+		if m.UserID == leaving {
+			continue
+		}
+		if m.Role == core.RoleAdmin {
+			return m
+		}
+		if next == nil {
+			next = m
+		}
+	}
+	return next
+}
+
+// requireRole returns the actor's membership if it holds at least role.
+func requireRole(ctx context.Context, repos core.Repositories, group, actor uuid.UUID, role core.GroupRole) (*core.GroupMember, error) {
+	m, err := repos.GroupRepo().GetMember(ctx, group, actor)
+	if errors.Is(err, core.ErrNotFound) {
+		return nil, core.ErrNotGroupMember
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !m.Role.AtLeast(role) {
+		return nil, core.ErrInsufficientRole
+	}
+	return m, nil
+}
+
+func (g *GroupUsecase) addMember(ctx context.Context, group, user uuid.UUID, role core.GroupRole) error {
+	if err := g.repos.GroupRepo().AddGroupMember(ctx, group, user, role); err != nil {
+		return err
+	}
+	g.publishMembership(ctx, user, group, true)
+	return nil
+}
+
+func (g *GroupUsecase) removeMember(ctx context.Context, group, user uuid.UUID) error {
+	if err := g.repos.GroupRepo().RemoveGroupMember(ctx, group, user); err != nil {
+		return err
+	}
+	g.publishMembership(ctx, user, group, false)
+	return nil
+}
+
+func (g *GroupUsecase) delete(ctx context.Context, group uuid.UUID) error {
+	members, err := g.repos.GroupRepo().ListGroupMembers(ctx, group)
+	if err != nil {
+		return err
+	}
+	atts, err := g.repos.AttachmentRepo().GroupAttachments(ctx, group)
+	if err != nil {
+		return err
+	}
+	if err := g.repos.GroupRepo().DeleteGroup(ctx, group); err != nil {
+		return err
+	}
+	removeFiles(ctx, g.store, atts)
+	for _, m := range members {
+		g.publishMembership(ctx, m.UserID, group, false)
+	}
+	return nil
+}
+
+func (g *GroupUsecase) publishMembership(ctx context.Context, user, group uuid.UUID, joined bool) {
+	b, _ := json.Marshal(MembershipEvent{UserID: user, GroupID: group, Joined: joined})
+	_ = g.broker.Publish(ctx, MembershipChannel, string(b))
+}
+
+func randomToken() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// requireMember returns core.ErrNotGroupMember unless user belongs to group.
+func requireMember(ctx context.Context, repos core.Repositories, group, user uuid.UUID) error {
+	ok, err := repos.GroupRepo().IsMember(ctx, group, user)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return core.ErrNotGroupMember
+	}
+	return nil
+}
@@ -0,0 +1,221 @@
+package usecases
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"example.com/go-chat/internal/core"
+	"example.com/go-chat/internal/drivers"
+	"github.com/google/uuid"
+)
+
+// newGroupTest returns a GroupUsecase over in-memory repositories and the
+// owner of a private group.
+func newGroupTest(t *testing.T) (*GroupUsecase, core.Repositories, *core.User, *core.Group) {
+	t.Helper()
+	repos := drivers.NewMemory()
+	groups := NewGroupUsecase(repos, drivers.NewLocalBroker(), nil)
+	owner := newMemoryUser(t, repos, "owner")
+	g, err := groups.Create(context.Background(), owner.ID, "team", core.VisibilityPrivate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return groups, repos, owner, g
+}
+
+func newMemoryUser(t *testing.T, repos core.Repositories, name string) *core.User {
+	t.Helper()
+	u := &core.User{Username: name, Email: name + "@example.com"}
+	if err := repos.UserRepo().CreateUser(context.Background(), u, "password"); err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
+
+func TestJoinWithAnotherGroupsInviteKeepsIt(t *testing.T) {
+	ctx := context.Background()
+	groups, repos, owner, g := newGroupTest(t)
+	other, err := groups.Create(ctx, owner.ID, "other", core.VisibilityPrivate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inv, err := groups.CreateInvite(ctx, owner.ID, g.ID, 0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	joiner := newMemoryUser(t, repos, "joiner")
+
+	if _, err := groups.Join(ctx, other.ID, joiner.ID, inv.Token); !errors.Is(err, core.ErrInvalidInvite) {
+		t.Fatalf("Join with another group's invite: got %v, want ErrInvalidInvite", err)
+	}
+	if status, err := groups.Join(ctx, g.ID, joiner.ID, inv.Token); err != nil || status != JoinJoined {
+		t.Fatalf("Join with the invite afterwards: got %v, %v", status, err)
+	}
+}
+
+func TestJoinWithInviteAsMemberKeepsIt(t *testing.T) {
+	ctx := context.Background()
+	groups, repos, owner, g := newGroupTest(t)
+	inv, err := groups.CreateInvite(ctx, owner.ID, g.ID, 0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := groups.JoinWithInvite(ctx, owner.ID, inv.Token); err != nil || got.ID != g.ID {
+		t.Fatalf("JoinWithInvite as a member: got %+v, %v", got, err)
+	}
+	joiner := newMemoryUser(t, repos, "joiner")
+	if got, err := groups.JoinWithInvite(ctx, joiner.ID, inv.Token); err != nil || got.ID != g.ID {
+		t.Fatalf("JoinWithInvite afterwards: got %+v, %v", got, err)
+	}
+	if ok, _ := repos.GroupRepo().IsMember(ctx, g.ID, joiner.ID); !ok {
+		t.Error("joiner is not a member")
+	}
+}
+
+// roleGroup is a group with an owner, two admins and a member, plus a user
+// outside it.
+type roleGroup struct {
+	g                                    *core.Group
+	owner, admin, peer, member, outsider uuid.UUID
+}
+
+func newRoleGroup(t *testing.T) (*GroupUsecase, core.Repositories, roleGroup) {
+	t.Helper()
+	groups, repos, owner, g := newGroupTest(t)
+	rg := roleGroup{g: g, owner: owner.ID}
+	for _, u := range []struct {
+		id   *uuid.UUID
+		role core.GroupRole
+	}{{&rg.admin, core.RoleAdmin}, {&rg.peer, core.RoleAdmin}, {&rg.member, core.RoleMember}} {
+		*u.id = newMemoryUser(t, repos, uuid.NewString()).ID
+		if err := repos.GroupRepo().AddGroupMember(context.Background(), g.ID, *u.id, u.role); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rg.outsider = newMemoryUser(t, repos, "outsider").ID
+	return groups, repos, rg
+}
+
+func TestGroupRolePermissions(t *testing.T) {
+	cases := []struct {
+		name string
+		do   func(ctx context.Context, groups *GroupUsecase, rg roleGroup) error
+		want error
+	}{
+		{"admin promotes a member", func(ctx context.Context, groups *GroupUsecase, rg roleGroup) error {
+			return groups.SetRole(ctx, rg.admin, rg.g.ID, rg.member, core.RoleAdmin)
+		}, core.ErrInsufficientRole},
+		{"admin demotes a peer", func(ctx context.Context, groups *GroupUsecase, rg roleGroup) error {
+			return groups.SetRole(ctx, rg.admin, rg.g.ID, rg.peer, core.RoleMember)
+		}, core.ErrInsufficientRole},
+		{"member sets a role", func(ctx context.Context, groups *GroupUsecase, rg roleGroup) error {
+			return groups.SetRole(ctx, rg.member, rg.g.ID, rg.member, core.RoleAdmin)
+		}, core.ErrInsufficientRole},
+		{"outsider sets a role", func(ctx context.Context, groups *GroupUsecase, rg roleGroup) error {
+			return groups.SetRole(ctx, rg.outsider, rg.g.ID, rg.member, core.RoleAdmin)
+		}, core.ErrNotGroupMember},
+		{"owner demotes themselves", func(ctx context.Context, groups *GroupUsecase, rg roleGroup) error {
+			return groups.SetRole(ctx, rg.owner, rg.g.ID, rg.owner, core.RoleMember)
+		}, core.ErrInsufficientRole},
+		{"owner grants ownership", func(ctx context.Context, groups *GroupUsecase, rg roleGroup) error {
+			return groups.SetRole(ctx, rg.owner, rg.g.ID, rg.member, core.RoleOwner)
+		}, core.ErrInvalidRole},
+		{"owner promotes a member", func(ctx context.Context, groups *GroupUsecase, rg roleGroup) error {
+			return groups.SetRole(ctx, rg.owner, rg.g.ID, rg.member, core.RoleAdmin)
+		}, nil},
+		{"owner demotes an admin", func(ctx context.Context, groups *GroupUsecase, rg roleGroup) error {
+			return groups.SetRole(ctx, rg.owner, rg.g.ID, rg.admin, core.RoleMember)
+		}, nil},
+		{"admin removes a peer", func(ctx context.Context, groups *GroupUsecase, rg roleGroup) error {
+			return groups.RemoveMember(ctx, rg.admin, rg.g.ID, rg.peer)
+		}, core.ErrInsufficientRole},
+		{"admin removes the owner", func(ctx context.Context, groups *GroupUsecase, rg roleGroup) error {
+			return groups.RemoveMember(ctx, rg.admin, rg.g.ID, rg.owner)
+		}, core.ErrInsufficientRole},
+		{"member removes an admin", func(ctx context.Context, groups *GroupUsecase, rg roleGroup) error {
+			return groups.RemoveMember(ctx, rg.member, rg.g.ID, rg.admin)
+		}, core.ErrInsufficientRole},
+		{"admin removes a member", func(ctx context.Context, groups *GroupUsecase, rg roleGroup) error {
+			return groups.RemoveMember(ctx, rg.admin, rg.g.ID, rg.member)
+		}, nil},
+		{"owner removes an admin", func(ctx context.Context, groups *GroupUsecase, rg roleGroup) error {
+			return groups.RemoveMember(ctx, rg.owner, rg.g.ID, rg.admin)
+		}, nil},
+		{"owner transfers to a non-member", func(ctx context.Context, groups *GroupUsecase, rg roleGroup) error {
+			return groups.TransferOwnership(ctx, rg.owner, rg.g.ID, rg.outsider)
+		}, core.ErrNotFound},
+		{"admin transfers ownership", func(ctx context.Context, groups *GroupUsecase, rg roleGroup) error {
+			return groups.TransferOwnership(ctx, rg.admin, rg.g.ID, rg.admin)
+		}, core.ErrInsufficientRole},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			groups, _, rg := newRoleGroup(t)
+			err := c.do(context.Background(), groups, rg)
+			if !errors.Is(err, c.want) {
+				t.Fatalf("got %v, want %v", err, c.want)
+			}
+		})
+	}
+}
+
+func TestTransferOwnership(t *testing.T) {
+	ctx := context.Background()
+	groups, repos, rg := newRoleGroup(t)
+	if err := groups.TransferOwnership(ctx, rg.owner, rg.g.ID, rg.member); err != nil {
+		t.Fatal(err)
+	}
+	for user, want := range map[uuid.UUID]core.GroupRole{rg.member: core.RoleOwner, rg.owner: core.RoleAdmin} {
+		if m, err := repos.GroupRepo().GetMember(ctx, rg.g.ID, user); err != nil || m.Role != want {
+			t.Errorf("after the transfer: got %+v, %v, want %s", m, err, want)
+		}
+	}
+}
+
+func TestOwnerLeaving(t *testing.T) {
+	cases := []struct {
+		name  string
+		roles []core.GroupRole // of the members joining after the owner, in order
+		next  int              // index into roles of the new owner, -1 if the group goes
+	}{
+		{"longest standing admin", []core.GroupRole{core.RoleMember, core.RoleAdmin, core.RoleAdmin}, 1},
+		{"longest standing member without admins", []core.GroupRole{core.RoleMember, core.RoleMember}, 0},
+		{"last member", nil, -1},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			ctx := context.Background()
+			groups, repos, owner, g := newGroupTest(t)
+			ids := make([]uuid.UUID, len(c.roles))
+			for i, role := range c.roles {
+				ids[i] = newMemoryUser(t, repos, uuid.NewString()).ID
+				if err := repos.GroupRepo().AddGroupMember(ctx, g.ID, ids[i], role); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if err := groups.Leave(ctx, owner.ID, g.ID); err != nil {
+				t.Fatal(err)
+			}
+			if c.next < 0 {
+				if _, err := repos.GroupRepo().GetGroup(ctx, g.ID); !errors.Is(err, core.ErrNotFound) {
+					t.Fatalf("GetGroup after the last member left: got %v, want ErrNotFound", err)
+				}
+				return
+			}
+			if ok, _ := repos.GroupRepo().IsMember(ctx, g.ID, owner.ID); ok {
+				t.Error("the owner is still a member")
+			}
+			for i, id := range ids {
+				want := c.roles[i]
+				if i == c.next {
+					want = core.RoleOwner
+				}
+				if m, err := repos.GroupRepo().GetMember(ctx, g.ID, id); err != nil || m.Role != want {
+					t.Errorf("member %d: got %+v, %v, want %s", i, m, err, want)
+				}
+			}
+		})
+	}
+}
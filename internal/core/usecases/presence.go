@@ -0,0 +1,122 @@
+package usecases
+
+import (
+	"context"
+	"slices"
+	"time"
+
+	"example.com/go-chat/internal/core"
+	"github.com/google/uuid"
+)
+
+// PresenceTTL is how long a connection counts as online without a heartbeat.
+// It must exceed the websocket ping interval.
+const PresenceTTL = 90 * time.Second
+
+// PresenceSweepInterval is how often each instance looks for users whose
+// connections were held by an instance that died.
+const PresenceSweepInterval = 30 * time.Second
+
+// MaxPresenceBatch bounds the number of users looked up in one call.
+const MaxPresenceBatch = 100
+
+// PresenceUsecase tracks which users are connected. Each server instance
+// reports the users it holds connections for; transitions between online and
+// offline are pushed to the user's contacts.
+type PresenceUsecase struct {
+	repos    core.Repositories
+	presence core.PresenceStore
+	broker   core.Broker
+}
+
+func NewPresenceUsecase(r core.Repositories, presence core.PresenceStore, broker core.Broker) *PresenceUsecase {
+	return &PresenceUsecase{repos: r, presence: presence, broker: broker}
+}
+
+// Connected marks user online on instance. It is also the heartbeat: calling
+// it again extends the entry.
+func (p *PresenceUsecase) Connected(ctx context.Context, user uuid.UUID, instance string) error {
+	cameOnline, err := p.presence.SetPresence(ctx, user.String(), instance, PresenceTTL)
+	if err != nil {
+		return err
+	}
+	if cameOnline {
+		p.publish(ctx, core.Presence{UserID: user, Online: true})
+	}
+	return nil
+}
+
+// Disconnected is called once instance holds no more connections for user.
+func (p *PresenceUsecase) Disconnected(ctx context.Context, user uuid.UUID, instance string) error {
+	wentOffline, err := p.presence.RemovePresence(ctx, user.String(), instance)
+	if err != nil {
+		return err
+	}
+	if wentOffline {
+		now := time.Now()
+		p.publish(ctx, core.Presence{UserID: user, LastSeen: &now})
+	}
+	return nil
+}
+
+// Sweep takes offline the users whose entries all ran out without a
+// disconnect, which happens when the instance holding their connections dies.
+func (p *PresenceUsecase) Sweep(ctx context.Context) error {
+	ids, lastSeen, err := p.presence.ExpirePresence(ctx, time.Now())
+	for i, id := range ids {
+		user, perr := uuid.Parse(id)
+		if perr != nil {
+			continue
+		}
+		p.publish(ctx, core.Presence{UserID: user, LastSeen: &lastSeen[i]})
+	}
+	return err
+}
+
+// Get looks up users' presence as seen by viewer. Like the pushed updates, the
+// status is only shown to contacts; anyone else comes back offline with no
+// last seen time.
+func (p *PresenceUsecase) Get(ctx context.Context, viewer uuid.UUID, users []uuid.UUID) ([]core.Presence, error) {
+	if len(users) > MaxPresenceBatch {
+		return nil, core.ErrInvalidInput
+	}
+	contacts, err := p.repos.UserRepo().ListContacts(ctx, viewer)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, len(users))
+	for i, u := range users {
+		ids[i] = u.String()
+	}
+	online, lastSeen, err := p.presence.GetPresence(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]core.Presence, len(users))
+	for i, u := range users {
+		out[i] = core.Presence{UserID: u}
+		if u != viewer && !slices.Contains(contacts, u) {
+			continue
+		}
+		out[i].Online = online[i]
+		if !lastSeen[i].IsZero() {
+			out[i].LastSeen = &lastSeen[i]
+		}
+	}
+	return out, nil
+}
+
+// publish pushes a presence change to every contact of the user.
+func (p *PresenceUsecase) publish(ctx context.Context, presence core.Presence) {
+	contacts, err := p.repos.UserRepo().ListContacts(ctx, presence.UserID)
+	if err != nil || len(contacts) == 0 {
+		return
+	}
+	ev, err := core.NewEvent(core.EventPresenceUpdate, presence)
+	if err != nil {
+		return
+	}
+	for _, id := range contacts {
+		_ = p.broker.Publish(ctx, core.PrivateChannel(id), ev)
+	}
+}
@@ -0,0 +1,153 @@
+package usecases
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"example.com/go-chat/internal/core"
+	"example.com/go-chat/internal/drivers"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/google/uuid"
+)
+
+type presenceRepos struct {
+	core.Repositories
+	users *contactUsers
+}
+
+func (r *presenceRepos) UserRepo() core.UserRepository { return r.users }
+
+// contactUsers gives every user the same contacts.
+type contactUsers struct {
+	core.UserRepository
+	contacts []uuid.UUID
+}
+
+func (u *contactUsers) ListContacts(ctx context.Context, userID uuid.UUID) ([]uuid.UUID, error) {
+	return u.contacts, nil
+}
+
+func TestPresenceAcrossInstances(t *testing.T) {
+	rds := drivers.NewRedis(miniredis.RunT(t).Addr())
+	user, viewer := uuid.New(), uuid.New()
+	p := NewPresenceUsecase(&presenceRepos{users: &contactUsers{contacts: []uuid.UUID{user}}}, rds, rds)
+	ctx := context.Background()
+
+	online := func() core.Presence {
+		t.Helper()
+		got, err := p.Get(ctx, viewer, []uuid.UUID{user})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return got[0]
+	}
+
+	if got := online(); got.Online || got.LastSeen != nil {
+		t.Fatalf("unknown user: got %+v", got)
+	}
+	if err := p.Connected(ctx, user, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Connected(ctx, user, "b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Disconnected(ctx, user, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if got := online(); !got.Online {
+		t.Fatal("user still connected on b should be online")
+	}
+	if err := p.Disconnected(ctx, user, "b"); err != nil {
+		t.Fatal(err)
+	}
+	if got := online(); got.Online || got.LastSeen == nil {
+		t.Fatalf("after last disconnect: got %+v", got)
+	}
+}
+
+func TestPresenceSweepAfterInstanceDies(t *testing.T) {
+	ctx := context.Background()
+	rds := drivers.NewRedis(miniredis.RunT(t).Addr())
+	user, contact := uuid.New(), uuid.New()
+	// contactUsers gives both users the same list, so it holds each of them
+	p := NewPresenceUsecase(&presenceRepos{users: &contactUsers{contacts: []uuid.UUID{contact, user}}}, rds, rds)
+	ps := rds.Subscribe(ctx, core.PrivateChannel(contact))
+	defer ps.Close()
+
+	// the instance holding the connection stops sending heartbeats
+	if _, err := rds.SetPresence(ctx, user.String(), "dead", 10*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if err := p.Sweep(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case msg := <-ps.Channel():
+		var ev core.Event
+		var presence core.Presence
+		if err := json.Unmarshal([]byte(msg.Payload), &ev); err != nil {
+			t.Fatal(err)
+		}
+		if err := json.Unmarshal(ev.Payload, &presence); err != nil {
+			t.Fatal(err)
+		}
+		if ev.Type != core.EventPresenceUpdate || presence.UserID != user || presence.Online || presence.LastSeen == nil {
+			t.Fatalf("got %s %+v, want the user going offline", ev.Type, presence)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no presence update")
+	}
+	got, err := p.Get(ctx, contact, []uuid.UUID{user})
+	if err != nil || got[0].Online || got[0].LastSeen == nil {
+		t.Fatalf("after the sweep: got %+v, %v", got, err)
+	}
+}
+
+func TestPresenceBatchLimit(t *testing.T) {
+	rds := drivers.NewRedis(miniredis.RunT(t).Addr())
+	p := NewPresenceUsecase(&presenceRepos{users: &contactUsers{}}, rds, rds)
+	_, err := p.Get(context.Background(), uuid.New(), make([]uuid.UUID, MaxPresenceBatch+1))
+	if !errors.Is(err, core.ErrInvalidInput) {
+		t.Fatalf("got %v, want ErrInvalidInput", err)
+	}
+}
+
+func TestPresenceHiddenFromNonContacts(t *testing.T) {
+	ctx := context.Background()
+	rds := drivers.NewRedis(miniredis.RunT(t).Addr())
+	user, contact, stranger := uuid.New(), uuid.New(), uuid.New()
+	p := NewPresenceUsecase(&presenceRepos{users: &contactUsers{contacts: []uuid.UUID{contact}}}, rds, rds)
+	if err := p.Connected(ctx, user, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Connected(ctx, contact, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Disconnected(ctx, contact, "a"); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := p.Get(ctx, user, []uuid.UUID{contact, stranger, user})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got[0].Online || got[0].LastSeen == nil {
+		t.Errorf("contact: got %+v, want offline with a last seen time", got[0])
+	}
+	if !got[2].Online {
+		t.Errorf("self: got %+v, want online", got[2])
+	}
+	// contactUsers gives stranger only contact, so user's status stays hidden
+	got, err = p.Get(ctx, stranger, []uuid.UUID{user})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got[0].UserID != user || got[0].Online || got[0].LastSeen != nil {
+		t.Errorf("non-contact: got %+v, want no status", got[0])
+	}
+}
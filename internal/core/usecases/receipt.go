@@ -0,0 +1,106 @@
+package usecases
+
+import (
+	"context"
+	"time"
+
+	"example.com/go-chat/internal/core"
+	"github.com/google/uuid"
+)
+
+// MaxReadReceipts bounds how many messages a single read records receipts
+// for. Older unread messages are still covered by the read cursor.
+const MaxReadReceipts = 500
+
+// ReceiptUsecase records delivery and read receipts and reports them to the
+// senders of the messages.
+type ReceiptUsecase struct {
+	repos  core.Repositories
+	broker core.Broker
+}
+
+func NewReceiptUsecase(r core.Repositories, broker core.Broker) *ReceiptUsecase {
+	return &ReceiptUsecase{repos: r, broker: broker}
+}
+
+// Delivered records that m reached one of user's devices.
+func (r *ReceiptUsecase) Delivered(ctx context.Context, user uuid.UUID, m *core.Message) error {
+	if m.SenderID == user {
+		return nil
+	}
+	now := time.Now()
+	first, err := r.repos.ReceiptRepo().MarkDelivered(ctx, m.ID, user, now)
+	if err != nil || !first {
+		return err
+	}
+	up := core.ReceiptUpdate{MessageID: m.ID, GroupID: m.GroupID, Status: core.ReceiptDelivered, At: now}
+	if m.GroupID == nil {
+		up.UserID = &user
+		r.publish(ctx, m.SenderID, up)
+		return nil
+	}
+	return r.publishCounts(ctx, []core.Message{*m}, up)
+}
+
+// Read marks every message of the conversation up to and including
+// messageID as read by user.
+func (r *ReceiptUsecase) Read(ctx context.Context, user, messageID uuid.UUID) error {
+	m, err := participantMessage(ctx, r.repos, user, messageID)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	msgs, err := r.repos.ReceiptRepo().MarkRead(ctx, user, m, now, MaxReadReceipts)
+	if err != nil || len(msgs) == 0 {
+		return err
+	}
+	up := core.ReceiptUpdate{GroupID: m.GroupID, Status: core.ReceiptRead, At: now}
+	if m.GroupID == nil {
+		// msgs are newest first; the newest one stands for all of them
+		up.MessageID = msgs[0].ID
+		up.UserID = &user
+		r.publish(ctx, msgs[0].SenderID, up)
+		return nil
+	}
+	return r.publishCounts(ctx, msgs, up)
+}
+
+// Receipts lists the receipts of a message. Only its sender may see them.
+func (r *ReceiptUsecase) Receipts(ctx context.Context, user, messageID uuid.UUID) ([]core.MessageReceipt, error) {
+	m, err := r.repos.MessageRepo().GetMessage(ctx, messageID)
+	if err != nil {
+		return nil, err
+	}
+	if m.SenderID != user {
+		return nil, core.ErrForbidden
+	}
+	return r.repos.ReceiptRepo().ListReceipts(ctx, messageID)
+}
+
+// publishCounts sends each sender of the group messages msgs the aggregated
+// receipts of their message.
+func (r *ReceiptUsecase) publishCounts(ctx context.Context, msgs []core.Message, up core.ReceiptUpdate) error {
+	ids := make([]uuid.UUID, len(msgs))
+	for i, m := range msgs {
+		ids[i] = m.ID
+	}
+	counts, err := r.repos.ReceiptRepo().CountReceipts(ctx, ids)
+	if err != nil {
+		return err
+	}
+	for _, m := range msgs {
+		c := counts[m.ID]
+		up.MessageID, up.Counts = m.ID, &c
+		r.publish(ctx, m.SenderID, up)
+	}
+	return nil
+}
+
+// publish is best effort like message delivery: receipts can always be fetched.
+func (r *ReceiptUsecase) publish(ctx context.Context, sender uuid.UUID, up core.ReceiptUpdate) {
+	ev, err := core.NewEvent(core.EventReceiptUpdate, up)
+	if err != nil {
+		return
+	}
+	_ = r.broker.Publish(ctx, core.PrivateChannel(sender), ev)
+}
@@ -0,0 +1,126 @@
+package usecases
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"example.com/go-chat/internal/core"
+	"example.com/go-chat/internal/drivers"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/google/uuid"
+)
+
+type receiptRepos struct {
+	core.Repositories
+	groups   *stubGroups
+	messages *messageByID
+	receipts *stubReceipts
+}
+
+func (r *receiptRepos) GroupRepo() core.GroupRepository     { return r.groups }
+func (r *receiptRepos) MessageRepo() core.MessageRepository { return r.messages }
+func (r *receiptRepos) ReceiptRepo() core.ReceiptRepository { return r.receipts }
+
+type messageByID struct {
+	core.MessageRepository
+	msgs map[uuid.UUID]*core.Message
+}
+
+func (m *messageByID) GetMessage(ctx context.Context, id uuid.UUID) (*core.Message, error) {
+	msg, ok := m.msgs[id]
+	if !ok {
+		return nil, core.ErrNotFound
+	}
+	return msg, nil
+}
+
+// stubReceipts reads every message it is told about at once.
+type stubReceipts struct {
+	core.ReceiptRepository
+	unread []core.Message
+	reads  map[uuid.UUID]int
+}
+
+func (r *stubReceipts) MarkRead(ctx context.Context, userID uuid.UUID, m *core.Message, at time.Time, limit int) ([]core.Message, error) {
+	msgs := r.unread
+	r.unread = nil
+	for _, msg := range msgs {
+		r.reads[msg.ID]++
+	}
+	return msgs, nil
+}
+
+func (r *stubReceipts) CountReceipts(ctx context.Context, ids []uuid.UUID) (map[uuid.UUID]core.ReceiptCounts, error) {
+	counts := map[uuid.UUID]core.ReceiptCounts{}
+	for _, id := range ids {
+		counts[id] = core.ReceiptCounts{Delivered: r.reads[id], Read: r.reads[id]}
+	}
+	return counts, nil
+}
+
+func TestGroupReadPublishesCountsToSenders(t *testing.T) {
+	ctx := context.Background()
+	rds := drivers.NewRedis(miniredis.RunT(t).Addr())
+	reader, alice, bob, group := uuid.New(), uuid.New(), uuid.New(), uuid.New()
+	older := core.Message{ID: uuid.New(), SenderID: alice, GroupID: &group}
+	newer := core.Message{ID: uuid.New(), SenderID: bob, GroupID: &group}
+	repos := &receiptRepos{
+		groups:   &stubGroups{members: map[uuid.UUID]bool{reader: true}},
+		messages: &messageByID{msgs: map[uuid.UUID]*core.Message{newer.ID: &newer}},
+		receipts: &stubReceipts{unread: []core.Message{newer, older}, reads: map[uuid.UUID]int{older.ID: 2}},
+	}
+	ps := rds.Subscribe(ctx, core.PrivateChannel(alice), core.PrivateChannel(bob))
+	defer ps.Close()
+
+	if err := NewReceiptUsecase(repos, rds).Read(ctx, reader, newer.ID); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]core.ReceiptUpdate{
+		core.PrivateChannel(alice): {MessageID: older.ID, Counts: &core.ReceiptCounts{Delivered: 3, Read: 3}},
+		core.PrivateChannel(bob):   {MessageID: newer.ID, Counts: &core.ReceiptCounts{Delivered: 1, Read: 1}},
+	}
+	for range want {
+		select {
+		case msg := <-ps.Channel():
+			var ev core.Event
+			var up core.ReceiptUpdate
+			if err := json.Unmarshal([]byte(msg.Payload), &ev); err != nil {
+				t.Fatal(err)
+			}
+			if err := json.Unmarshal(ev.Payload, &up); err != nil {
+				t.Fatal(err)
+			}
+			w := want[msg.Channel]
+			if ev.Type != core.EventReceiptUpdate || up.Status != core.ReceiptRead || up.MessageID != w.MessageID || *up.Counts != *w.Counts {
+				t.Errorf("%s: got %s %+v counts %+v, want read of %s counts %+v", msg.Channel, ev.Type, up, up.Counts, w.MessageID, w.Counts)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("missing receipt update")
+		}
+	}
+}
+
+func TestReceiptsAccess(t *testing.T) {
+	ctx := context.Background()
+	sender, recipient, outsider := uuid.New(), uuid.New(), uuid.New()
+	m := core.Message{ID: uuid.New(), SenderID: sender, RecipientID: &recipient}
+	repos := &receiptRepos{
+		groups:   &stubGroups{members: map[uuid.UUID]bool{}},
+		messages: &messageByID{msgs: map[uuid.UUID]*core.Message{m.ID: &m}},
+		receipts: &stubReceipts{reads: map[uuid.UUID]int{}},
+	}
+	receipts := NewReceiptUsecase(repos, nil)
+
+	if err := receipts.Read(ctx, outsider, m.ID); !errors.Is(err, core.ErrForbidden) {
+		t.Fatalf("Read by outsider: got %v, want ErrForbidden", err)
+	}
+	if _, err := receipts.Receipts(ctx, recipient, m.ID); !errors.Is(err, core.ErrForbidden) {
+		t.Fatalf("Receipts by recipient: got %v, want ErrForbidden", err)
+	}
+	if err := receipts.Read(ctx, recipient, uuid.New()); !errors.Is(err, core.ErrNotFound) {
+		t.Fatalf("Read of unknown message: got %v, want ErrNotFound", err)
+	}
+}
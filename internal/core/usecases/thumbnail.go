@@ -0,0 +1,153 @@
+package usecases
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"io"
+	"log"
+	"strings"
+
+	// decoders for the image types accepted for upload
+	_ "image/gif"
+	_ "image/png"
+
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+
+	"example.com/go-chat/internal/core"
+	"github.com/google/uuid"
+)
+
+const (
+	// ThumbnailSize bounds the width and height of a thumbnail.
+	ThumbnailSize = 320
+	// MaxThumbnailPixels is the largest image, in pixels, a thumbnail is made
+	// for; larger ones only get their dimensions recorded.
+	MaxThumbnailPixels = 40_000_000
+	thumbnailQueue     = 256
+)
+
+// ThumbnailWorker reads the dimensions of uploaded images and makes their
+// thumbnails in the background. Once an image sent with a message is done, the
+// message is pushed again as message.updated.
+type ThumbnailWorker struct {
+	repos  core.Repositories
+	broker core.Broker
+	store  core.AttachmentStore
+	jobs   chan uuid.UUID
+}
+
+func NewThumbnailWorker(r core.Repositories, broker core.Broker, store core.AttachmentStore) *ThumbnailWorker {
+	return &ThumbnailWorker{repos: r, broker: broker, store: store, jobs: make(chan uuid.UUID, thumbnailQueue)}
+}
+
+// Enqueue schedules an attachment if it is an image. It never blocks: when the
+// queue is full the attachment simply gets no preview.
+func (w *ThumbnailWorker) Enqueue(att *core.Attachment) {
+	if !strings.HasPrefix(att.ContentType, "image/") {
+		return
+	}
+	select {
+	case w.jobs <- att.ID:
+	default:
+		log.Println("thumbnail queue full, skipping", att.ID)
+	}
+}
+
+// Run processes attachments one at a time until ctx is done.
+func (w *ThumbnailWorker) Run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case id := <-w.jobs:
+			if err := w.Process(ctx, id); err != nil {
+				log.Println("thumbnail", id, err)
+			}
+		}
+	}
+}
+
+// Process records the dimensions of an image attachment and stores its
+// thumbnail next to it.
+func (w *ThumbnailWorker) Process(ctx context.Context, id uuid.UUID) error {
+	att, err := w.repos.AttachmentRepo().GetAttachment(ctx, id)
+	if err != nil {
+		return err
+	}
+	body, err := w.store.Get(ctx, att.StorageKey)
+	if err != nil {
+		return err
+	}
+	data, err := io.ReadAll(io.LimitReader(body, MaxAttachmentSize))
+	body.Close()
+	if err != nil {
+		return err
+	}
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+
+	thumbKey, thumbnail := att.ThumbnailKey(), false
+	// DecodeConfig is cheap; checking the size first keeps a small file that
+	// claims huge dimensions from being decoded
+	if int64(cfg.Width)*int64(cfg.Height) <= MaxThumbnailPixels {
+		img, _, err := image.Decode(bytes.NewReader(data))
+		if err != nil {
+			return err
+		}
+		var buf bytes.Buffer
+		if err := jpeg.Encode(&buf, shrink(img, ThumbnailSize), &jpeg.Options{Quality: 80}); err != nil {
+			return err
+		}
+		if err := w.store.Put(ctx, thumbKey, &buf, int64(buf.Len()), "image/jpeg"); err != nil {
+			return err
+		}
+		thumbnail = true
+	}
+
+	att, err = w.repos.AttachmentRepo().SetAttachmentPreview(ctx, id, cfg.Width, cfg.Height, thumbnail)
+	if errors.Is(err, core.ErrNotFound) {
+		// deleted with its message meanwhile
+		if thumbnail {
+			_ = w.store.Delete(ctx, thumbKey)
+		}
+		return nil
+	}
+	if err != nil || att.MessageID == nil {
+		// not sent yet: message.new will carry the preview
+		return err
+	}
+	m, err := w.repos.MessageRepo().GetMessage(ctx, *att.MessageID)
+	if err != nil || m.DeletedAt != nil {
+		return err
+	}
+	if m.Attachments, err = w.repos.AttachmentRepo().MessageAttachments(ctx, m.ID); err != nil {
+		return err
+	}
+	publishEvent(ctx, w.broker, core.EventMessageUpdated, m, channelsOf(m)...)
+	return nil
+}
+
+// shrink scales img down to fit in a size x size square, on a white
+// background since JPEG has no transparency. Smaller images keep their size.
+func shrink(img image.Image, size int) image.Image {
+	b := img.Bounds()
+	width, height := b.Dx(), b.Dy()
+	if width > size || height > size {
+		if width >= height {
+			width, height = size, max(1, height*size/width)
+		} else {
+			width, height = max(1, width*size/height), size
+		}
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(dst, dst.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	draw.BiLinear.Scale(dst, dst.Bounds(), img, b, draw.Over, nil)
+	return dst
+}
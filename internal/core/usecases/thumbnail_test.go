@@ -0,0 +1,90 @@
+package usecases
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"image"
+	"image/color"
+	"image/png"
+	"testing"
+	"time"
+
+	"example.com/go-chat/internal/core"
+	"example.com/go-chat/internal/drivers"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/google/uuid"
+)
+
+func TestThumbnailWorkerUpdatesSentMessage(t *testing.T) {
+	ctx := context.Background()
+	a, repos := newAttachmentTest(t)
+	rds := drivers.NewRedis(miniredis.RunT(t).Addr())
+	worker := NewThumbnailWorker(repos, rds, a.store)
+	sender, recipient := uuid.New(), uuid.New()
+
+	img := image.NewNRGBA(image.Rect(0, 0, 800, 400))
+	for x := range 800 {
+		img.Set(x, x%400, color.Black)
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	att, err := a.Upload(ctx, sender, "wide.png", int64(buf.Len()), &buf)
+	if err != nil {
+		t.Fatalf("Upload: %v", err)
+	}
+	m := &core.Message{ID: uuid.New(), SenderID: sender, RecipientID: &recipient}
+	repos.messages.msgs[m.ID] = m
+	att.MessageID = &m.ID
+
+	sub := rds.Subscribe(ctx, core.PrivateChannel(recipient))
+	defer sub.Close()
+	if err := worker.Process(ctx, att.ID); err != nil {
+		t.Fatalf("Process: %v", err)
+	}
+	if att.Width != 800 || att.Height != 400 || !att.Thumbnail {
+		t.Fatalf("preview: got %dx%d thumbnail=%v", att.Width, att.Height, att.Thumbnail)
+	}
+
+	d, err := a.Thumbnail(ctx, recipient, att.ID)
+	if err != nil {
+		t.Fatalf("Thumbnail: %v", err)
+	}
+	defer d.Body.Close()
+	cfg, format, err := image.DecodeConfig(d.Body)
+	if err != nil || format != "jpeg" || cfg.Width != ThumbnailSize || cfg.Height != ThumbnailSize/2 {
+		t.Fatalf("thumbnail: got %s %dx%d, %v", format, cfg.Width, cfg.Height, err)
+	}
+
+	select {
+	case msg := <-sub.Channel():
+		var ev struct {
+			Type    string       `json:"type"`
+			Payload core.Message `json:"payload"`
+		}
+		if err := json.Unmarshal([]byte(msg.Payload), &ev); err != nil {
+			t.Fatal(err)
+		}
+		if ev.Type != core.EventMessageUpdated || len(ev.Payload.Attachments) != 1 || !ev.Payload.Attachments[0].Thumbnail {
+			t.Fatalf("event: got %+v", ev)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no message.updated event")
+	}
+}
+
+func TestThumbnailOnlyOnceReady(t *testing.T) {
+	ctx := context.Background()
+	a, _ := newAttachmentTest(t)
+	user := uuid.New()
+	att, err := a.Upload(ctx, user, "cat.png", int64(len(pngHeader)), bytes.NewReader(pngHeader))
+	if err != nil {
+		t.Fatalf("Upload: %v", err)
+	}
+	if _, err := a.Thumbnail(ctx, user, att.ID); !errors.Is(err, core.ErrNotFound) {
+		t.Fatalf("Thumbnail before processing: got %v, want ErrNotFound", err)
+	}
+}
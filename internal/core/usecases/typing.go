@@ -0,0 +1,70 @@
+package usecases
+
+import (
+	"context"
+	"slices"
+	"time"
+
+	"example.com/go-chat/internal/core"
+	"github.com/google/uuid"
+)
+
+// TypingTTL is how long receivers should show a typing indicator that is not
+// refreshed. Typing indicators are relayed as they happen and never stored.
+const TypingTTL = 6 * time.Second
+
+type TypingUsecase struct {
+	repos  core.Repositories
+	broker core.Broker
+}
+
+func NewTypingUsecase(r core.Repositories, broker core.Broker) *TypingUsecase {
+	return &TypingUsecase{repos: r, broker: broker}
+}
+
+// Typing relays that from started or stopped typing to the private
+// conversation with to or to group. Exactly one of to and group must be set.
+func (t *TypingUsecase) Typing(ctx context.Context, from uuid.UUID, to, group *uuid.UUID, typing bool) error {
+	if (to == nil) == (group == nil) {
+		return core.ErrInvalidInput
+	}
+	ev := core.Typing{UserID: from, To: to, GroupID: group, Typing: typing}
+	if typing {
+		ev.ExpiresIn = int(TypingTTL / time.Second)
+	}
+	var channel string
+	if to != nil {
+		// stops only follow a start that passed this check
+		if typing {
+			if err := requireContact(ctx, t.repos, from, *to); err != nil {
+				return err
+			}
+		}
+		channel = core.PrivateChannel(*to)
+	} else {
+		if typing {
+			if err := requireMember(ctx, t.repos, *group, from); err != nil {
+				return err
+			}
+		}
+		channel = core.GroupChannel(*group)
+	}
+	payload, err := core.NewEvent(core.EventTypingUpdate, ev)
+	if err != nil {
+		return err
+	}
+	return t.broker.Publish(ctx, channel, payload)
+}
+
+// requireContact checks that user shares a private conversation or a group
+// with other, the same users presence updates reach.
+func requireContact(ctx context.Context, repos core.Repositories, user, other uuid.UUID) error {
+	contacts, err := repos.UserRepo().ListContacts(ctx, user)
+	if err != nil {
+		return err
+	}
+	if !slices.Contains(contacts, other) {
+		return core.ErrNotContact
+	}
+	return nil
+}
@@ -0,0 +1,241 @@
+package drivers
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+
+	"example.com/go-chat/internal/core"
+)
+
+func TestRedisCluster(t *testing.T) {
+	testCluster(t, NewRedis(miniredis.RunT(t).Addr()))
+}
+
+func TestLocalBroker(t *testing.T) {
+	testCluster(t, NewLocalBroker())
+}
+
+// testCluster runs the behaviour every core.Cluster shares.
+func testCluster(t *testing.T, c core.Cluster) {
+	t.Run("PubSub", func(t *testing.T) { testPubSub(t, c) })
+	t.Run("Presence", func(t *testing.T) { testPresence(t, c) })
+	t.Run("Denylist", func(t *testing.T) { testDenylist(t, c) })
+}
+
+func receive(t *testing.T, sub core.Subscription) *core.BrokerMessage {
+	t.Helper()
+	select {
+	case msg, ok := <-sub.Channel():
+		if !ok {
+			t.Fatal("subscription closed")
+		}
+		return msg
+	case <-time.After(time.Second):
+		t.Fatal("nothing received")
+		return nil
+	}
+}
+
+func expectNothing(t *testing.T, sub core.Subscription) {
+	t.Helper()
+	select {
+	case msg := <-sub.Channel():
+		t.Fatalf("unexpected message %+v", msg)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func testPubSub(t *testing.T, b core.Broker) {
+	ctx := context.Background()
+	sub := b.Subscribe(ctx, "a", "b")
+	other := b.Subscribe(ctx, "a")
+	defer other.Close()
+
+	for i := range 3 {
+		if err := b.Publish(ctx, "a", fmt.Sprint(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := b.Publish(ctx, "c", "unheard"); err != nil {
+		t.Fatal(err)
+	}
+	for i := range 3 {
+		if msg := receive(t, sub); msg.Channel != "a" || msg.Payload != fmt.Sprint(i) {
+			t.Fatalf("message %d: got %+v", i, msg)
+		}
+		if msg := receive(t, other); msg.Payload != fmt.Sprint(i) {
+			t.Fatalf("other subscription, message %d: got %+v", i, msg)
+		}
+	}
+
+	// a channel added later is subscribed to once Subscribe returns, even
+	// with messages still waiting to be read
+	for i := range 3 {
+		_ = b.Publish(ctx, "b", fmt.Sprint("waiting ", i))
+	}
+	subscribeCtx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	if err := sub.Subscribe(subscribeCtx, "c"); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Publish(ctx, "c", "late"); err != nil {
+		t.Fatal(err)
+	}
+	for i := range 3 {
+		if msg := receive(t, sub); msg.Payload != fmt.Sprint("waiting ", i) {
+			t.Fatalf("message %d waiting: got %+v", i, msg)
+		}
+	}
+	if msg := receive(t, sub); msg.Channel != "c" || msg.Payload != "late" {
+		t.Fatalf("late channel: got %+v", msg)
+	}
+
+	if err := sub.Unsubscribe(ctx, "a", "c"); err != nil {
+		t.Fatal(err)
+	}
+	// the unsubscribe is settled once a round of publishes brings only the
+	// message on the channel still subscribed to
+	deadline := time.Now().Add(time.Second)
+	for round := 0; ; round++ {
+		marker := fmt.Sprint("marker ", round)
+		_ = b.Publish(ctx, "a", "unsubscribed")
+		_ = b.Publish(ctx, "c", "unsubscribed")
+		_ = b.Publish(ctx, "b", marker)
+		settled := true
+		for msg := receive(t, sub); msg.Payload != marker; msg = receive(t, sub) {
+			if msg.Channel == "b" {
+				t.Fatalf("got %+v, want %q", msg, marker)
+			}
+			settled = false
+		}
+		if settled {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("still receiving after unsubscribing")
+		}
+	}
+	_ = b.Publish(ctx, "a", "unsubscribed")
+	expectNothing(t, sub)
+
+	if err := sub.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case msg, ok := <-sub.Channel():
+		if ok {
+			t.Fatalf("message after Close: %+v", msg)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Channel not closed by Close")
+	}
+}
+
+func testPresence(t *testing.T, p core.PresenceStore) {
+	ctx := context.Background()
+	online := func(user string) (bool, time.Time) {
+		t.Helper()
+		on, seen, err := p.GetPresence(ctx, []string{user})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return on[0], seen[0]
+	}
+
+	if first, err := p.SetPresence(ctx, "alice", "i1", time.Minute); err != nil || !first {
+		t.Fatalf("SetPresence: got %v, %v, want the user to come online", first, err)
+	}
+	if first, _ := p.SetPresence(ctx, "alice", "i2", time.Minute); first {
+		t.Error("second instance brought an online user online")
+	}
+	if on, _ := online("alice"); !on {
+		t.Error("alice is not online")
+	}
+	if last, _ := p.RemovePresence(ctx, "alice", "i1"); last {
+		t.Error("RemovePresence reported offline while another instance holds a connection")
+	}
+	before := time.Now().Add(-time.Second)
+	if last, _ := p.RemovePresence(ctx, "alice", "i2"); !last {
+		t.Error("RemovePresence of the last instance did not report offline")
+	}
+	if on, seen := online("alice"); on || seen.Before(before) {
+		t.Errorf("after going offline: online %v, last seen %v", on, seen)
+	}
+
+	if _, err := p.SetPresence(ctx, "bob", "i1", 20*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(40 * time.Millisecond)
+	if on, seen := online("bob"); on || !seen.IsZero() {
+		t.Errorf("after the entry expired: online %v, last seen %v", on, seen)
+	}
+	// dave's entry ran out as well but he is back before the sweep
+	if _, err := p.SetPresence(ctx, "dave", "i1", 20*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(40 * time.Millisecond)
+	if first, _ := p.SetPresence(ctx, "dave", "i2", time.Minute); !first {
+		t.Error("SetPresence after the entry expired did not report coming online")
+	}
+	ids, seen, err := p.ExpirePresence(ctx, time.Now())
+	if err != nil || len(ids) != 1 || ids[0] != "bob" || seen[0].Before(before) || seen[0].After(time.Now()) {
+		t.Errorf("ExpirePresence: got %v, %v, %v, want bob", ids, seen, err)
+	}
+	if ids, _, _ := p.ExpirePresence(ctx, time.Now()); len(ids) != 0 {
+		t.Errorf("second ExpirePresence: got %v, want nobody", ids)
+	}
+	if on, seen := online("bob"); on || seen.IsZero() {
+		t.Errorf("after the sweep: online %v, last seen %v", on, seen)
+	}
+	if on, _ := online("dave"); !on {
+		t.Error("dave is not online")
+	}
+	if first, _ := p.SetPresence(ctx, "bob", "i1", time.Minute); !first {
+		t.Error("SetPresence after the sweep did not report coming online")
+	}
+	if on, seen := online("carol"); on || !seen.IsZero() {
+		t.Errorf("unknown user: online %v, last seen %v", on, seen)
+	}
+}
+
+func testDenylist(t *testing.T, d core.TokenDenylist) {
+	ctx := context.Background()
+	revoked := func(jti, sid string) bool {
+		t.Helper()
+		ok, err := d.IsRevoked(ctx, jti, sid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ok
+	}
+	if revoked("t1", "s1") {
+		t.Fatal("nothing was revoked yet")
+	}
+	if err := d.RevokeToken(ctx, "t1", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.RevokeToken(ctx, "t2", 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.RevokeSessionTokens(ctx, "s2", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		jti, sid string
+		want     bool
+	}{
+		{"t1", "s1", true},
+		{"t2", "s1", false},
+		{"t3", "s2", true},
+		{"t3", "s3", false},
+	}
+	for _, c := range cases {
+		if got := revoked(c.jti, c.sid); got != c.want {
+			t.Errorf("IsRevoked(%s, %s): got %v, want %v", c.jti, c.sid, got, c.want)
+		}
+	}
+}
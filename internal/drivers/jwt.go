@@ -1,49 +1,223 @@
 package drivers
 
 import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
 	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"sort"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/google/uuid"
 )
 
+// JWTManager signs access tokens and verifies them. It either uses a shared
+// HMAC secret, or a set of RSA/Ed25519 keys identified by kid: tokens are
+// signed with the active key and verified with whichever key their kid names,
+// so keys can be rotated without invalidating tokens already issued.
 type JWTManager struct {
 	secret string
+	active *JWTKey
+	keys   map[string]*JWTKey
+}
+
+// JWTKey is an asymmetric key. Keys loaded from a public key only verify.
+type JWTKey struct {
+	ID      string
+	Method  jwt.SigningMethod
+	Private crypto.Signer
+	Public  crypto.PublicKey
 }
 
 func NewJWTManager(secret string) *JWTManager { return &JWTManager{secret: secret} }
 
-func (j *JWTManager) Generate(userID uuid.UUID, exp time.Duration) (string, error) {
-	claims := jwt.MapClaims{"sub": userID.String(), "exp": time.Now().Add(exp).Unix()}
+// NewJWTManagerFromKeys signs with the private key activeKID and verifies with
+// any of keys. A non-empty legacySecret keeps accepting HMAC tokens issued
+// before the switch to asymmetric keys; it is never used for signing.
+func NewJWTManagerFromKeys(keys []*JWTKey, activeKID, legacySecret string) (*JWTManager, error) {
+	j := &JWTManager{secret: legacySecret, keys: make(map[string]*JWTKey)}
+	for _, k := range keys {
+		if _, dup := j.keys[k.ID]; dup {
+			return nil, fmt.Errorf("duplicate jwt key id %q", k.ID)
+		}
+		j.keys[k.ID] = k
+	}
+	active, ok := j.keys[activeKID]
+	if !ok {
+		return nil, fmt.Errorf("active jwt key %q not found", activeKID)
+	}
+	if active.Private == nil {
+		return nil, fmt.Errorf("active jwt key %q has no private key", activeKID)
+	}
+	j.active = active
+	return j, nil
+}
+
+// LoadPEMKey reads an RSA or Ed25519 key from a PEM file. Private keys may be
+// PKCS#8 or PKCS#1 (RSA); public keys are PKIX.
+func LoadPEMKey(kid, path string) (*JWTKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM block", path)
+	}
+	var key any
+	switch block.Type {
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PUBLIC KEY":
+		key, err = x509.ParsePKIXPublicKey(block.Bytes)
+	case "RSA PUBLIC KEY":
+		key, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("%s: unsupported PEM block %q", path, block.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return NewJWTKey(kid, key)
+}
+
+// NewJWTKey wraps an RSA or Ed25519 private or public key.
+func NewJWTKey(kid string, key any) (*JWTKey, error) {
+	k := &JWTKey{ID: kid}
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		k.Method, k.Private, k.Public = jwt.SigningMethodRS256, key, &key.PublicKey
+	case *rsa.PublicKey:
+		k.Method, k.Public = jwt.SigningMethodRS256, key
+	case ed25519.PrivateKey:
+		k.Method, k.Private, k.Public = jwt.SigningMethodEdDSA, key, key.Public()
+	case ed25519.PublicKey:
+		k.Method, k.Public = jwt.SigningMethodEdDSA, key
+	default:
+		return nil, fmt.Errorf("jwt key %q: unsupported key type %T", kid, key)
+	}
+	return k, nil
+}
+
+// Claims are the verified contents of an access token.
+type Claims struct {
+	ID        string // jti, used to revoke this token alone
+	UserID    uuid.UUID
+	SessionID uuid.UUID
+	ExpiresAt time.Time
+}
+
+func (j *JWTManager) Generate(userID, sessionID uuid.UUID, exp time.Duration) (string, error) {
+	claims := jwt.MapClaims{"jti": uuid.NewString(), "sub": userID.String(), "sid": sessionID.String(), "exp": time.Now().Add(exp).Unix()}
+	if j.active != nil {
+		t := jwt.NewWithClaims(j.active.Method, claims)
+		t.Header["kid"] = j.active.ID
+		return t.SignedString(j.active.Private)
+	}
 	t := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
 	return t.SignedString([]byte(j.secret))
 }
 
-func (j *JWTManager) Verify(tokenStr string) (uuid.UUID, error) {
-	t, err := jwt.Parse(tokenStr, func(t *jwt.Token) (interface{}, error) {
-		if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, errors.New("invalid signing")
-		}
-		return []byte(j.secret), nil
-	})
+func (j *JWTManager) Verify(tokenStr string) (*Claims, error) {
+	t, err := jwt.Parse(tokenStr, j.keyFor, jwt.WithExpirationRequired())
 	if err != nil {
-		return uuid.Nil, err
+		return nil, err
 	}
 	if !t.Valid {
-		return uuid.Nil, errors.New("invalid token")
+		return nil, errors.New("invalid token")
 	}
 	m, ok := t.Claims.(jwt.MapClaims)
 	if !ok {
-		return uuid.Nil, errors.New("invalid claims")
+		return nil, errors.New("invalid claims")
 	}
 	sub, ok := m["sub"].(string)
 	if !ok {
-		return uuid.Nil, errors.New("invalid subject")
+		return nil, errors.New("invalid subject")
 	}
 	id, err := uuid.Parse(sub)
 	if err != nil {
-		return uuid.Nil, err
+		return nil, err
+	}
+	sid, ok := m["sid"].(string)
+	if !ok {
+		return nil, errors.New("invalid session")
+	}
+	sessionID, err := uuid.Parse(sid)
+	if err != nil {
+		return nil, err
+	}
+	jti, ok := m["jti"].(string)
+	if !ok || jti == "" {
+		return nil, errors.New("invalid token id")
+	}
+	exp, err := m.GetExpirationTime()
+	if err != nil || exp == nil {
+		return nil, errors.New("invalid expiry")
+	}
+	return &Claims{ID: jti, UserID: id, SessionID: sessionID, ExpiresAt: exp.Time}, nil
+}
+
+// keyFor picks the verification key for t. The algorithm must match the key
+// it names, so a public key can never be used as an HMAC secret.
+func (j *JWTManager) keyFor(t *jwt.Token) (interface{}, error) {
+	if _, ok := t.Method.(*jwt.SigningMethodHMAC); ok {
+		if j.secret == "" {
+			return nil, errors.New("invalid signing")
+		}
+		return []byte(j.secret), nil
+	}
+	kid, _ := t.Header["kid"].(string)
+	k, ok := j.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown key id %q", kid)
+	}
+	if t.Method.Alg() != k.Method.Alg() {
+		return nil, errors.New("invalid signing")
+	}
+	return k.Public, nil
+}
+
+// JWK is a public key in JSON Web Key format.
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	// RSA
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+	// Ed25519
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+}
+
+// JWKS returns the public half of every asymmetric key, for services that
+// verify our tokens. HMAC secrets are never published.
+func (j *JWTManager) JWKS() []JWK {
+	keys := make([]JWK, 0, len(j.keys))
+	for _, k := range j.keys {
+		jwk := JWK{Kid: k.ID, Use: "sig", Alg: k.Method.Alg()}
+		switch pub := k.Public.(type) {
+		case *rsa.PublicKey:
+			jwk.Kty = "RSA"
+			jwk.N = base64.RawURLEncoding.EncodeToString(pub.N.Bytes())
+			jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes())
+		case ed25519.PublicKey:
+			jwk.Kty = "OKP"
+			jwk.Crv = "Ed25519"
+			jwk.X = base64.RawURLEncoding.EncodeToString(pub)
+		}
+		keys = append(keys, jwk)
 	}
-	return id, nil
+	sort.Slice(keys, func(a, b int) bool { return keys[a].Kid < keys[b].Kid })
+	return keys
 }
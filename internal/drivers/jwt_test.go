@@ -0,0 +1,110 @@
+package drivers
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func writePEM(t *testing.T, name, typ string, der []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestJWTKeyRotation(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaDER, _ := x509.MarshalPKCS8PrivateKey(rsaKey)
+	edDER, _ := x509.MarshalPKCS8PrivateKey(edKey)
+	edPubDER, _ := x509.MarshalPKIXPublicKey(edKey.Public())
+
+	oldKey, err := LoadPEMKey("old", writePEM(t, "old.pem", "PRIVATE KEY", rsaDER))
+	if err != nil {
+		t.Fatal(err)
+	}
+	newKey, err := LoadPEMKey("new", writePEM(t, "new.pem", "PRIVATE KEY", edDER))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	before, err := NewJWTManagerFromKeys([]*JWTKey{oldKey}, "old", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	after, err := NewJWTManagerFromKeys([]*JWTKey{oldKey, newKey}, "new", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user := uuid.New()
+	oldToken, err := before.Generate(user, uuid.New(), time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newToken, err := after.Generate(user, uuid.New(), time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, tok := range map[string]string{"old": oldToken, "new": newToken} {
+		claims, err := after.Verify(tok)
+		if err != nil {
+			t.Fatalf("verify %s token after rotation: %v", name, err)
+		}
+		if claims.UserID != user {
+			t.Fatalf("%s token: subject %s, want %s", name, claims.UserID, user)
+		}
+	}
+	if _, err := before.Verify(newToken); err == nil {
+		t.Fatal("token signed with an unknown kid was accepted")
+	}
+
+	// a service holding only the public key can verify
+	pub, err := LoadPEMKey("new", writePEM(t, "new.pub.pem", "PUBLIC KEY", edPubDER))
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifier := &JWTManager{keys: map[string]*JWTKey{"new": pub}}
+	if _, err := verifier.Verify(newToken); err != nil {
+		t.Fatalf("verify with public key: %v", err)
+	}
+
+	jwks := after.JWKS()
+	if len(jwks) != 2 || jwks[0].Kid != "new" || jwks[0].Kty != "OKP" || jwks[1].Kid != "old" || jwks[1].Kty != "RSA" {
+		t.Fatalf("unexpected jwks: %+v", jwks)
+	}
+}
+
+func TestJWTRejectsHMACWithoutSecret(t *testing.T) {
+	hmacToken, _ := NewJWTManager("secret").Generate(uuid.New(), uuid.New(), time.Minute)
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	k, _ := NewJWTKey("k", edKey)
+	j, err := NewJWTManagerFromKeys([]*JWTKey{k}, "k", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := j.Verify(hmacToken); err == nil {
+		t.Fatal("HMAC token accepted without a legacy secret")
+	}
+	legacy, _ := NewJWTManagerFromKeys([]*JWTKey{k}, "k", "secret")
+	if _, err := legacy.Verify(hmacToken); err != nil {
+		t.Fatalf("legacy HMAC token: %v", err)
+	}
+}
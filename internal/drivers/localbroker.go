@@ -0,0 +1,219 @@
+package drivers
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"example.com/go-chat/internal/core"
+)
+
+// localQueue is how many messages a local subscription buffers. Like a redis
+// subscriber that falls behind, one whose buffer is full misses messages.
+const localQueue = 1024
+
+// LocalBroker is the core.Cluster of a single server instance: messages are
+// relayed between subscriptions of this process, and presence and revoked
+// tokens are kept in memory. It replaces Redis when only one instance runs.
+type LocalBroker struct {
+	mu       sync.RWMutex
+	subs     map[string]map[*localSubscription]bool
+	presence map[string]map[string]time.Time // user -> instance -> expiry, kept until swept
+	lastSeen map[string]time.Time
+	revoked  map[string]time.Time // "jti:" or "sid:" key -> expiry
+}
+
+func NewLocalBroker() *LocalBroker {
+	return &LocalBroker{
+		subs:     map[string]map[*localSubscription]bool{},
+		presence: map[string]map[string]time.Time{},
+		lastSeen: map[string]time.Time{},
+		revoked:  map[string]time.Time{},
+	}
+}
+
+func (b *LocalBroker) Publish(ctx context.Context, channel, payload string) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for s := range b.subs[channel] {
+		select {
+		case s.ch <- &core.BrokerMessage{Channel: channel, Payload: payload}:
+		default:
+			log.Println("local subscription full, dropping message on", channel)
+		}
+	}
+	return nil
+}
+
+func (b *LocalBroker) Subscribe(ctx context.Context, channels ...string) core.Subscription {
+	s := &localSubscription{b: b, ch: make(chan *core.BrokerMessage, localQueue), channels: map[string]bool{}}
+	_ = s.Subscribe(ctx, channels...)
+	return s
+}
+
+type localSubscription struct {
+	b        *LocalBroker
+	ch       chan *core.BrokerMessage
+	channels map[string]bool // guarded by b.mu
+	closed   bool
+}
+
+func (s *localSubscription) Subscribe(ctx context.Context, channels ...string) error {
+	s.b.mu.Lock()
+	defer s.b.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+	for _, ch := range channels {
+		if s.b.subs[ch] == nil {
+			s.b.subs[ch] = map[*localSubscription]bool{}
+		}
+		s.b.subs[ch][s] = true
+		s.channels[ch] = true
+	}
+	return nil
+}
+
+func (s *localSubscription) Unsubscribe(ctx context.Context, channels ...string) error {
+	s.b.mu.Lock()
+	defer s.b.mu.Unlock()
+	for _, ch := range channels {
+		s.b.remove(ch, s)
+	}
+	return nil
+}
+
+func (s *localSubscription) Channel() <-chan *core.BrokerMessage { return s.ch }
+
+func (s *localSubscription) Close() error {
+	s.b.mu.Lock()
+	defer s.b.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+	for ch := range s.channels {
+		s.b.remove(ch, s)
+	}
+	s.closed = true
+	// publishers hold the read lock while sending, so none is sending now
+	close(s.ch)
+	return nil
+}
+
+func (b *LocalBroker) remove(channel string, s *localSubscription) {
+	delete(s.channels, channel)
+	delete(b.subs[channel], s)
+	if len(b.subs[channel]) == 0 {
+		delete(b.subs, channel)
+	}
+}
+
+func (b *LocalBroker) SetPresence(ctx context.Context, userID, instance string, ttl time.Duration) (bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	wasOffline := !b.online(userID, now)
+	if wasOffline {
+		// whatever ran out is not swept anymore: the user is back
+		b.presence[userID] = map[string]time.Time{}
+	}
+	b.presence[userID][instance] = now.Add(ttl)
+	return wasOffline, nil
+}
+
+func (b *LocalBroker) RemovePresence(ctx context.Context, userID, instance string) (bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	delete(b.presence[userID], instance)
+	if b.online(userID, now) {
+		return false, nil
+	}
+	delete(b.presence, userID)
+	b.lastSeen[userID] = now
+	return true, nil
+}
+
+func (b *LocalBroker) GetPresence(ctx context.Context, userIDs []string) (online []bool, lastSeen []time.Time, err error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	now := time.Now()
+	online = make([]bool, len(userIDs))
+	lastSeen = make([]time.Time, len(userIDs))
+	for i, id := range userIDs {
+		online[i] = b.online(id, now)
+		if !online[i] {
+			lastSeen[i] = b.lastSeen[id]
+		}
+	}
+	return online, lastSeen, nil
+}
+
+func (b *LocalBroker) ExpirePresence(ctx context.Context, now time.Time) (userIDs []string, lastSeen []time.Time, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for id, entries := range b.presence {
+		if b.online(id, now) {
+			continue
+		}
+		var last time.Time
+		for _, expires := range entries {
+			if expires.After(last) {
+				last = expires
+			}
+		}
+		delete(b.presence, id)
+		b.lastSeen[id] = last
+		userIDs, lastSeen = append(userIDs, id), append(lastSeen, last)
+	}
+	return userIDs, lastSeen, nil
+}
+
+// online reports whether any of the user's entries is still running.
+func (b *LocalBroker) online(userID string, now time.Time) bool {
+	for _, expires := range b.presence[userID] {
+		if expires.After(now) {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *LocalBroker) RevokeToken(ctx context.Context, jti string, ttl time.Duration) error {
+	if ttl <= 0 {
+		return nil
+	}
+	b.revoke("jti:"+jti, ttl)
+	return nil
+}
+
+func (b *LocalBroker) RevokeSessionTokens(ctx context.Context, sessionID string, ttl time.Duration) error {
+	b.revoke("sid:"+sessionID, ttl)
+	return nil
+}
+
+// revoke denylists key for ttl, forgetting the entries that ran out.
+func (b *LocalBroker) revoke(key string, ttl time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	for k, expires := range b.revoked {
+		if !expires.After(now) {
+			delete(b.revoked, k)
+		}
+	}
+	b.revoked[key] = now.Add(ttl)
+}
+
+func (b *LocalBroker) IsRevoked(ctx context.Context, jti, sessionID string) (bool, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	now := time.Now()
+	for _, key := range []string{"jti:" + jti, "sid:" + sessionID} {
+		if expires, ok := b.revoked[key]; ok && expires.After(now) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
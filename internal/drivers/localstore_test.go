@@ -0,0 +1,65 @@
+package drivers
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"example.com/go-chat/internal/core"
+)
+
+// testAttachmentStore runs the behaviour every AttachmentStore shares.
+func testAttachmentStore(t *testing.T, store core.AttachmentStore) {
+	ctx := context.Background()
+	const key = "attachments/test"
+	body := []byte("hello")
+
+	if err := store.Put(ctx, key, bytes.NewReader(body), int64(len(body)), "text/plain"); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	rc, err := store.Get(ctx, key)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	got, err := io.ReadAll(rc)
+	rc.Close()
+	if err != nil || !bytes.Equal(got, body) {
+		t.Fatalf("Get: got %q, %v", got, err)
+	}
+	if err := store.Delete(ctx, key); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, err := store.Get(ctx, key); !errors.Is(err, core.ErrNotFound) {
+		t.Fatalf("Get after Delete: got %v, want ErrNotFound", err)
+	}
+	if err := store.Delete(ctx, key); err != nil {
+		t.Fatalf("Delete of a missing key: %v", err)
+	}
+}
+
+func TestLocalStore(t *testing.T) {
+	store, err := NewLocalStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	testAttachmentStore(t, store)
+}
+
+func TestLocalStoreRejectsEscapingKeys(t *testing.T) {
+	store, err := NewLocalStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	for _, key := range []string{"../outside", "/etc/passwd", "a/../../b", ""} {
+		if err := store.Put(ctx, key, strings.NewReader("x"), 1, "text/plain"); err == nil {
+			t.Errorf("Put(%q): want an error", key)
+		}
+		if _, err := store.Get(ctx, key); err == nil {
+			t.Errorf("Get(%q): want an error", key)
+		}
+	}
+}
@@ -0,0 +1,1199 @@
+package drivers
+
+import (
+	"bytes"
+	"context"
+	"html"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"example.com/go-chat/internal/core"
+	"github.com/google/uuid"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Memory implements every repository in memory, for tests and local
+// development. It behaves like the Postgres driver, which the conformance
+// tests check, but keeps nothing across restarts.
+type Memory struct {
+	mu           sync.RWMutex
+	users        map[uuid.UUID]core.User
+	groups       map[uuid.UUID]core.Group
+	members      map[memberKey]core.GroupMember
+	invites      map[string]core.GroupInvite
+	joinRequests map[memberKey]core.GroupJoinRequest
+	messages     map[uuid.UUID]core.Message
+	edits        map[uuid.UUID]core.MessageEdit
+	attachments  map[uuid.UUID]core.Attachment
+	reactions    map[core.Reaction]time.Time
+	receipts     map[memberKey]core.MessageReceipt
+	cursors      map[memberKey]core.ReadCursor
+	sessions     map[uuid.UUID]core.Session
+	tokens       map[string]core.RefreshToken
+}
+
+// memberKey keys the rows whose primary key is a pair of ids.
+type memberKey struct{ a, b uuid.UUID }
+
+func NewMemory() *Memory {
+	return &Memory{
+		users:        map[uuid.UUID]core.User{},
+		groups:       map[uuid.UUID]core.Group{},
+		members:      map[memberKey]core.GroupMember{},
+		invites:      map[string]core.GroupInvite{},
+		joinRequests: map[memberKey]core.GroupJoinRequest{},
+		messages:     map[uuid.UUID]core.Message{},
+		edits:        map[uuid.UUID]core.MessageEdit{},
+		attachments:  map[uuid.UUID]core.Attachment{},
+		reactions:    map[core.Reaction]time.Time{},
+		receipts:     map[memberKey]core.MessageReceipt{},
+		cursors:      map[memberKey]core.ReadCursor{},
+		sessions:     map[uuid.UUID]core.Session{},
+		tokens:       map[string]core.RefreshToken{},
+	}
+}
+
+func (m *Memory) UserRepo() core.UserRepository             { return m }
+func (m *Memory) GroupRepo() core.GroupRepository           { return m }
+func (m *Memory) MessageRepo() core.MessageRepository       { return m }
+func (m *Memory) AttachmentRepo() core.AttachmentRepository { return m }
+func (m *Memory) ReactionRepo() core.ReactionRepository     { return m }
+func (m *Memory) ReceiptRepo() core.ReceiptRepository       { return m }
+func (m *Memory) SessionRepo() core.SessionRepository       { return m }
+
+// CreateUser hashes with the minimum bcrypt cost: logins in tests would
+// otherwise dominate their run time.
+func (m *Memory) CreateUser(ctx context.Context, u *core.User, plainPassword string) error {
+	hash, err := bcrypt.GenerateFromPassword([]byte(plainPassword), bcrypt.MinCost)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, other := range m.users {
+		if other.Email == u.Email {
+			return core.ErrEmailTaken
+		}
+	}
+	u.ID = uuid.New()
+	u.PasswordHash = string(hash)
+	u.CreatedAt = time.Now()
+	m.users[u.ID] = *u
+	return nil
+}
+
+func (m *Memory) GetUserByEmail(ctx context.Context, email string) (*core.User, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for _, u := range m.users {
+		if u.Email == email {
+			return &u, nil
+		}
+	}
+	return nil, core.ErrNotFound
+}
+
+func (m *Memory) GetUserByID(ctx context.Context, id uuid.UUID) (*core.User, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	u, ok := m.users[id]
+	if !ok {
+		return nil, core.ErrNotFound
+	}
+	return &u, nil
+}
+
+func (m *Memory) VerifyPassword(ctx context.Context, email, plain string) (*core.User, error) {
+	u, err := m.GetUserByEmail(ctx, email)
+	if err != nil {
+		return nil, core.ErrInvalidCredentials
+	}
+	if bcrypt.CompareHashAndPassword([]byte(u.PasswordHash), []byte(plain)) != nil {
+		return nil, core.ErrInvalidCredentials
+	}
+	return u, nil
+}
+
+func (m *Memory) ListContacts(ctx context.Context, userId uuid.UUID) ([]uuid.UUID, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	seen := map[uuid.UUID]bool{}
+	var ids []uuid.UUID
+	add := func(id uuid.UUID) {
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	for k := range m.members {
+		if k.b != userId {
+			continue
+		}
+		for other := range m.members {
+			if other.a == k.a && other.b != userId {
+				add(other.b)
+			}
+		}
+	}
+	for _, msg := range m.messages {
+		switch {
+		case msg.SenderID == userId && msg.RecipientID != nil:
+			add(*msg.RecipientID)
+		case msg.RecipientID != nil && *msg.RecipientID == userId:
+			add(msg.SenderID)
+		}
+	}
+	return ids, nil
+}
+
+func (m *Memory) CreateGroup(ctx context.Context, g *core.Group) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	g.ID = uuid.New()
+	g.CreatedAt = time.Now()
+	row := *g
+	row.Owner = nil
+	m.groups[g.ID] = row
+	return nil
+}
+
+func (m *Memory) GetGroup(ctx context.Context, id uuid.UUID) (*core.Group, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	g, ok := m.groups[id]
+	if !ok {
+		return nil, core.ErrNotFound
+	}
+	return &g, nil
+}
+
+func (m *Memory) UpdateGroup(ctx context.Context, g *core.Group) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if row, ok := m.groups[g.ID]; ok {
+		row.Name, row.OwnerID, row.Visibility = g.Name, g.OwnerID, g.Visibility
+		m.groups[g.ID] = row
+	}
+	return nil
+}
+
+func (m *Memory) DeleteGroup(ctx context.Context, id uuid.UUID) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for msgID, msg := range m.messages {
+		if msg.GroupID != nil && *msg.GroupID == id {
+			m.dropMessageRows(msgID)
+			for k := range m.receipts {
+				if k.a == msgID {
+					delete(m.receipts, k)
+				}
+			}
+			delete(m.messages, msgID)
+		}
+	}
+	for k := range m.cursors {
+		if k.b == id {
+			delete(m.cursors, k)
+		}
+	}
+	for k := range m.members {
+		if k.a == id {
+			delete(m.members, k)
+		}
+	}
+	for token, inv := range m.invites {
+		if inv.GroupID == id {
+			delete(m.invites, token)
+		}
+	}
+	for k := range m.joinRequests {
+		if k.a == id {
+			delete(m.joinRequests, k)
+		}
+	}
+	delete(m.groups, id)
+	return nil
+}
+
+func (m *Memory) MyGroups(ctx context.Context, userId uuid.UUID) ([]core.Group, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var groups []core.Group
+	for k := range m.members {
+		if k.b != userId {
+			continue
+		}
+		g := m.groups[k.a]
+		if owner, ok := m.users[g.OwnerID]; ok {
+			g.Owner = &owner
+		}
+		groups = append(groups, g)
+	}
+	slices.SortFunc(groups, func(a, b core.Group) int { return a.CreatedAt.Compare(b.CreatedAt) })
+	return groups, nil
+}
+
+func (m *Memory) AddGroupMember(ctx context.Context, groupId, userId uuid.UUID, role core.GroupRole) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	k := memberKey{groupId, userId}
+	if _, ok := m.members[k]; !ok {
+		m.members[k] = core.GroupMember{GroupID: groupId, UserID: userId, Role: role, JoinedAt: time.Now()}
+	}
+	return nil
+}
+
+func (m *Memory) RemoveGroupMember(ctx context.Context, groupId, userId uuid.UUID) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.members, memberKey{groupId, userId})
+	return nil
+}
+
+func (m *Memory) GetMember(ctx context.Context, groupId, userId uuid.UUID) (*core.GroupMember, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	gm, ok := m.members[memberKey{groupId, userId}]
+	if !ok {
+		return nil, core.ErrNotFound
+	}
+	return &gm, nil
+}
+
+func (m *Memory) SetMemberRole(ctx context.Context, groupId, userId uuid.UUID, role core.GroupRole) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	k := memberKey{groupId, userId}
+	gm, ok := m.members[k]
+	if !ok {
+		return core.ErrNotFound
+	}
+	gm.Role = role
+	m.members[k] = gm
+	return nil
+}
+
+func (m *Memory) TransferOwnership(ctx context.Context, groupId, userId uuid.UUID) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	next, ok := m.members[memberKey{groupId, userId}]
+	if !ok {
+		return core.ErrNotFound
+	}
+	for k, gm := range m.members {
+		if k.a == groupId && gm.Role == core.RoleOwner {
+			gm.Role = core.RoleAdmin
+			m.members[k] = gm
+		}
+	}
+	next.Role = core.RoleOwner
+	m.members[memberKey{groupId, userId}] = next
+	if g, ok := m.groups[groupId]; ok {
+		g.OwnerID = userId
+		m.groups[groupId] = g
+	}
+	return nil
+}
+
+func (m *Memory) ListGroupMembers(ctx context.Context, groupId uuid.UUID) ([]core.GroupMember, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var members []core.GroupMember
+	for k, gm := range m.members {
+		if k.a != groupId {
+			continue
+		}
+		if u, ok := m.users[gm.UserID]; ok {
+			gm.User = &u
+		}
+		members = append(members, gm)
+	}
+	slices.SortFunc(members, func(a, b core.GroupMember) int {
+		if c := a.JoinedAt.Compare(b.JoinedAt); c != 0 {
+			return c
+		}
+		return bytes.Compare(a.UserID[:], b.UserID[:])
+	})
+	return members, nil
+}
+
+func (m *Memory) IsMember(ctx context.Context, groupId, userId uuid.UUID) (bool, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	_, ok := m.members[memberKey{groupId, userId}]
+	return ok, nil
+}
+
+func (m *Memory) CreateInvite(ctx context.Context, inv *core.GroupInvite) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	inv.CreatedAt = time.Now()
+	m.invites[inv.Token] = *inv
+	return nil
+}
+
+func (m *Memory) ListInvites(ctx context.Context, groupId uuid.UUID) ([]core.GroupInvite, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var invites []core.GroupInvite
+	for _, inv := range m.invites {
+		if inv.GroupID == groupId {
+			invites = append(invites, inv)
+		}
+	}
+	slices.SortFunc(invites, func(a, b core.GroupInvite) int { return b.CreatedAt.Compare(a.CreatedAt) })
+	return invites, nil
+}
+
+func (m *Memory) DeleteInvite(ctx context.Context, groupId uuid.UUID, token string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	inv, ok := m.invites[token]
+	if !ok || inv.GroupID != groupId {
+		return core.ErrInvalidInvite
+	}
+	delete(m.invites, token)
+	return nil
+}
+
+func (m *Memory) GetInvite(ctx context.Context, token string) (*core.GroupInvite, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	inv, ok := m.invites[token]
+	if !ok {
+		return nil, core.ErrInvalidInvite
+	}
+	return &inv, nil
+}
+
+func (m *Memory) UseInvite(ctx context.Context, token string, now time.Time) (*core.GroupInvite, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	inv, ok := m.invites[token]
+	if !ok || (inv.MaxUses != 0 && inv.Uses >= inv.MaxUses) || (inv.ExpiresAt != nil && !inv.ExpiresAt.After(now)) {
+		return nil, core.ErrInvalidInvite
+	}
+	inv.Uses++
+	m.invites[token] = inv
+	return &inv, nil
+}
+
+func (m *Memory) SaveJoinRequest(ctx context.Context, r *core.GroupJoinRequest) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	r.CreatedAt = time.Now()
+	row := *r
+	row.User = nil
+	m.joinRequests[memberKey{r.GroupID, r.UserID}] = row
+	return nil
+}
+
+func (m *Memory) ListJoinRequests(ctx context.Context, groupId uuid.UUID, status core.JoinRequestStatus) ([]core.GroupJoinRequest, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var reqs []core.GroupJoinRequest
+	for k, r := range m.joinRequests {
+		if k.a != groupId || r.Status != status {
+			continue
+		}
+		if u, ok := m.users[r.UserID]; ok {
+			r.User = &u
+		}
+		reqs = append(reqs, r)
+	}
+	slices.SortFunc(reqs, func(a, b core.GroupJoinRequest) int { return a.CreatedAt.Compare(b.CreatedAt) })
+	return reqs, nil
+}
+
+func (m *Memory) DecideJoinRequest(ctx context.Context, groupId, userId, decidedBy uuid.UUID, status core.JoinRequestStatus) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	k := memberKey{groupId, userId}
+	r, ok := m.joinRequests[k]
+	if !ok || r.Status != core.JoinRequestPending {
+		return core.ErrNoJoinRequest
+	}
+	now := time.Now()
+	r.Status, r.DecidedBy, r.DecidedAt = status, &decidedBy, &now
+	m.joinRequests[k] = r
+	return nil
+}
+
+func (m *Memory) SaveMessage(ctx context.Context, msg *core.Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, att := range msg.Attachments {
+		row, ok := m.attachments[att.ID]
+		if !ok || row.UploaderID != msg.SenderID || row.MessageID != nil {
+			return core.ErrInvalidAttachment
+		}
+	}
+	msg.ID = uuid.New()
+	msg.CreatedAt = time.Now().Truncate(time.Microsecond)
+	for i := range msg.Attachments {
+		msg.Attachments[i].MessageID = &msg.ID
+		row := m.attachments[msg.Attachments[i].ID]
+		row.MessageID = &msg.ID
+		m.attachments[row.ID] = row
+	}
+	m.messages[msg.ID] = messageRow(*msg)
+	if msg.ThreadRootID != nil {
+		if root, ok := m.messages[*msg.ThreadRootID]; ok {
+			root.ReplyCount++
+			m.messages[root.ID] = root
+		}
+	}
+	return nil
+}
+
+// messageRow strips what isn't stored in the messages table.
+func messageRow(msg core.Message) core.Message {
+	msg.Reactions, msg.Attachments = nil, nil
+	msg.Sender, msg.Recipient, msg.Group, msg.ReplyTo = nil, nil, nil, nil
+	return msg
+}
+
+func (m *Memory) GetMessage(ctx context.Context, id uuid.UUID) (*core.Message, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	msg, ok := m.messages[id]
+	if !ok {
+		return nil, core.ErrNotFound
+	}
+	return &msg, nil
+}
+
+func (m *Memory) EditMessage(ctx context.Context, msg *core.Message, content string, at time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	cur, ok := m.messages[msg.ID]
+	if !ok {
+		return core.ErrNotFound
+	}
+	if cur.DeletedAt != nil {
+		return core.ErrMessageDeleted
+	}
+	edit := core.MessageEdit{ID: uuid.New(), MessageID: msg.ID, Content: cur.Content, EditedAt: at}
+	m.edits[edit.ID] = edit
+	cur.Content, cur.EditedAt = content, &at
+	m.messages[msg.ID] = cur
+	msg.Content, msg.EditedAt = content, &at
+	return nil
+}
+
+func (m *Memory) DeleteMessage(ctx context.Context, msg *core.Message, by uuid.UUID, at time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	cur, ok := m.messages[msg.ID]
+	if !ok || cur.DeletedAt != nil {
+		return core.ErrMessageDeleted
+	}
+	cur.Content, cur.DeletedAt, cur.DeletedBy = "", &at, &by
+	m.messages[msg.ID] = cur
+	m.dropMessageRows(msg.ID)
+	if cur.ThreadRootID != nil {
+		if root, ok := m.messages[*cur.ThreadRootID]; ok {
+			root.ReplyCount--
+			m.messages[root.ID] = root
+		}
+	}
+	msg.Content, msg.DeletedAt, msg.DeletedBy, msg.Attachments = "", &at, &by, nil
+	return nil
+}
+
+// dropMessageRows deletes the edits, attachments and reactions of a message.
+func (m *Memory) dropMessageRows(id uuid.UUID) {
+	for editID, e := range m.edits {
+		if e.MessageID == id {
+			delete(m.edits, editID)
+		}
+	}
+	for attID, att := range m.attachments {
+		if att.MessageID != nil && *att.MessageID == id {
+			delete(m.attachments, attID)
+		}
+	}
+	for r := range m.reactions {
+		if r.MessageID == id {
+			delete(m.reactions, r)
+		}
+	}
+}
+
+func (m *Memory) ListEdits(ctx context.Context, messageId uuid.UUID) ([]core.MessageEdit, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var edits []core.MessageEdit
+	for _, e := range m.edits {
+		if e.MessageID == messageId {
+			edits = append(edits, e)
+		}
+	}
+	slices.SortFunc(edits, func(a, b core.MessageEdit) int {
+		if c := a.EditedAt.Compare(b.EditedAt); c != 0 {
+			return c
+		}
+		return bytes.Compare(a.ID[:], b.ID[:])
+	})
+	return edits, nil
+}
+
+func (m *Memory) GetPrivateHistory(ctx context.Context, a, b uuid.UUID, q core.HistoryQuery) ([]core.Message, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.findPage(func(msg *core.Message) bool { return isPrivateBetween(msg, a, b) }, q), nil
+}
+
+func (m *Memory) GetGroupHistory(ctx context.Context, groupID uuid.UUID, q core.HistoryQuery) ([]core.Message, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.findPage(func(msg *core.Message) bool { return msg.GroupID != nil && *msg.GroupID == groupID }, q), nil
+}
+
+func (m *Memory) GetThread(ctx context.Context, rootId uuid.UUID, q core.HistoryQuery) ([]core.Message, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.findPage(func(msg *core.Message) bool { return msg.ThreadRootID != nil && *msg.ThreadRootID == rootId }, q), nil
+}
+
+func isPrivateBetween(msg *core.Message, a, b uuid.UUID) bool {
+	if msg.RecipientID == nil {
+		return false
+	}
+	return (msg.SenderID == a && *msg.RecipientID == b) || (msg.SenderID == b && *msg.RecipientID == a)
+}
+
+// findPage is the keyset page of findPage in the Postgres driver, with the
+// quoted messages and attachments loaded.
+func (m *Memory) findPage(match func(*core.Message) bool, q core.HistoryQuery) []core.Message {
+	msgs := m.keysetPage(match, q.Before, q.After, q.Limit)
+	for i := range msgs {
+		m.preload(&msgs[i])
+	}
+	return msgs
+}
+
+// keysetPage returns the matching messages before or after a cursor, newest
+// first, at most limit of them.
+func (m *Memory) keysetPage(match func(*core.Message) bool, before, after *core.Cursor, limit int) []core.Message {
+	var msgs []core.Message
+	for _, msg := range m.messages {
+		switch {
+		case !match(&msg):
+		case before != nil && !cursorBefore(msg.CreatedAt, msg.ID, before.CreatedAt, before.ID):
+		case after != nil && !cursorBefore(after.CreatedAt, after.ID, msg.CreatedAt, msg.ID):
+		default:
+			msgs = append(msgs, msg)
+		}
+	}
+	slices.SortFunc(msgs, newestFirst)
+	if after != nil {
+		// the page is the oldest messages past the cursor
+		msgs = msgs[max(0, len(msgs)-limit):]
+	} else if len(msgs) > limit {
+		msgs = msgs[:limit]
+	}
+	return msgs
+}
+
+func newestFirst(a, b core.Message) int {
+	if cursorBefore(a.CreatedAt, a.ID, b.CreatedAt, b.ID) {
+		return 1
+	}
+	if cursorBefore(b.CreatedAt, b.ID, a.CreatedAt, a.ID) {
+		return -1
+	}
+	return 0
+}
+
+func (m *Memory) preload(msg *core.Message) {
+	if msg.ReplyToID != nil {
+		if quoted, ok := m.messages[*msg.ReplyToID]; ok {
+			msg.ReplyTo = &quoted
+		}
+	}
+	msg.Attachments = m.messageAttachments(msg.ID)
+}
+
+func (m *Memory) ListConversations(ctx context.Context, userId uuid.UUID) ([]core.Conversation, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	type conv struct {
+		core.Conversation
+		id uuid.UUID
+	}
+	var convs []conv
+	// unread counts the messages of others past the user's read cursor
+	unread := func(conversation uuid.UUID, match func(*core.Message) bool) int {
+		cur, hasCursor := m.cursors[memberKey{userId, conversation}]
+		n := 0
+		for _, msg := range m.messages {
+			if match(&msg) && msg.SenderID != userId && msg.DeletedAt == nil &&
+				(!hasCursor || cursorBefore(cur.MessageCreatedAt, cur.MessageID, msg.CreatedAt, msg.ID)) {
+				n++
+			}
+		}
+		return n
+	}
+	last := func(match func(*core.Message) bool) *core.Message {
+		var newest *core.Message
+		for _, msg := range m.messages {
+			if match(&msg) && (newest == nil || newestFirst(msg, *newest) < 0) {
+				msg := msg
+				newest = &msg
+			}
+		}
+		return newest
+	}
+
+	for k, gm := range m.members {
+		if k.b != userId {
+			continue
+		}
+		inGroup := func(msg *core.Message) bool { return msg.GroupID != nil && *msg.GroupID == gm.GroupID }
+		g := m.groups[gm.GroupID]
+		c := conv{id: gm.GroupID}
+		c.Group = &g
+		c.LastMessage = last(inGroup)
+		c.LastActivity = gm.JoinedAt
+		if c.LastMessage != nil {
+			c.LastActivity = c.LastMessage.CreatedAt
+		}
+		c.UnreadCount = unread(gm.GroupID, inGroup)
+		convs = append(convs, c)
+	}
+	peers := map[uuid.UUID]bool{}
+	for _, msg := range m.messages {
+		switch {
+		case msg.SenderID == userId && msg.RecipientID != nil:
+			peers[*msg.RecipientID] = true
+		case msg.RecipientID != nil && *msg.RecipientID == userId:
+			peers[msg.SenderID] = true
+		}
+	}
+	for peer := range peers {
+		between := func(msg *core.Message) bool { return isPrivateBetween(msg, userId, peer) }
+		c := conv{id: peer}
+		if u, ok := m.users[peer]; ok {
+			c.Peer = &u
+		}
+		c.LastMessage = last(between)
+		c.LastActivity = c.LastMessage.CreatedAt
+		c.UnreadCount = unread(peer, func(msg *core.Message) bool { return msg.SenderID == peer && between(msg) })
+		convs = append(convs, c)
+	}
+
+	slices.SortFunc(convs, func(a, b conv) int {
+		if c := b.LastActivity.Compare(a.LastActivity); c != 0 {
+			return c
+		}
+		return bytes.Compare(a.id[:], b.id[:])
+	})
+	out := make([]core.Conversation, len(convs))
+	for i, c := range convs {
+		out[i] = c.Conversation
+	}
+	return out, nil
+}
+
+// SearchMessages approximates Postgres' websearch_to_tsquery with the simple
+// configuration: words match case-insensitively, "quoted phrases" match
+// consecutive words, a leading - excludes a word and "or" separates
+// alternatives.
+func (m *Memory) SearchMessages(ctx context.Context, userId uuid.UUID, q core.SearchQuery) ([]core.SearchHit, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	query := parseWebSearch(q.Text)
+	visible := func(msg *core.Message) bool {
+		if msg.GroupID != nil {
+			_, ok := m.members[memberKey{*msg.GroupID, userId}]
+			return ok
+		}
+		return msg.SenderID == userId || (msg.RecipientID != nil && *msg.RecipientID == userId)
+	}
+	match := func(msg *core.Message) bool {
+		switch {
+		case msg.DeletedAt != nil || !visible(msg):
+		case q.SenderID != nil && msg.SenderID != *q.SenderID:
+		case q.GroupID != nil && (msg.GroupID == nil || *msg.GroupID != *q.GroupID):
+		case q.Since != nil && msg.CreatedAt.Before(*q.Since):
+		case q.Until != nil && !msg.CreatedAt.Before(*q.Until):
+		default:
+			return query.matches(searchWords(msg.Content))
+		}
+		return false
+	}
+	msgs := m.findPage(match, q.HistoryQuery)
+	if len(msgs) == 0 {
+		return nil, nil
+	}
+	hits := make([]core.SearchHit, len(msgs))
+	for i, msg := range msgs {
+		hits[i] = core.SearchHit{Message: msg, Snippet: query.highlight(msg.Content)}
+	}
+	return hits, nil
+}
+
+// webSearch is a parsed search: any of its alternatives matches.
+type webSearch [][]searchTerm
+
+type searchTerm struct {
+	words  []string // one word, or the words of a phrase
+	negate bool
+}
+
+func parseWebSearch(text string) webSearch {
+	var (
+		q   webSearch
+		alt []searchTerm
+	)
+	for len(text) > 0 {
+		text = strings.TrimLeftFunc(text, unicode.IsSpace)
+		if text == "" {
+			break
+		}
+		negate := false
+		if text[0] == '-' {
+			negate, text = true, text[1:]
+		}
+		var raw string
+		if strings.HasPrefix(text, `"`) {
+			end := strings.IndexByte(text[1:], '"')
+			if end < 0 {
+				raw, text = text[1:], ""
+			} else {
+				raw, text = text[1:end+1], text[end+2:]
+			}
+		} else {
+			end := strings.IndexFunc(text, unicode.IsSpace)
+			if end < 0 {
+				end = len(text)
+			}
+			raw, text = text[:end], text[end:]
+			if !negate && strings.EqualFold(raw, "or") {
+				if len(alt) > 0 {
+					q, alt = append(q, alt), nil
+				}
+				continue
+			}
+		}
+		if words := searchWords(raw); len(words) > 0 {
+			alt = append(alt, searchTerm{words: words, negate: negate})
+		}
+	}
+	if len(alt) > 0 {
+		q = append(q, alt)
+	}
+	return q
+}
+
+// searchWords splits text into lower case words like the simple configuration.
+func searchWords(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+func (q webSearch) matches(words []string) bool {
+	for _, alt := range q {
+		all := true
+		for _, t := range alt {
+			if t.in(words) == t.negate {
+				all = false
+				break
+			}
+		}
+		if all && len(alt) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (t searchTerm) in(words []string) bool {
+	for i := 0; i+len(t.words) <= len(words); i++ {
+		if slices.Equal(words[i:i+len(t.words)], t.words) {
+			return true
+		}
+	}
+	return false
+}
+
+// highlight escapes content and wraps every searched word in <mark> tags.
+func (q webSearch) highlight(content string) string {
+	marked := map[string]bool{}
+	for _, alt := range q {
+		for _, t := range alt {
+			if !t.negate {
+				for _, w := range t.words {
+					marked[w] = true
+				}
+			}
+		}
+	}
+	var b strings.Builder
+	word := func(r rune) bool { return unicode.IsLetter(r) || unicode.IsDigit(r) }
+	for len(content) > 0 {
+		end := strings.IndexFunc(content, func(r rune) bool { return !word(r) })
+		if end == 0 {
+			end = strings.IndexFunc(content, word)
+			if end < 0 {
+				end = len(content)
+			}
+			b.WriteString(html.EscapeString(content[:end]))
+		} else {
+			if end < 0 {
+				end = len(content)
+			}
+			if marked[strings.ToLower(content[:end])] {
+				b.WriteString("<mark>" + content[:end] + "</mark>")
+			} else {
+				b.WriteString(content[:end])
+			}
+		}
+		content = content[end:]
+	}
+	return b.String()
+}
+
+func (m *Memory) CreateAttachment(ctx context.Context, a *core.Attachment) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	a.CreatedAt = time.Now()
+	m.attachments[a.ID] = *a
+	return nil
+}
+
+func (m *Memory) GetAttachment(ctx context.Context, id uuid.UUID) (*core.Attachment, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	a, ok := m.attachments[id]
+	if !ok {
+		return nil, core.ErrNotFound
+	}
+	return &a, nil
+}
+
+func (m *Memory) ListAttachments(ctx context.Context, ids []uuid.UUID) ([]core.Attachment, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var atts []core.Attachment
+	for _, a := range m.attachments {
+		if slices.Contains(ids, a.ID) {
+			atts = append(atts, a)
+		}
+	}
+	slices.SortFunc(atts, oldestAttachmentFirst)
+	return atts, nil
+}
+
+func (m *Memory) MessageAttachments(ctx context.Context, messageId uuid.UUID) ([]core.Attachment, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.messageAttachments(messageId), nil
+}
+
+func (m *Memory) GroupAttachments(ctx context.Context, groupId uuid.UUID) ([]core.Attachment, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var atts []core.Attachment
+	for _, a := range m.attachments {
+		if a.MessageID == nil {
+			continue
+		}
+		if msg := m.messages[*a.MessageID]; msg.GroupID != nil && *msg.GroupID == groupId {
+			atts = append(atts, a)
+		}
+	}
+	slices.SortFunc(atts, oldestAttachmentFirst)
+	return atts, nil
+}
+
+func (m *Memory) messageAttachments(messageId uuid.UUID) []core.Attachment {
+	var atts []core.Attachment
+	for _, a := range m.attachments {
+		if a.MessageID != nil && *a.MessageID == messageId {
+			atts = append(atts, a)
+		}
+	}
+	slices.SortFunc(atts, oldestAttachmentFirst)
+	return atts
+}
+
+func oldestAttachmentFirst(a, b core.Attachment) int {
+	if c := a.CreatedAt.Compare(b.CreatedAt); c != 0 {
+		return c
+	}
+	return bytes.Compare(a.ID[:], b.ID[:])
+}
+
+func (m *Memory) SetAttachmentPreview(ctx context.Context, id uuid.UUID, width, height int, thumbnail bool) (*core.Attachment, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	a, ok := m.attachments[id]
+	if !ok {
+		return nil, core.ErrNotFound
+	}
+	a.Width, a.Height, a.Thumbnail = width, height, thumbnail
+	m.attachments[id] = a
+	return &a, nil
+}
+
+func (m *Memory) AddReaction(ctx context.Context, r *core.Reaction) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	r.CreatedAt = time.Now()
+	key := core.Reaction{MessageID: r.MessageID, UserID: r.UserID, Emoji: r.Emoji}
+	if _, ok := m.reactions[key]; ok {
+		return false, nil
+	}
+	m.reactions[key] = r.CreatedAt
+	return true, nil
+}
+
+func (m *Memory) RemoveReaction(ctx context.Context, messageId, userId uuid.UUID, emoji string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := core.Reaction{MessageID: messageId, UserID: userId, Emoji: emoji}
+	if _, ok := m.reactions[key]; !ok {
+		return false, nil
+	}
+	delete(m.reactions, key)
+	return true, nil
+}
+
+func (m *Memory) CountReactions(ctx context.Context, messageIds []uuid.UUID, viewer uuid.UUID) (map[uuid.UUID][]core.ReactionCount, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	type group struct {
+		core.ReactionCount
+		first time.Time
+	}
+	byMessage := map[uuid.UUID]map[string]*group{}
+	for r, at := range m.reactions {
+		if !slices.Contains(messageIds, r.MessageID) {
+			continue
+		}
+		if byMessage[r.MessageID] == nil {
+			byMessage[r.MessageID] = map[string]*group{}
+		}
+		g := byMessage[r.MessageID][r.Emoji]
+		if g == nil {
+			g = &group{ReactionCount: core.ReactionCount{Emoji: r.Emoji}, first: at}
+			byMessage[r.MessageID][r.Emoji] = g
+		}
+		g.Count++
+		g.Me = g.Me || r.UserID == viewer
+		if at.Before(g.first) {
+			g.first = at
+		}
+	}
+	counts := make(map[uuid.UUID][]core.ReactionCount)
+	for id, emoji := range byMessage {
+		groups := make([]*group, 0, len(emoji))
+		for _, g := range emoji {
+			groups = append(groups, g)
+		}
+		slices.SortFunc(groups, func(a, b *group) int {
+			if a.Count != b.Count {
+				return b.Count - a.Count
+			}
+			if c := a.first.Compare(b.first); c != 0 {
+				return c
+			}
+			return strings.Compare(a.Emoji, b.Emoji)
+		})
+		for _, g := range groups {
+			counts[id] = append(counts[id], g.ReactionCount)
+		}
+	}
+	return counts, nil
+}
+
+func (m *Memory) MarkDelivered(ctx context.Context, messageId, userId uuid.UUID, at time.Time) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	k := memberKey{messageId, userId}
+	if _, ok := m.receipts[k]; ok {
+		return false, nil
+	}
+	m.receipts[k] = core.MessageReceipt{MessageID: messageId, UserID: userId, DeliveredAt: &at}
+	return true, nil
+}
+
+func (m *Memory) MarkRead(ctx context.Context, userId uuid.UUID, msg *core.Message, at time.Time, limit int) ([]core.Message, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	conv := core.ConversationOf(msg, userId)
+	k := memberKey{userId, conv}
+	cur, found := m.cursors[k]
+	if found && !cursorBefore(cur.MessageCreatedAt, cur.MessageID, msg.CreatedAt, msg.ID) {
+		return nil, nil
+	}
+	m.cursors[k] = core.ReadCursor{UserID: userId, ConversationID: conv, MessageID: msg.ID, MessageCreatedAt: msg.CreatedAt, UpdatedAt: at}
+
+	msgs := m.keysetPage(func(other *core.Message) bool {
+		return sameConversation(other, msg) && other.SenderID != userId &&
+			!cursorBefore(msg.CreatedAt, msg.ID, other.CreatedAt, other.ID) &&
+			(!found || cursorBefore(cur.MessageCreatedAt, cur.MessageID, other.CreatedAt, other.ID))
+	}, nil, nil, limit)
+	for _, read := range msgs {
+		rk := memberKey{read.ID, userId}
+		r, ok := m.receipts[rk]
+		if ok && r.ReadAt != nil {
+			continue
+		}
+		if !ok {
+			r = core.MessageReceipt{MessageID: read.ID, UserID: userId}
+		}
+		if r.DeliveredAt == nil {
+			r.DeliveredAt = &at
+		}
+		r.ReadAt = &at
+		m.receipts[rk] = r
+	}
+	return msgs, nil
+}
+
+// sameConversation reports whether a is in the conversation of b.
+func sameConversation(a, b *core.Message) bool {
+	if b.GroupID != nil {
+		return a.GroupID != nil && *a.GroupID == *b.GroupID
+	}
+	return isPrivateBetween(a, b.SenderID, *b.RecipientID)
+}
+
+func (m *Memory) ListReceipts(ctx context.Context, messageId uuid.UUID) ([]core.MessageReceipt, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var receipts []core.MessageReceipt
+	for k, r := range m.receipts {
+		if k.a != messageId {
+			continue
+		}
+		if u, ok := m.users[r.UserID]; ok {
+			r.User = &u
+		}
+		receipts = append(receipts, r)
+	}
+	slices.SortFunc(receipts, func(a, b core.MessageReceipt) int {
+		if c := compareNullsLast(a.ReadAt, b.ReadAt); c != 0 {
+			return c
+		}
+		if c := compareNullsLast(a.DeliveredAt, b.DeliveredAt); c != 0 {
+			return c
+		}
+		return bytes.Compare(a.UserID[:], b.UserID[:])
+	})
+	return receipts, nil
+}
+
+// compareNullsLast orders times ascending with nil last, like Postgres does.
+func compareNullsLast(a, b *time.Time) int {
+	switch {
+	case a == nil && b == nil:
+		return 0
+	case a == nil:
+		return 1
+	case b == nil:
+		return -1
+	}
+	return a.Compare(*b)
+}
+
+func (m *Memory) CountReceipts(ctx context.Context, messageIds []uuid.UUID) (map[uuid.UUID]core.ReceiptCounts, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	counts := make(map[uuid.UUID]core.ReceiptCounts)
+	for k, r := range m.receipts {
+		if !slices.Contains(messageIds, k.a) {
+			continue
+		}
+		c := counts[k.a]
+		if r.DeliveredAt != nil {
+			c.Delivered++
+		}
+		if r.ReadAt != nil {
+			c.Read++
+		}
+		counts[k.a] = c
+	}
+	return counts, nil
+}
+
+func (m *Memory) CreateSession(ctx context.Context, s *core.Session) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sessions[s.ID] = *s
+	return nil
+}
+
+func (m *Memory) GetSession(ctx context.Context, id uuid.UUID) (*core.Session, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	s, ok := m.sessions[id]
+	if !ok {
+		return nil, core.ErrNotFound
+	}
+	return &s, nil
+}
+
+func (m *Memory) ListSessions(ctx context.Context, userId uuid.UUID, now time.Time) ([]core.Session, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var sessions []core.Session
+	for _, s := range m.sessions {
+		if s.UserID == userId && s.RevokedAt == nil && s.ExpiresAt.After(now) {
+			sessions = append(sessions, s)
+		}
+	}
+	slices.SortFunc(sessions, func(a, b core.Session) int { return b.LastUsedAt.Compare(a.LastUsedAt) })
+	return sessions, nil
+}
+
+func (m *Memory) TouchSession(ctx context.Context, id uuid.UUID, lastUsed, expires time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if s, ok := m.sessions[id]; ok {
+		s.LastUsedAt, s.ExpiresAt = lastUsed, expires
+		m.sessions[id] = s
+	}
+	return nil
+}
+
+func (m *Memory) RevokeSession(ctx context.Context, id uuid.UUID, now time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.sessions[id]
+	if !ok || s.RevokedAt != nil {
+		return core.ErrNotFound
+	}
+	s.RevokedAt = &now
+	m.sessions[id] = s
+	return nil
+}
+
+func (m *Memory) SaveRefreshToken(ctx context.Context, t *core.RefreshToken) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.tokens[t.Hash] = *t
+	return nil
+}
+
+func (m *Memory) ConsumeRefreshToken(ctx context.Context, hash string, now time.Time) (*core.RefreshToken, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t, ok := m.tokens[hash]
+	if !ok {
+		return nil, core.ErrInvalidRefreshToken
+	}
+	if t.UsedAt != nil {
+		return &t, core.ErrRefreshTokenReused
+	}
+	t.UsedAt = &now
+	m.tokens[hash] = t
+	return &t, nil
+}
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS attachments, reactions, message_edits, read_cursors, message_receipts,
+    refresh_tokens, sessions, group_join_requests, group_invites, group_members, messages, groups, users;
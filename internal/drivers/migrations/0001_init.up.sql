@@ -0,0 +1,203 @@
+-- The schema as GORM's AutoMigrate left it, plus the foreign keys it missed.
+-- Every statement is guarded so a database created by AutoMigrate is adopted
+-- as version 1 and ends up with the same schema as a fresh one.
+
+CREATE TABLE IF NOT EXISTS users (
+    id            uuid PRIMARY KEY DEFAULT gen_random_uuid(),
+    username      varchar(100) NOT NULL,
+    email         varchar(255) NOT NULL,
+    password_hash varchar(255) NOT NULL,
+    created_at    timestamptz
+);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_users_email ON users (email);
+
+CREATE TABLE IF NOT EXISTS groups (
+    id         uuid PRIMARY KEY DEFAULT gen_random_uuid(),
+    name       varchar(100) NOT NULL,
+    owner_id   uuid NOT NULL,
+    visibility varchar(20) NOT NULL DEFAULT 'public',
+    created_at timestamptz,
+    CONSTRAINT fk_groups_owner FOREIGN KEY (owner_id) REFERENCES users (id)
+);
+
+CREATE TABLE IF NOT EXISTS messages (
+    id             uuid PRIMARY KEY DEFAULT gen_random_uuid(),
+    sender_id      uuid NOT NULL,
+    recipient_id   uuid,
+    group_id       uuid,
+    content        text NOT NULL,
+    created_at     timestamptz,
+    edited_at      timestamptz,
+    deleted_at     timestamptz,
+    deleted_by     uuid,
+    reply_to_id    uuid,
+    thread_root_id uuid,
+    reply_count    bigint NOT NULL DEFAULT 0,
+    CONSTRAINT fk_messages_sender FOREIGN KEY (sender_id) REFERENCES users (id),
+    CONSTRAINT fk_messages_recipient FOREIGN KEY (recipient_id) REFERENCES users (id),
+    CONSTRAINT fk_messages_group FOREIGN KEY (group_id) REFERENCES groups (id),
+    CONSTRAINT fk_messages_reply_to FOREIGN KEY (reply_to_id) REFERENCES messages (id)
+);
+CREATE INDEX IF NOT EXISTS idx_messages_private ON messages (recipient_id, sender_id, created_at);
+-- the inbox and contacts look up what a user sent, which the index above cannot serve
+CREATE INDEX IF NOT EXISTS idx_messages_sender ON messages (sender_id, recipient_id, created_at);
+CREATE INDEX IF NOT EXISTS idx_messages_group ON messages (group_id, created_at);
+CREATE INDEX IF NOT EXISTS idx_messages_thread ON messages (thread_root_id, created_at);
+-- 'simple' doesn't stem, which suits any language
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS search tsvector
+    GENERATED ALWAYS AS (to_tsvector('simple', content)) STORED;
+CREATE INDEX IF NOT EXISTS idx_messages_search ON messages USING GIN (search);
+
+CREATE TABLE IF NOT EXISTS group_members (
+    group_id  uuid,
+    user_id   uuid,
+    role      varchar(20) NOT NULL DEFAULT 'member',
+    joined_at timestamptz,
+    PRIMARY KEY (group_id, user_id),
+    CONSTRAINT fk_group_members_group FOREIGN KEY (group_id) REFERENCES groups (id),
+    CONSTRAINT fk_group_members_user FOREIGN KEY (user_id) REFERENCES users (id)
+);
+
+CREATE TABLE IF NOT EXISTS group_invites (
+    token      varchar(64) PRIMARY KEY,
+    group_id   uuid NOT NULL,
+    created_by uuid NOT NULL,
+    max_uses   bigint NOT NULL DEFAULT 0,
+    uses       bigint NOT NULL DEFAULT 0,
+    expires_at timestamptz,
+    created_at timestamptz
+);
+CREATE INDEX IF NOT EXISTS idx_group_invites_group_id ON group_invites (group_id);
+
+CREATE TABLE IF NOT EXISTS group_join_requests (
+    group_id   uuid,
+    user_id    uuid,
+    status     varchar(20) NOT NULL,
+    decided_by uuid,
+    decided_at timestamptz,
+    created_at timestamptz,
+    PRIMARY KEY (group_id, user_id),
+    CONSTRAINT fk_group_join_requests_user FOREIGN KEY (user_id) REFERENCES users (id)
+);
+CREATE INDEX IF NOT EXISTS idx_group_join_requests_status ON group_join_requests (status);
+
+CREATE TABLE IF NOT EXISTS sessions (
+    id           uuid PRIMARY KEY,
+    user_id      uuid NOT NULL,
+    user_agent   varchar(255),
+    ip           varchar(64),
+    created_at   timestamptz,
+    last_used_at timestamptz,
+    expires_at   timestamptz,
+    revoked_at   timestamptz
+);
+CREATE INDEX IF NOT EXISTS idx_sessions_user_id ON sessions (user_id);
+
+CREATE TABLE IF NOT EXISTS refresh_tokens (
+    hash       char(64) PRIMARY KEY,
+    session_id uuid NOT NULL,
+    expires_at timestamptz NOT NULL,
+    used_at    timestamptz,
+    created_at timestamptz
+);
+CREATE INDEX IF NOT EXISTS idx_refresh_tokens_session_id ON refresh_tokens (session_id);
+
+CREATE TABLE IF NOT EXISTS message_receipts (
+    message_id   uuid,
+    user_id      uuid,
+    delivered_at timestamptz,
+    read_at      timestamptz,
+    PRIMARY KEY (message_id, user_id),
+    CONSTRAINT fk_message_receipts_user FOREIGN KEY (user_id) REFERENCES users (id)
+);
+
+CREATE TABLE IF NOT EXISTS read_cursors (
+    user_id            uuid,
+    conversation_id    uuid,
+    message_id         uuid NOT NULL,
+    message_created_at timestamptz NOT NULL,
+    updated_at         timestamptz,
+    PRIMARY KEY (user_id, conversation_id)
+);
+
+CREATE TABLE IF NOT EXISTS message_edits (
+    id         uuid PRIMARY KEY DEFAULT gen_random_uuid(),
+    message_id uuid NOT NULL,
+    content    text NOT NULL,
+    edited_at  timestamptz
+);
+CREATE INDEX IF NOT EXISTS idx_message_edits_message_id ON message_edits (message_id);
+
+CREATE TABLE IF NOT EXISTS reactions (
+    message_id uuid,
+    user_id    uuid,
+    emoji      varchar(64),
+    created_at timestamptz,
+    PRIMARY KEY (message_id, user_id, emoji)
+);
+
+CREATE TABLE IF NOT EXISTS attachments (
+    id           uuid PRIMARY KEY,
+    uploader_id  uuid NOT NULL,
+    message_id   uuid,
+    file_name    varchar(255) NOT NULL,
+    content_type varchar(127) NOT NULL,
+    size         bigint NOT NULL,
+    storage_key  varchar(255) NOT NULL,
+    width        bigint NOT NULL DEFAULT 0,
+    height       bigint NOT NULL DEFAULT 0,
+    thumbnail    boolean NOT NULL DEFAULT false,
+    created_at   timestamptz,
+    CONSTRAINT fk_messages_attachments FOREIGN KEY (message_id) REFERENCES messages (id)
+);
+CREATE INDEX IF NOT EXISTS idx_attachments_uploader_id ON attachments (uploader_id);
+CREATE INDEX IF NOT EXISTS idx_attachments_message_id ON attachments (message_id);
+
+-- Foreign keys AutoMigrate never created. They are added here rather than in
+-- the table bodies so that an adopted database gets them too, once the rows
+-- earlier deletes left dangling are gone.
+DELETE FROM group_invites i WHERE NOT EXISTS (SELECT 1 FROM groups g WHERE g.id = i.group_id)
+    OR NOT EXISTS (SELECT 1 FROM users u WHERE u.id = i.created_by);
+DELETE FROM group_join_requests r WHERE NOT EXISTS (SELECT 1 FROM groups g WHERE g.id = r.group_id);
+DELETE FROM sessions s WHERE NOT EXISTS (SELECT 1 FROM users u WHERE u.id = s.user_id);
+DELETE FROM refresh_tokens t WHERE NOT EXISTS (SELECT 1 FROM sessions s WHERE s.id = t.session_id);
+DELETE FROM message_receipts r WHERE NOT EXISTS (SELECT 1 FROM messages m WHERE m.id = r.message_id);
+DELETE FROM reactions r WHERE NOT EXISTS (SELECT 1 FROM messages m WHERE m.id = r.message_id)
+    OR NOT EXISTS (SELECT 1 FROM users u WHERE u.id = r.user_id);
+DELETE FROM attachments a WHERE NOT EXISTS (SELECT 1 FROM users u WHERE u.id = a.uploader_id);
+UPDATE messages m SET thread_root_id = NULL
+    WHERE thread_root_id IS NOT NULL AND NOT EXISTS (SELECT 1 FROM messages r WHERE r.id = m.thread_root_id);
+UPDATE messages m SET deleted_by = NULL
+    WHERE deleted_by IS NOT NULL AND NOT EXISTS (SELECT 1 FROM users u WHERE u.id = m.deleted_by);
+DELETE FROM message_edits e WHERE NOT EXISTS (SELECT 1 FROM messages m WHERE m.id = e.message_id);
+DELETE FROM read_cursors c WHERE NOT EXISTS (SELECT 1 FROM users u WHERE u.id = c.user_id);
+
+DO $$
+DECLARE
+    fk text[];
+BEGIN
+    -- table, constraint, column, referenced table
+    FOREACH fk SLICE 1 IN ARRAY ARRAY[
+        ['group_invites', 'fk_group_invites_group', 'group_id', 'groups'],
+        ['group_invites', 'fk_group_invites_created_by', 'created_by', 'users'],
+        ['group_join_requests', 'fk_group_join_requests_group', 'group_id', 'groups'],
+        ['sessions', 'fk_sessions_user', 'user_id', 'users'],
+        ['refresh_tokens', 'fk_refresh_tokens_session', 'session_id', 'sessions'],
+        ['message_receipts', 'fk_message_receipts_message', 'message_id', 'messages'],
+        ['reactions', 'fk_reactions_message', 'message_id', 'messages'],
+        ['reactions', 'fk_reactions_user', 'user_id', 'users'],
+        ['attachments', 'fk_attachments_uploader', 'uploader_id', 'users'],
+        ['messages', 'fk_messages_thread_root', 'thread_root_id', 'messages'],
+        ['messages', 'fk_messages_deleted_by', 'deleted_by', 'users'],
+        ['message_edits', 'fk_message_edits_message', 'message_id', 'messages'],
+        ['read_cursors', 'fk_read_cursors_user', 'user_id', 'users']
+    ] LOOP
+        IF NOT EXISTS (SELECT 1 FROM pg_constraint WHERE conname = fk[2] AND conrelid = fk[1]::regclass) THEN
+            EXECUTE format('ALTER TABLE %I ADD CONSTRAINT %I FOREIGN KEY (%I) REFERENCES %I (id)', fk[1], fk[2], fk[3], fk[4]);
+        END IF;
+    END LOOP;
+END $$;
+
+-- memberships created before roles existed default to member; restore their owners
+UPDATE group_members gm SET role = 'owner' FROM groups g
+    WHERE g.id = gm.group_id AND g.owner_id = gm.user_id AND gm.role <> 'owner';
@@ -1,8 +1,11 @@
 package drivers
 
 import (
+	"bytes"
 	"context"
+	"database/sql"
 	"errors"
+	"slices"
 	"time"
 
 	"example.com/go-chat/internal/core"
@@ -18,21 +21,14 @@ type Postgres struct {
 }
 
 func NewPostgres(ctx context.Context, dsn string) (*Postgres, error) {
-	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{})
+	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{
+		// report unique violations as gorm.ErrDuplicatedKey
+		TranslateError: true,
+	})
 	if err != nil {
 		return nil, err
 	}
 
-	err = db.AutoMigrate(
-		&core.Group{},
-		&core.User{},
-		&core.Message{},
-		&core.GroupMember{},
-	)
-	if err!=nil{
-		return nil, err
-	}
-
 	return &Postgres{db: db}, nil
 }
 
@@ -44,69 +40,177 @@ func (p *Postgres) Close(ctx context.Context) error {
 	return sqlDB.Close()
 }
 
-
-func (p *Postgres) CreateUser(ctx context.Context, u *core.User, plainPassword string) error{
+func (p *Postgres) CreateUser(ctx context.Context, u *core.User, plainPassword string) error {
 	hash, err := bcrypt.GenerateFromPassword([]byte(plainPassword), bcrypt.DefaultCost)
-	if err != nil{
+	if err != nil {
 		return err
 	}
 	u.ID = uuid.New()
 	u.PasswordHash = string(hash)
 	u.CreatedAt = time.Now()
-	return p.db.WithContext(ctx).Create(u).Error
+	err = p.db.WithContext(ctx).Create(u).Error
+	if errors.Is(err, gorm.ErrDuplicatedKey) {
+		return core.ErrEmailTaken
+	}
+	return err
 }
 
-func( p * Postgres) GetUserByEmail(ctx context.Context, email string) (*core .User, error){
+func (p *Postgres) GetUserByEmail(ctx context.Context, email string) (*core.User, error) {
 	var u core.User
-	err :=  p.db.WithContext(ctx).Where("email = ?", email).First(&u).Error
-	if err != nil{
-		return nil, err
+	if err := p.db.WithContext(ctx).Where("email = ?", email).First(&u).Error; err != nil {
+		return nil, notFound(err)
 	}
-return &u, nil
+	return &u, nil
 }
 
-func (p * Postgres) GetUserByID(ctx context.Context, id uuid.UUID) (*core.User, error){
+func (p *Postgres) GetUserByID(ctx context.Context, id uuid.UUID) (*core.User, error) {
 	var u core.User
-	err := p.db.WithContext(ctx).First(&u, "id = ?",id).Error
-	if err!= nil{
-		return nil, err
+	if err := p.db.WithContext(ctx).First(&u, "id = ?", id).Error; err != nil {
+		return nil, notFound(err)
 	}
 	return &u, nil
 }
 
-func (p *Postgres) VerifyPassword(ctx context.Context, email, plain string) (*core.User, error){
-	u, err := p.GetUserByEmail(ctx,email)
-	if err!=nil{
+// VerifyPassword doesn't tell an unknown email from a wrong password.
+func (p *Postgres) VerifyPassword(ctx context.Context, email, plain string) (*core.User, error) {
+	u, err := p.GetUserByEmail(ctx, email)
+	if errors.Is(err, core.ErrNotFound) {
+		return nil, core.ErrInvalidCredentials
+	}
+	if err != nil {
 		return nil, err
 	}
-	if bcrypt.CompareHashAndPassword([]byte(u.PasswordHash),[]byte(plain)) !=nil{
-		return nil, errors.New("invalid credentials")
+	if bcrypt.CompareHashAndPassword([]byte(u.PasswordHash), []byte(plain)) != nil {
+		return nil, core.ErrInvalidCredentials
 	}
 	return u, nil
 }
 
-func (p *Postgres) CreateGroup(ctx context.Context, g *core.Group) error{
+func (p *Postgres) ListContacts(ctx context.Context, userId uuid.UUID) ([]uuid.UUID, error) {
+	var ids []uuid.UUID
+	err := p.db.WithContext(ctx).Raw(`
+		SELECT gm2.user_id FROM group_members gm1
+		JOIN group_members gm2 ON gm2.group_id = gm1.group_id
+		WHERE gm1.user_id = @user AND gm2.user_id <> @user
+		UNION
+		SELECT recipient_id FROM messages WHERE sender_id = @user AND recipient_id IS NOT NULL
+		UNION
+		SELECT sender_id FROM messages WHERE recipient_id = @user`,
+		sql.Named("user", userId)).Scan(&ids).Error
+	return ids, err
+}
+
+func (p *Postgres) CreateGroup(ctx context.Context, g *core.Group) error {
 	g.ID = uuid.New()
 	g.CreatedAt = time.Now()
 	return p.db.WithContext(ctx).Create(g).Error
 }
 
-type GroupMember struct{
-	GroupID uuid.UUID `gorm:"type:uuid"`
-	UserID uuid.UUID `gorm:"type:uuid"`
-	JoinedAt time.Time
-}
-
-func (p *Postgres) AddGroupMember(ctx context.Context, groupId , userId uuid.UUID) error{
+func (p *Postgres) AddGroupMember(ctx context.Context, groupId, userId uuid.UUID, role core.GroupRole) error {
 	m := core.GroupMember{
 		GroupID:  groupId,
-		UserID: userId,
+		UserID:   userId,
+		Role:     role,
 		JoinedAt: time.Now(),
 	}
 
 	return p.db.WithContext(ctx).Clauses(clause.OnConflict{DoNothing: true}).Create(&m).Error
 }
-func (p *Postgres) MyGroups(ctx context.Context, userId uuid.UUID) ([]core.Group,error){
+
+func (p *Postgres) RemoveGroupMember(ctx context.Context, groupId, userId uuid.UUID) error {
+	return p.db.WithContext(ctx).Where("group_id = ? AND user_id = ?", groupId, userId).Delete(&core.GroupMember{}).Error
+}
+
+func (p *Postgres) GetMember(ctx context.Context, groupId, userId uuid.UUID) (*core.GroupMember, error) {
+	var m core.GroupMember
+	err := p.db.WithContext(ctx).Where("group_id = ? AND user_id = ?", groupId, userId).First(&m).Error
+	if err != nil {
+		return nil, notFound(err)
+	}
+	return &m, nil
+}
+
+func (p *Postgres) SetMemberRole(ctx context.Context, groupId, userId uuid.UUID, role core.GroupRole) error {
+	res := p.db.WithContext(ctx).Model(&core.GroupMember{}).
+		Where("group_id = ? AND user_id = ?", groupId, userId).Update("role", role)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return core.ErrNotFound
+	}
+	return nil
+}
+
+func (p *Postgres) TransferOwnership(ctx context.Context, groupId, userId uuid.UUID) error {
+	return p.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&core.GroupMember{}).
+			Where("group_id = ? AND role = ?", groupId, core.RoleOwner).Update("role", core.RoleAdmin).Error
+		if err != nil {
+			return err
+		}
+		res := tx.Model(&core.GroupMember{}).
+			Where("group_id = ? AND user_id = ?", groupId, userId).Update("role", core.RoleOwner)
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return core.ErrNotFound
+		}
+		return tx.Model(&core.Group{}).Where("id = ?", groupId).Update("owner_id", userId).Error
+	})
+}
+
+func (p *Postgres) GetGroup(ctx context.Context, id uuid.UUID) (*core.Group, error) {
+	var g core.Group
+	if err := p.db.WithContext(ctx).First(&g, "id = ?", id).Error; err != nil {
+		return nil, notFound(err)
+	}
+	return &g, nil
+}
+
+func (p *Postgres) UpdateGroup(ctx context.Context, g *core.Group) error {
+	return p.db.WithContext(ctx).Model(g).Select("name", "owner_id", "visibility").Updates(g).Error
+}
+
+func (p *Postgres) DeleteGroup(ctx context.Context, id uuid.UUID) error {
+	return p.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("message_id IN (?)", tx.Model(&core.Message{}).Select("id").Where("group_id = ?", id)).
+			Delete(&core.MessageReceipt{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("message_id IN (?)", tx.Model(&core.Message{}).Select("id").Where("group_id = ?", id)).
+			Delete(&core.MessageEdit{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("message_id IN (?)", tx.Model(&core.Message{}).Select("id").Where("group_id = ?", id)).
+			Delete(&core.Reaction{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("message_id IN (?)", tx.Model(&core.Message{}).Select("id").Where("group_id = ?", id)).
+			Delete(&core.Attachment{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("conversation_id = ?", id).Delete(&core.ReadCursor{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("group_id = ?", id).Delete(&core.Message{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("group_id = ?", id).Delete(&core.GroupMember{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("group_id = ?", id).Delete(&core.GroupInvite{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("group_id = ?", id).Delete(&core.GroupJoinRequest{}).Error; err != nil {
+			return err
+		}
+		return tx.Where("id = ?", id).Delete(&core.Group{}).Error
+	})
+}
+
+func (p *Postgres) MyGroups(ctx context.Context, userId uuid.UUID) ([]core.Group, error) {
 	var groups []core.Group
 
 	err := p.db.WithContext(ctx).
@@ -121,43 +225,646 @@ func (p *Postgres) MyGroups(ctx context.Context, userId uuid.UUID) ([]core.Group
 	return groups, nil
 }
 
-func (p *Postgres) ListGroupMembers(ctx context.Context, groupId uuid.UUID)([]core.User,error){
-	var users []core.User
+func (p *Postgres) ListGroupMembers(ctx context.Context, groupId uuid.UUID) ([]core.GroupMember, error) {
+	var members []core.GroupMember
 
-	err := p.db.WithContext(ctx).
-	Joins("JOIN group_members gm ON gm.user_id=users.id").
-	Where("gm.group_id = ?",groupId).Find(&users).Error
-	return users,err
+	err := p.db.WithContext(ctx).Preload("User").
+		Where("group_id = ?", groupId).Order("joined_at, user_id").Find(&members).Error
+	return members, err
 }
 
+func (p *Postgres) IsMember(ctx context.Context, groupId, userId uuid.UUID) (bool, error) {
+	var n int64
+	err := p.db.WithContext(ctx).Model(&core.GroupMember{}).
+		Where("group_id = ? AND user_id = ?", groupId, userId).Count(&n).Error
+	return n > 0, err
+}
 
-func (p *Postgres) SaveMessage(ctx context.Context, m *core.Message) error{
+func (p *Postgres) CreateInvite(ctx context.Context, inv *core.GroupInvite) error {
+	inv.CreatedAt = time.Now()
+	return p.db.WithContext(ctx).Create(inv).Error
+}
+
+func (p *Postgres) ListInvites(ctx context.Context, groupId uuid.UUID) ([]core.GroupInvite, error) {
+	var invites []core.GroupInvite
+	err := p.db.WithContext(ctx).Where("group_id = ?", groupId).Order("created_at DESC").Find(&invites).Error
+	return invites, err
+}
+
+func (p *Postgres) DeleteInvite(ctx context.Context, groupId uuid.UUID, token string) error {
+	res := p.db.WithContext(ctx).Where("group_id = ? AND token = ?", groupId, token).Delete(&core.GroupInvite{})
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return core.ErrInvalidInvite
+	}
+	return nil
+}
+
+func (p *Postgres) GetInvite(ctx context.Context, token string) (*core.GroupInvite, error) {
+	var inv core.GroupInvite
+	if err := p.db.WithContext(ctx).First(&inv, "token = ?", token).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, core.ErrInvalidInvite
+		}
+		return nil, err
+	}
+	return &inv, nil
+}
+
+func (p *Postgres) UseInvite(ctx context.Context, token string, now time.Time) (*core.GroupInvite, error) {
+	var inv core.GroupInvite
+	res := p.db.WithContext(ctx).Model(&inv).Clauses(clause.Returning{}).
+		Where("token = ? AND (max_uses = 0 OR uses < max_uses) AND (expires_at IS NULL OR expires_at > ?)", token, now).
+		Update("uses", gorm.Expr("uses + 1"))
+	if res.Error != nil {
+		return nil, res.Error
+	}
+	if res.RowsAffected == 0 {
+		return nil, core.ErrInvalidInvite
+	}
+	return &inv, nil
+}
+
+func (p *Postgres) SaveJoinRequest(ctx context.Context, r *core.GroupJoinRequest) error {
+	r.CreatedAt = time.Now()
+	return p.db.WithContext(ctx).Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "group_id"}, {Name: "user_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"status", "decided_by", "decided_at", "created_at"}),
+	}).Create(r).Error
+}
+
+func (p *Postgres) ListJoinRequests(ctx context.Context, groupId uuid.UUID, status core.JoinRequestStatus) ([]core.GroupJoinRequest, error) {
+	var reqs []core.GroupJoinRequest
+	err := p.db.WithContext(ctx).Preload("User").
+		Where("group_id = ? AND status = ?", groupId, status).Order("created_at").Find(&reqs).Error
+	return reqs, err
+}
+
+func (p *Postgres) DecideJoinRequest(ctx context.Context, groupId, userId, decidedBy uuid.UUID, status core.JoinRequestStatus) error {
+	res := p.db.WithContext(ctx).Model(&core.GroupJoinRequest{}).
+		Where("group_id = ? AND user_id = ? AND status = ?", groupId, userId, core.JoinRequestPending).
+		Updates(map[string]any{"status": status, "decided_by": decidedBy, "decided_at": time.Now()})
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return core.ErrNoJoinRequest
+	}
+	return nil
+}
+
+func (p *Postgres) SaveMessage(ctx context.Context, m *core.Message) error {
 	m.ID = uuid.New()
-	m.CreatedAt = time.Now()
-	return p.db.WithContext(ctx).Create(m).Error
+	// postgres keeps microseconds; truncate so cursors built from m match the stored row
+	m.CreatedAt = time.Now().Truncate(time.Microsecond)
+	return p.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Omit(clause.Associations).Create(m).Error; err != nil {
+			return err
+		}
+		if len(m.Attachments) > 0 {
+			ids := make([]uuid.UUID, len(m.Attachments))
+			for i := range m.Attachments {
+				ids[i] = m.Attachments[i].ID
+				m.Attachments[i].MessageID = &m.ID
+			}
+			res := tx.Model(&core.Attachment{}).
+				Where("id IN ? AND uploader_id = ? AND message_id IS NULL", ids, m.SenderID).Update("message_id", m.ID)
+			if res.Error != nil {
+				return res.Error
+			}
+			if res.RowsAffected != int64(len(ids)) {
+				return core.ErrInvalidAttachment
+			}
+		}
+		if m.ThreadRootID == nil {
+			return nil
+		}
+		return tx.Model(&core.Message{}).Where("id = ?", *m.ThreadRootID).
+			Update("reply_count", gorm.Expr("reply_count + 1")).Error
+	})
+}
+
+func (p *Postgres) GetMessage(ctx context.Context, id uuid.UUID) (*core.Message, error) {
+	var m core.Message
+	if err := p.db.WithContext(ctx).First(&m, "id = ?", id).Error; err != nil {
+		return nil, notFound(err)
+	}
+	return &m, nil
+}
+
+func (p *Postgres) EditMessage(ctx context.Context, m *core.Message, content string, at time.Time) error {
+	err := p.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var cur core.Message
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&cur, "id = ?", m.ID).Error; err != nil {
+			return notFound(err)
+		}
+		if cur.DeletedAt != nil {
+			return core.ErrMessageDeleted
+		}
+		if err := tx.Create(&core.MessageEdit{ID: uuid.New(), MessageID: m.ID, Content: cur.Content, EditedAt: at}).Error; err != nil {
+			return err
+		}
+		return tx.Model(&core.Message{}).Where("id = ?", m.ID).
+			Updates(map[string]any{"content": content, "edited_at": at}).Error
+	})
+	if err != nil {
+		return err
+	}
+	m.Content, m.EditedAt = content, &at
+	return nil
+}
+
+func (p *Postgres) DeleteMessage(ctx context.Context, m *core.Message, by uuid.UUID, at time.Time) error {
+	err := p.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		res := tx.Model(&core.Message{}).Where("id = ? AND deleted_at IS NULL", m.ID).
+			Updates(map[string]any{"content": "", "deleted_at": at, "deleted_by": by})
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return core.ErrMessageDeleted
+		}
+		if err := tx.Where("message_id = ?", m.ID).Delete(&core.MessageEdit{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("message_id = ?", m.ID).Delete(&core.Attachment{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("message_id = ?", m.ID).Delete(&core.Reaction{}).Error; err != nil {
+			return err
+		}
+		// the reply stays in its thread as a tombstone but no longer counts
+		root := tx.Model(&core.Message{}).Select("thread_root_id").Where("id = ?", m.ID)
+		return tx.Model(&core.Message{}).Where("id = (?)", root).
+			Update("reply_count", gorm.Expr("reply_count - 1")).Error
+	})
+	if err != nil {
+		return err
+	}
+	m.Content, m.DeletedAt, m.DeletedBy, m.Attachments = "", &at, &by, nil
+	return nil
+}
+
+func (p *Postgres) ListEdits(ctx context.Context, messageId uuid.UUID) ([]core.MessageEdit, error) {
+	var edits []core.MessageEdit
+	err := p.db.WithContext(ctx).Where("message_id = ?", messageId).Order("edited_at, id").Find(&edits).Error
+	return edits, err
+}
+
+func (p *Postgres) GetPrivateHistory(ctx context.Context, a, b uuid.UUID, q core.HistoryQuery) ([]core.Message, error) {
+	tx := p.db.WithContext(ctx).
+		Where("(sender_id = ? AND recipient_id = ?) OR (sender_id = ? AND recipient_id = ?)", a, b, b, a)
+	return findPage(tx, q)
+}
+
+func (p *Postgres) GetGroupHistory(ctx context.Context, groupID uuid.UUID, q core.HistoryQuery) ([]core.Message, error) {
+	tx := p.db.WithContext(ctx).Where("group_id = ?", groupID)
+	return findPage(tx, q)
+}
+
+func (p *Postgres) GetThread(ctx context.Context, rootId uuid.UUID, q core.HistoryQuery) ([]core.Message, error) {
+	tx := p.db.WithContext(ctx).Where("thread_root_id = ?", rootId)
+	return findPage(tx, q)
+}
+
+// conversationsQuery lists one row per group the user is in and per user they
+// exchanged private messages with, along with the newest message and the
+// number of messages from others past the user's read cursor.
+const conversationsQuery = `
+SELECT c.id, c.is_group, c.last_id, c.activity, c.unread FROM (
+	SELECT gm.group_id AS id, TRUE AS is_group, lm.id AS last_id,
+		COALESCE(lm.created_at, gm.joined_at) AS activity,
+		(SELECT COUNT(*) FROM messages m
+			WHERE m.group_id = gm.group_id AND m.sender_id <> @user AND m.deleted_at IS NULL
+			AND (rc.message_id IS NULL OR (m.created_at, m.id) > (rc.message_created_at, rc.message_id))) AS unread
+	FROM group_members gm
+	LEFT JOIN read_cursors rc ON rc.user_id = @user AND rc.conversation_id = gm.group_id
+	LEFT JOIN LATERAL (SELECT id, created_at FROM messages m WHERE m.group_id = gm.group_id
+		ORDER BY created_at DESC, id DESC LIMIT 1) lm ON TRUE
+	WHERE gm.user_id = @user
+	UNION ALL
+	SELECT p.peer, FALSE, lm.id, lm.created_at,
+		(SELECT COUNT(*) FROM messages m
+			WHERE m.sender_id = p.peer AND m.recipient_id = @user AND m.deleted_at IS NULL
+			AND (rc.message_id IS NULL OR (m.created_at, m.id) > (rc.message_created_at, rc.message_id)))
+	FROM (SELECT DISTINCT CASE WHEN sender_id = @user THEN recipient_id ELSE sender_id END AS peer
+		FROM messages WHERE (sender_id = @user AND recipient_id IS NOT NULL) OR recipient_id = @user) p
+	LEFT JOIN read_cursors rc ON rc.user_id = @user AND rc.conversation_id = p.peer
+	JOIN LATERAL (SELECT id, created_at FROM messages m
+		WHERE (m.sender_id = @user AND m.recipient_id = p.peer) OR (m.sender_id = p.peer AND m.recipient_id = @user)
+		ORDER BY created_at DESC, id DESC LIMIT 1) lm ON TRUE
+) c ORDER BY c.activity DESC, c.id`
+
+// ListConversations runs conversationsQuery and then loads the peers, groups
+// and last messages it refers to with one query each.
+func (p *Postgres) ListConversations(ctx context.Context, userId uuid.UUID) ([]core.Conversation, error) {
+	db := p.db.WithContext(ctx)
+	var rows []struct {
+		ID       uuid.UUID
+		IsGroup  bool
+		LastID   *uuid.UUID
+		Activity time.Time
+		Unread   int
+	}
+	if err := db.Raw(conversationsQuery, sql.Named("user", userId)).Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+	var peerIds, groupIds, lastIds []uuid.UUID
+	for _, r := range rows {
+		if r.IsGroup {
+			groupIds = append(groupIds, r.ID)
+		} else {
+			peerIds = append(peerIds, r.ID)
+		}
+		if r.LastID != nil {
+			lastIds = append(lastIds, *r.LastID)
+		}
+	}
+	peers, err := findByID(db, peerIds, func(u *core.User) uuid.UUID { return u.ID })
+	if err != nil {
+		return nil, err
+	}
+	groups, err := findByID(db, groupIds, func(g *core.Group) uuid.UUID { return g.ID })
+	if err != nil {
+		return nil, err
+	}
+	last, err := findByID(db, lastIds, func(m *core.Message) uuid.UUID { return m.ID })
+	if err != nil {
+		return nil, err
+	}
+
+	convs := make([]core.Conversation, 0, len(rows))
+	for _, r := range rows {
+		c := core.Conversation{UnreadCount: r.Unread, LastActivity: r.Activity}
+		if r.IsGroup {
+			c.Group = groups[r.ID]
+		} else {
+			c.Peer = peers[r.ID]
+		}
+		if r.LastID != nil {
+			c.LastMessage = last[*r.LastID]
+		}
+		convs = append(convs, c)
+	}
+	return convs, nil
+}
+
+// findByID loads the rows with the given primary keys, indexed by id.
+func findByID[T any](db *gorm.DB, ids []uuid.UUID, id func(*T) uuid.UUID) (map[uuid.UUID]*T, error) {
+	byID := make(map[uuid.UUID]*T, len(ids))
+	if len(ids) == 0 {
+		return byID, nil
+	}
+	var rows []T
+	if err := db.Where("id IN ?", ids).Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	for i := range rows {
+		byID[id(&rows[i])] = &rows[i]
+	}
+	return byID, nil
 }
 
-func (p *Postgres) GetPrivateHistory(ctx context.Context, a, b uuid.UUID, limit int)([]core.Message, error){
+// findPage applies a keyset page on (created_at, id) to tx and returns the rows
+// newest first, along with the messages they quote.
+func findPage(tx *gorm.DB, q core.HistoryQuery) ([]core.Message, error) {
 	var msgs []core.Message
-	err:= p.db.WithContext(ctx).
-	Where("(sender_id = ? AND recipient_id = ?) OR (sender_id = ? AND recipient_id = ?)", a,b,b,a).
-	Order("created_at DESC").Limit(limit).Find(&msgs).Error
-	return msgs,err
+	tx = tx.Preload("ReplyTo").Preload("Attachments", func(db *gorm.DB) *gorm.DB { return db.Order("created_at, id") })
+	switch {
+	case q.Before != nil:
+		tx = tx.Where("(created_at, id) < (?, ?)", q.Before.CreatedAt, q.Before.ID).Order("created_at DESC, id DESC")
+	case q.After != nil:
+		tx = tx.Where("(created_at, id) > (?, ?)", q.After.CreatedAt, q.After.ID).Order("created_at ASC, id ASC")
+	default:
+		tx = tx.Order("created_at DESC, id DESC")
+	}
+	if err := tx.Limit(q.Limit).Find(&msgs).Error; err != nil {
+		return nil, err
+	}
+	if q.After != nil {
+		slices.Reverse(msgs)
+	}
+	return msgs, nil
+}
+
+// searchSnippet highlights the search terms in content. The content is HTML
+// escaped first so only the <mark> tags are markup.
+const searchSnippet = `ts_headline('simple',
+	replace(replace(replace(content, '&', '&amp;'), '<', '&lt;'), '>', '&gt;'),
+	websearch_to_tsquery('simple', ?),
+	'StartSel=<mark>, StopSel=</mark>, MaxWords=30, MinWords=10, MaxFragments=2')`
+
+func (p *Postgres) SearchMessages(ctx context.Context, userId uuid.UUID, q core.SearchQuery) ([]core.SearchHit, error) {
+	tx := p.db.WithContext(ctx).Table("messages").
+		Select("id, "+searchSnippet+" AS snippet", q.Text).
+		Where("search @@ websearch_to_tsquery('simple', ?) AND deleted_at IS NULL", q.Text).
+		Where(`(group_id IN (SELECT group_id FROM group_members WHERE user_id = ?)
+			OR (group_id IS NULL AND (sender_id = ? OR recipient_id = ?)))`, userId, userId, userId)
+	if q.SenderID != nil {
+		tx = tx.Where("sender_id = ?", *q.SenderID)
+	}
+	if q.GroupID != nil {
+		tx = tx.Where("group_id = ?", *q.GroupID)
+	}
+	if q.Since != nil {
+		tx = tx.Where("created_at >= ?", *q.Since)
+	}
+	if q.Until != nil {
+		tx = tx.Where("created_at < ?", *q.Until)
+	}
+	switch {
+	case q.Before != nil:
+		tx = tx.Where("(created_at, id) < (?, ?)", q.Before.CreatedAt, q.Before.ID).Order("created_at DESC, id DESC")
+	case q.After != nil:
+		tx = tx.Where("(created_at, id) > (?, ?)", q.After.CreatedAt, q.After.ID).Order("created_at ASC, id ASC")
+	default:
+		tx = tx.Order("created_at DESC, id DESC")
+	}
+	var rows []struct {
+		ID      uuid.UUID
+		Snippet string
+	}
+	if err := tx.Limit(q.Limit).Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, nil
+	}
+
+	ids := make([]uuid.UUID, len(rows))
+	for i, r := range rows {
+		ids[i] = r.ID
+	}
+	byID, err := findByID(p.db.WithContext(ctx).Preload("ReplyTo").Preload("Attachments", func(db *gorm.DB) *gorm.DB {
+		return db.Order("created_at, id")
+	}), ids, func(m *core.Message) uuid.UUID { return m.ID })
+	if err != nil {
+		return nil, err
+	}
+	hits := make([]core.SearchHit, 0, len(rows))
+	for _, r := range rows {
+		if m, ok := byID[r.ID]; ok {
+			hits = append(hits, core.SearchHit{Message: *m, Snippet: r.Snippet})
+		}
+	}
+	if q.After != nil {
+		slices.Reverse(hits)
+	}
+	return hits, nil
+}
+
+func (p *Postgres) CreateAttachment(ctx context.Context, a *core.Attachment) error {
+	a.CreatedAt = time.Now()
+	return p.db.WithContext(ctx).Create(a).Error
 }
 
-func (p *Postgres) GetGroupHistory(ctx context.Context, groupID uuid.UUID, limit int)([]core.Message,error){
+func (p *Postgres) GetAttachment(ctx context.Context, id uuid.UUID) (*core.Attachment, error) {
+	var a core.Attachment
+	if err := p.db.WithContext(ctx).First(&a, "id = ?", id).Error; err != nil {
+		return nil, notFound(err)
+	}
+	return &a, nil
+}
+
+func (p *Postgres) ListAttachments(ctx context.Context, ids []uuid.UUID) ([]core.Attachment, error) {
+	var atts []core.Attachment
+	err := p.db.WithContext(ctx).Where("id IN ?", ids).Order("created_at, id").Find(&atts).Error
+	return atts, err
+}
+
+func (p *Postgres) MessageAttachments(ctx context.Context, messageId uuid.UUID) ([]core.Attachment, error) {
+	var atts []core.Attachment
+	err := p.db.WithContext(ctx).Where("message_id = ?", messageId).Order("created_at, id").Find(&atts).Error
+	return atts, err
+}
+
+func (p *Postgres) GroupAttachments(ctx context.Context, groupId uuid.UUID) ([]core.Attachment, error) {
+	var atts []core.Attachment
+	err := p.db.WithContext(ctx).Where("message_id IN (?)", p.db.Model(&core.Message{}).Select("id").Where("group_id = ?", groupId)).
+		Order("created_at, id").Find(&atts).Error
+	return atts, err
+}
+
+func (p *Postgres) SetAttachmentPreview(ctx context.Context, id uuid.UUID, width, height int, thumbnail bool) (*core.Attachment, error) {
+	var a core.Attachment
+	res := p.db.WithContext(ctx).Model(&a).Clauses(clause.Returning{}).Where("id = ?", id).
+		Updates(map[string]any{"width": width, "height": height, "thumbnail": thumbnail})
+	if res.Error != nil {
+		return nil, res.Error
+	}
+	if res.RowsAffected == 0 {
+		return nil, core.ErrNotFound
+	}
+	return &a, nil
+}
+
+func (p *Postgres) AddReaction(ctx context.Context, r *core.Reaction) (bool, error) {
+	r.CreatedAt = time.Now()
+	res := p.db.WithContext(ctx).Clauses(clause.OnConflict{DoNothing: true}).Create(r)
+	return res.RowsAffected == 1, res.Error
+}
+
+func (p *Postgres) RemoveReaction(ctx context.Context, messageId, userId uuid.UUID, emoji string) (bool, error) {
+	res := p.db.WithContext(ctx).Where("message_id = ? AND user_id = ? AND emoji = ?", messageId, userId, emoji).
+		Delete(&core.Reaction{})
+	return res.RowsAffected == 1, res.Error
+}
+
+func (p *Postgres) CountReactions(ctx context.Context, messageIds []uuid.UUID, viewer uuid.UUID) (map[uuid.UUID][]core.ReactionCount, error) {
+	counts := make(map[uuid.UUID][]core.ReactionCount)
+	if len(messageIds) == 0 {
+		return counts, nil
+	}
+	var rows []struct {
+		MessageID uuid.UUID
+		core.ReactionCount
+	}
+	err := p.db.WithContext(ctx).Model(&core.Reaction{}).
+		Select("message_id, emoji, COUNT(*) AS count, BOOL_OR(user_id = ?) AS me", viewer).
+		Where("message_id IN ?", messageIds).Group("message_id, emoji").
+		Order("count DESC, MIN(created_at), emoji").Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range rows {
+		counts[r.MessageID] = append(counts[r.MessageID], r.ReactionCount)
+	}
+	return counts, nil
+}
+
+func (p *Postgres) MarkDelivered(ctx context.Context, messageId, userId uuid.UUID, at time.Time) (bool, error) {
+	res := p.db.WithContext(ctx).Clauses(clause.OnConflict{DoNothing: true}).
+		Create(&core.MessageReceipt{MessageID: messageId, UserID: userId, DeliveredAt: &at})
+	return res.RowsAffected == 1, res.Error
+}
+
+func (p *Postgres) MarkRead(ctx context.Context, userId uuid.UUID, m *core.Message, at time.Time, limit int) ([]core.Message, error) {
 	var msgs []core.Message
-	err := p.db.WithContext(ctx).Where("group_id = ?",groupID).Order("created_at DESC").Limit(limit).Find(&msgs).Error
+	err := p.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		conv := core.ConversationOf(m, userId)
+		var cur core.ReadCursor
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("user_id = ? AND conversation_id = ?", userId, conv).Take(&cur).Error
+		found := err == nil
+		if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+		if found && !cursorBefore(cur.MessageCreatedAt, cur.MessageID, m.CreatedAt, m.ID) {
+			return nil
+		}
+		next := core.ReadCursor{UserID: userId, ConversationID: conv, MessageID: m.ID, MessageCreatedAt: m.CreatedAt, UpdatedAt: at}
+		if err := tx.Save(&next).Error; err != nil {
+			return err
+		}
+
+		q := conversation(tx, m).Where("sender_id <> ? AND (created_at, id) <= (?, ?)", userId, m.CreatedAt, m.ID)
+		if found {
+			q = q.Where("(created_at, id) > (?, ?)", cur.MessageCreatedAt, cur.MessageID)
+		}
+		if err := q.Order("created_at DESC, id DESC").Limit(limit).Find(&msgs).Error; err != nil {
+			return err
+		}
+		if len(msgs) == 0 {
+			return nil
+		}
+		receipts := make([]core.MessageReceipt, len(msgs))
+		for i, msg := range msgs {
+			receipts[i] = core.MessageReceipt{MessageID: msg.ID, UserID: userId, DeliveredAt: &at, ReadAt: &at}
+		}
+		return tx.Clauses(clause.OnConflict{
+			Columns: []clause.Column{{Name: "message_id"}, {Name: "user_id"}},
+			DoUpdates: clause.Set{
+				{Column: clause.Column{Name: "read_at"}, Value: at},
+				{Column: clause.Column{Name: "delivered_at"}, Value: gorm.Expr("COALESCE(message_receipts.delivered_at, ?)", at)},
+			},
+			Where: clause.Where{Exprs: []clause.Expression{clause.Expr{SQL: "message_receipts.read_at IS NULL"}}},
+		}).Create(&receipts).Error
+	})
+	return msgs, err
+}
 
-	return msgs,err
+// conversation scopes messages to the conversation m belongs to.
+func conversation(tx *gorm.DB, m *core.Message) *gorm.DB {
+	if m.GroupID != nil {
+		return tx.Where("group_id = ?", *m.GroupID)
+	}
+	a, b := m.SenderID, *m.RecipientID
+	return tx.Where("(sender_id = ? AND recipient_id = ?) OR (sender_id = ? AND recipient_id = ?)", a, b, b, a)
+}
+
+// cursorBefore orders two (created_at, id) positions like the keyset queries do.
+func cursorBefore(t1 time.Time, id1 uuid.UUID, t2 time.Time, id2 uuid.UUID) bool {
+	if !t1.Equal(t2) {
+		return t1.Before(t2)
+	}
+	return bytes.Compare(id1[:], id2[:]) < 0
+}
+
+func (p *Postgres) ListReceipts(ctx context.Context, messageId uuid.UUID) ([]core.MessageReceipt, error) {
+	var receipts []core.MessageReceipt
+	err := p.db.WithContext(ctx).Preload("User").Where("message_id = ?", messageId).
+		Order("read_at NULLS LAST, delivered_at, user_id").Find(&receipts).Error
+	return receipts, err
+}
+
+func (p *Postgres) CountReceipts(ctx context.Context, messageIds []uuid.UUID) (map[uuid.UUID]core.ReceiptCounts, error) {
+	var rows []struct {
+		MessageID uuid.UUID
+		Delivered int
+		Read      int
+	}
+	err := p.db.WithContext(ctx).Model(&core.MessageReceipt{}).
+		Select("message_id, COUNT(delivered_at) AS delivered, COUNT(read_at) AS read").
+		Where("message_id IN ?", messageIds).Group("message_id").Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+	counts := make(map[uuid.UUID]core.ReceiptCounts, len(rows))
+	for _, r := range rows {
+		counts[r.MessageID] = core.ReceiptCounts{Delivered: r.Delivered, Read: r.Read}
+	}
+	return counts, nil
+}
+
+func (p *Postgres) CreateSession(ctx context.Context, s *core.Session) error {
+	return p.db.WithContext(ctx).Create(s).Error
+}
+
+func (p *Postgres) GetSession(ctx context.Context, id uuid.UUID) (*core.Session, error) {
+	var s core.Session
+	if err := p.db.WithContext(ctx).First(&s, "id = ?", id).Error; err != nil {
+		return nil, notFound(err)
+	}
+	return &s, nil
+}
+
+func (p *Postgres) ListSessions(ctx context.Context, userId uuid.UUID, now time.Time) ([]core.Session, error) {
+	var sessions []core.Session
+	err := p.db.WithContext(ctx).
+		Where("user_id = ? AND revoked_at IS NULL AND expires_at > ?", userId, now).
+		Order("last_used_at DESC").Find(&sessions).Error
+	return sessions, err
+}
+
+func (p *Postgres) TouchSession(ctx context.Context, id uuid.UUID, lastUsed, expires time.Time) error {
+	return p.db.WithContext(ctx).Model(&core.Session{}).Where("id = ?", id).
+		Updates(map[string]any{"last_used_at": lastUsed, "expires_at": expires}).Error
+}
+
+func (p *Postgres) RevokeSession(ctx context.Context, id uuid.UUID, now time.Time) error {
+	res := p.db.WithContext(ctx).Model(&core.Session{}).Where("id = ? AND revoked_at IS NULL", id).Update("revoked_at", now)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return core.ErrNotFound
+	}
+	return nil
+}
+
+func (p *Postgres) SaveRefreshToken(ctx context.Context, t *core.RefreshToken) error {
+	return p.db.WithContext(ctx).Create(t).Error
+}
+
+func (p *Postgres) ConsumeRefreshToken(ctx context.Context, hash string, now time.Time) (*core.RefreshToken, error) {
+	var t core.RefreshToken
+	res := p.db.WithContext(ctx).Model(&t).Clauses(clause.Returning{}).
+		Where("hash = ? AND used_at IS NULL", hash).Update("used_at", now)
+	if res.Error != nil {
+		return nil, res.Error
+	}
+	if res.RowsAffected == 1 {
+		return &t, nil
+	}
+	if err := p.db.WithContext(ctx).First(&t, "hash = ?", hash).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, core.ErrInvalidRefreshToken
+		}
+		return nil, err
+	}
+	return &t, core.ErrRefreshTokenReused
+}
+
+// notFound maps gorm's missing row error to core.ErrNotFound.
+func notFound(err error) error {
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return core.ErrNotFound
+	}
+	return err
 }
 
-func NewRepositories(pg *Postgres) *Repositories{
+func NewRepositories(pg *Postgres) *Repositories {
 	return &Repositories{pg}
 }
 
-type Repositories struct {*Postgres}
+type Repositories struct{ *Postgres }
 
-func (r *Repositories) UserRepo() core.UserRepository { return r }
-func (r *Repositories) GroupRepo() core.GroupRepository { return r }
-func (r *Repositories) MessageRepo() core.MessageRepository {return r }
+func (r *Repositories) UserRepo() core.UserRepository             { return r }
+func (r *Repositories) GroupRepo() core.GroupRepository           { return r }
+func (r *Repositories) MessageRepo() core.MessageRepository       { return r }
+func (r *Repositories) SessionRepo() core.SessionRepository       { return r }
+func (r *Repositories) AttachmentRepo() core.AttachmentRepository { return r }
+func (r *Repositories) ReactionRepo() core.ReactionRepository     { return r }
+func (r *Repositories) ReceiptRepo() core.ReceiptRepository       { return r }
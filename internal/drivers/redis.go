@@ -3,11 +3,17 @@ package drivers
 import (
 	"context"
 	"fmt"
+	"slices"
+	"sync"
 	"time"
 
 	"github.com/redis/go-redis/v9"
+
+	"example.com/go-chat/internal/core"
 )
 
+// RedisClient is the core.Cluster shared by every server instance connected
+// to the same Redis.
 type RedisClient struct {
 	c *redis.Client
 }
@@ -23,14 +29,276 @@ func (r *RedisClient) Publish(ctx context.Context, channel string, payload strin
 	return r.c.Publish(ctx, channel, payload).Err()
 }
 
-func (r *RedisClient) Subscribe(ctx context.Context, channel string) *redis.PubSub {
-	return r.c.Subscribe(ctx, channel)
+func (r *RedisClient) Subscribe(ctx context.Context, channels ...string) core.Subscription {
+	s := &redisSubscription{
+		ps:      r.c.Subscribe(ctx),
+		ch:      make(chan *core.BrokerMessage),
+		ready:   make(chan struct{}, 1),
+		done:    make(chan struct{}),
+		waiting: map[string][]chan struct{}{},
+	}
+	go s.receive()
+	go s.forward()
+	if len(channels) > 0 {
+		// if redis is unreachable the client subscribes once it is back
+		_ = s.Subscribe(ctx, channels...)
+	}
+	return s
+}
+
+// subscribeTimeout bounds how long Subscribe waits for redis to confirm.
+const subscribeTimeout = 5 * time.Second
+
+// redisSubscription adapts a redis PubSub to core.Subscription. receive reads
+// the connection and queues the messages for forward to deliver, so that
+// confirmations keep coming in while the reader of Channel is busy, possibly
+// waiting on Subscribe itself.
+type redisSubscription struct {
+	ps    *redis.PubSub
+	ch    chan *core.BrokerMessage
+	ready chan struct{} // signals forward that queue changed
+	done  chan struct{}
+	stop  sync.Once
+
+	mu      sync.Mutex
+	queue   []*core.BrokerMessage
+	ended   bool
+	waiting map[string][]chan struct{} // by channel, in subscription order
+}
+
+// Subscribe returns once redis confirms the subscriptions, so anything
+// published afterwards is delivered.
+func (s *redisSubscription) Subscribe(ctx context.Context, channels ...string) error {
+	confirmed := make([]chan struct{}, len(channels))
+	s.mu.Lock()
+	for i, ch := range channels {
+		confirmed[i] = make(chan struct{})
+		s.waiting[ch] = append(s.waiting[ch], confirmed[i])
+	}
+	s.mu.Unlock()
+	defer s.stopWaiting(channels, confirmed)
+	if err := s.ps.Subscribe(ctx, channels...); err != nil {
+		return err
+	}
+	timeout := time.NewTimer(subscribeTimeout)
+	defer timeout.Stop()
+	for i, c := range confirmed {
+		select {
+		case <-c:
+		case <-timeout.C:
+			return fmt.Errorf("subscribe %s: no confirmation from redis", channels[i])
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-s.done:
+			return nil
+		}
+	}
+	return nil
+}
+
+// stopWaiting forgets the confirmations Subscribe did not get.
+func (s *redisSubscription) stopWaiting(channels []string, confirmed []chan struct{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, ch := range channels {
+		s.waiting[ch] = slices.DeleteFunc(s.waiting[ch], func(c chan struct{}) bool { return c == confirmed[i] })
+		if len(s.waiting[ch]) == 0 {
+			delete(s.waiting, ch)
+		}
+	}
+}
+
+func (s *redisSubscription) Unsubscribe(ctx context.Context, channels ...string) error {
+	return s.ps.Unsubscribe(ctx, channels...)
+}
+
+func (s *redisSubscription) Channel() <-chan *core.BrokerMessage { return s.ch }
+
+func (s *redisSubscription) receive() {
+	for m := range s.ps.ChannelWithSubscriptions() {
+		s.mu.Lock()
+		switch m := m.(type) {
+		case *redis.Subscription:
+			if w := s.waiting[m.Channel]; m.Kind == "subscribe" && len(w) > 0 {
+				close(w[0])
+				s.waiting[m.Channel] = w[1:]
+			}
+		case *redis.Message:
+			s.queue = append(s.queue, &core.BrokerMessage{Channel: m.Channel, Payload: m.Payload})
+		}
+		s.mu.Unlock()
+		s.notify()
+	}
+	s.mu.Lock()
+	s.ended = true
+	s.mu.Unlock()
+	s.notify()
+}
+
+func (s *redisSubscription) notify() {
+	select {
+	case s.ready <- struct{}{}:
+	default:
+	}
+}
+
+func (s *redisSubscription) forward() {
+	defer close(s.ch)
+	for {
+		s.mu.Lock()
+		queue, ended := s.queue, s.ended
+		s.queue = nil
+		s.mu.Unlock()
+		for _, msg := range queue {
+			select {
+			case s.ch <- msg:
+			case <-s.done:
+				return
+			}
+		}
+		if len(queue) > 0 {
+			continue
+		}
+		if ended {
+			return
+		}
+		select {
+		case <-s.ready:
+		case <-s.done:
+			return
+		}
+	}
+}
+
+func (s *redisSubscription) Close() error {
+	s.stop.Do(func() { close(s.done) })
+	return s.ps.Close()
+}
+
+// Presence is kept per user as a sorted set of the server instances holding a
+// connection for them, scored by when that entry expires. A user is online
+// while any entry is unexpired, so an instance that dies without cleaning up
+// stops counting once its last heartbeat runs out. presenceUsersKey scores
+// every user with entries by when the last of them runs out, which lets
+// ExpirePresence find the users such an instance left behind.
+const presenceUsersKey = "presence_users"
+
+var setPresenceScript = redis.NewScript(`
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', ARGV[1])
+local n = redis.call('ZCARD', KEYS[1])
+redis.call('ZADD', KEYS[1], ARGV[2], ARGV[3])
+redis.call('PEXPIRE', KEYS[1], ARGV[4])
+local last = redis.call('ZRANGE', KEYS[1], -1, -1, 'WITHSCORES')
+redis.call('ZADD', KEYS[2], last[2], ARGV[5])
+return n
+`)
+
+var removePresenceScript = redis.NewScript(`
+redis.call('ZREM', KEYS[1], ARGV[2])
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', ARGV[1])
+if redis.call('ZCARD', KEYS[1]) == 0 then
+	redis.call('SET', KEYS[2], ARGV[1])
+	redis.call('ZREM', KEYS[3], ARGV[3])
+	return 1
+end
+local last = redis.call('ZRANGE', KEYS[1], -1, -1, 'WITHSCORES')
+redis.call('ZADD', KEYS[3], last[2], ARGV[3])
+return 0
+`)
+
+// expirePresenceScript returns when the user's last entry ran out, or nil if
+// the user came back or was swept by another instance meanwhile.
+var expirePresenceScript = redis.NewScript(`
+local last = redis.call('ZSCORE', KEYS[3], ARGV[2])
+if not last or tonumber(last) > tonumber(ARGV[1]) then
+	return false
+end
+redis.call('ZREM', KEYS[3], ARGV[2])
+redis.call('DEL', KEYS[1])
+redis.call('SET', KEYS[2], last)
+return last
+`)
+
+// SetPresence records that instance holds a connection for the user until ttl
+// from now. It reports whether the user was offline before.
+func (r *RedisClient) SetPresence(ctx context.Context, userID, instance string, ttl time.Duration) (bool, error) {
+	now := time.Now()
+	keys := []string{fmt.Sprintf("presence:%s", userID), presenceUsersKey}
+	n, err := setPresenceScript.Run(ctx, r.c, keys, now.UnixMilli(), now.Add(ttl).UnixMilli(), instance, ttl.Milliseconds(), userID).Int()
+	return n == 0, err
+}
+
+// RemovePresence drops the instance's entry. When no other instance holds a
+// connection the user's last seen time is recorded and true is returned.
+func (r *RedisClient) RemovePresence(ctx context.Context, userID, instance string) (bool, error) {
+	keys := []string{fmt.Sprintf("presence:%s", userID), fmt.Sprintf("last_seen:%s", userID), presenceUsersKey}
+	n, err := removePresenceScript.Run(ctx, r.c, keys, time.Now().UnixMilli(), instance, userID).Int()
+	return n == 1, err
+}
+
+// ExpirePresence finds the users whose entries all ran out by now and records
+// when they were last seen. Each user is claimed atomically, so of several
+// instances sweeping at once only one reports them.
+func (r *RedisClient) ExpirePresence(ctx context.Context, now time.Time) (userIDs []string, lastSeen []time.Time, err error) {
+	stale, err := r.c.ZRangeByScore(ctx, presenceUsersKey, &redis.ZRangeBy{Min: "-inf", Max: fmt.Sprint(now.UnixMilli())}).Result()
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, id := range stale {
+		keys := []string{fmt.Sprintf("presence:%s", id), fmt.Sprintf("last_seen:%s", id), presenceUsersKey}
+		last, err := expirePresenceScript.Run(ctx, r.c, keys, now.UnixMilli(), id).Int64()
+		if err == redis.Nil {
+			continue
+		}
+		if err != nil {
+			return userIDs, lastSeen, err
+		}
+		userIDs, lastSeen = append(userIDs, id), append(lastSeen, time.UnixMilli(last))
+	}
+	return userIDs, lastSeen, nil
+}
+
+// GetPresence looks up several users at once. lastSeen is zero for users who
+// are online or were never seen.
+func (r *RedisClient) GetPresence(ctx context.Context, userIDs []string) (online []bool, lastSeen []time.Time, err error) {
+	now := fmt.Sprint(time.Now().UnixMilli())
+	pipe := r.c.Pipeline()
+	counts := make([]*redis.IntCmd, len(userIDs))
+	seen := make([]*redis.StringCmd, len(userIDs))
+	for i, id := range userIDs {
+		counts[i] = pipe.ZCount(ctx, fmt.Sprintf("presence:%s", id), "("+now, "+inf")
+		seen[i] = pipe.Get(ctx, fmt.Sprintf("last_seen:%s", id))
+	}
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return nil, nil, err
+	}
+	online = make([]bool, len(userIDs))
+	lastSeen = make([]time.Time, len(userIDs))
+	for i := range userIDs {
+		online[i] = counts[i].Val() > 0
+		if ms, err := seen[i].Int64(); err == nil && !online[i] {
+			lastSeen[i] = time.UnixMilli(ms)
+		}
+	}
+	return online, lastSeen, nil
+}
+
+// RevokeToken denylists a single access token until it would have expired anyway.
+func (r *RedisClient) RevokeToken(ctx context.Context, jti string, ttl time.Duration) error {
+	if ttl <= 0 {
+		return nil
+	}
+	return r.c.Set(ctx, fmt.Sprintf("revoked:jti:%s", jti), 1, ttl).Err()
 }
 
-func (r *RedisClient) SetPresence(ctx context.Context, userID string, ttl time.Duration) error {
-	return r.c.Set(ctx, fmt.Sprintf("presence:%s", userID), "online", ttl).Err()
+// RevokeSessionTokens denylists every access token issued for a session. ttl
+// must cover the lifetime of the longest lived access token.
+func (r *RedisClient) RevokeSessionTokens(ctx context.Context, sessionID string, ttl time.Duration) error {
+	return r.c.Set(ctx, fmt.Sprintf("revoked:sid:%s", sessionID), 1, ttl).Err()
 }
 
-func (r *RedisClient) RemovePresence(ctx context.Context, userID string) error {
-	return r.c.Del(ctx, fmt.Sprintf("presence:%s", userID)).Err()
+// IsRevoked reports whether the token or its session has been denylisted.
+func (r *RedisClient) IsRevoked(ctx context.Context, jti, sessionID string) (bool, error) {
+	n, err := r.c.Exists(ctx, fmt.Sprintf("revoked:jti:%s", jti), fmt.Sprintf("revoked:sid:%s", sessionID)).Result()
+	return n > 0, err
 }
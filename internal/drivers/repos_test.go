@@ -0,0 +1,722 @@
+package drivers
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"example.com/go-chat/internal/core"
+	"github.com/google/uuid"
+)
+
+func TestMemoryRepositories(t *testing.T) {
+	testRepositories(t, func(t *testing.T) core.Repositories { return NewMemory() })
+}
+
+func TestPostgresRepositories(t *testing.T) {
+	pg := testPostgres(t)
+	m, err := NewMigrator(pg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Up(context.Background(), 0); err != nil {
+		t.Fatalf("Up: %v", err)
+	}
+	testRepositories(t, func(t *testing.T) core.Repositories {
+		err := pg.db.Exec(`TRUNCATE users, groups, messages, group_members, group_invites, group_join_requests,
+			sessions, refresh_tokens, message_receipts, read_cursors, message_edits, reactions, attachments CASCADE`).Error
+		if err != nil {
+			t.Fatal(err)
+		}
+		return NewRepositories(pg)
+	})
+}
+
+// testRepositories checks the behaviour the usecases rely on, so that every
+// driver can be held to it. newRepos returns empty repositories.
+func testRepositories(t *testing.T, newRepos func(t *testing.T) core.Repositories) {
+	t.Run("Users", func(t *testing.T) { testUsers(t, newRepos(t)) })
+	t.Run("Groups", func(t *testing.T) { testGroups(t, newRepos(t)) })
+	t.Run("InvitesAndJoinRequests", func(t *testing.T) { testInvitesAndJoinRequests(t, newRepos(t)) })
+	t.Run("History", func(t *testing.T) { testHistory(t, newRepos(t)) })
+	t.Run("EditAndDelete", func(t *testing.T) { testEditAndDelete(t, newRepos(t)) })
+	t.Run("Attachments", func(t *testing.T) { testAttachments(t, newRepos(t)) })
+	t.Run("Reactions", func(t *testing.T) { testReactions(t, newRepos(t)) })
+	t.Run("ReceiptsAndConversations", func(t *testing.T) { testReceiptsAndConversations(t, newRepos(t)) })
+	t.Run("Search", func(t *testing.T) { testSearch(t, newRepos(t)) })
+	t.Run("Sessions", func(t *testing.T) { testSessions(t, newRepos(t)) })
+}
+
+func newUser(t *testing.T, r core.Repositories, name string) *core.User {
+	t.Helper()
+	u := &core.User{Username: name, Email: name + "@example.com"}
+	if err := r.UserRepo().CreateUser(context.Background(), u, "password-"+name); err != nil {
+		t.Fatalf("CreateUser %s: %v", name, err)
+	}
+	return u
+}
+
+func newGroup(t *testing.T, r core.Repositories, owner *core.User, members ...*core.User) *core.Group {
+	t.Helper()
+	ctx := context.Background()
+	g := &core.Group{Name: "group", OwnerID: owner.ID, Visibility: core.VisibilityPublic}
+	if err := r.GroupRepo().CreateGroup(ctx, g); err != nil {
+		t.Fatalf("CreateGroup: %v", err)
+	}
+	if err := r.GroupRepo().AddGroupMember(ctx, g.ID, owner.ID, core.RoleOwner); err != nil {
+		t.Fatalf("AddGroupMember: %v", err)
+	}
+	for _, u := range members {
+		if err := r.GroupRepo().AddGroupMember(ctx, g.ID, u.ID, core.RoleMember); err != nil {
+			t.Fatalf("AddGroupMember: %v", err)
+		}
+	}
+	return g
+}
+
+// send saves m. It waits for the clock to pass a microsecond first, so that
+// messages sent one after the other are ordered by when they were sent.
+func send(t *testing.T, r core.Repositories, m *core.Message) *core.Message {
+	t.Helper()
+	time.Sleep(time.Microsecond)
+	if err := r.MessageRepo().SaveMessage(context.Background(), m); err != nil {
+		t.Fatalf("SaveMessage: %v", err)
+	}
+	return m
+}
+
+func sendPrivate(t *testing.T, r core.Repositories, from, to *core.User, content string) *core.Message {
+	t.Helper()
+	return send(t, r, &core.Message{SenderID: from.ID, RecipientID: &to.ID, Content: content})
+}
+
+func sendGroup(t *testing.T, r core.Repositories, from *core.User, g *core.Group, content string) *core.Message {
+	t.Helper()
+	return send(t, r, &core.Message{SenderID: from.ID, GroupID: &g.ID, Content: content})
+}
+
+func contents(msgs []core.Message) []string {
+	out := make([]string, len(msgs))
+	for i, m := range msgs {
+		out[i] = m.Content
+	}
+	return out
+}
+
+func sortedIDs(ids []uuid.UUID) []uuid.UUID {
+	ids = slices.Clone(ids)
+	slices.SortFunc(ids, func(a, b uuid.UUID) int { return strings.Compare(a.String(), b.String()) })
+	return ids
+}
+
+func testUsers(t *testing.T, r core.Repositories) {
+	ctx := context.Background()
+	users := r.UserRepo()
+	alice, bob, carol := newUser(t, r, "alice"), newUser(t, r, "bob"), newUser(t, r, "carol")
+	newUser(t, r, "dave")
+
+	if err := users.CreateUser(ctx, &core.User{Username: "alice2", Email: alice.Email}, "pw"); !errors.Is(err, core.ErrEmailTaken) {
+		t.Errorf("CreateUser with a taken email: got %v, want ErrEmailTaken", err)
+	}
+	if u, err := users.GetUserByEmail(ctx, alice.Email); err != nil || u.ID != alice.ID {
+		t.Errorf("GetUserByEmail: got %+v, %v", u, err)
+	}
+	if u, err := users.GetUserByID(ctx, bob.ID); err != nil || u.Username != "bob" {
+		t.Errorf("GetUserByID: got %+v, %v", u, err)
+	}
+	if _, err := users.GetUserByID(ctx, uuid.New()); !errors.Is(err, core.ErrNotFound) {
+		t.Errorf("GetUserByID of an unknown id: got %v, want ErrNotFound", err)
+	}
+	if _, err := users.GetUserByEmail(ctx, "nobody@example.com"); !errors.Is(err, core.ErrNotFound) {
+		t.Errorf("GetUserByEmail of an unknown email: got %v, want ErrNotFound", err)
+	}
+
+	if u, err := users.VerifyPassword(ctx, alice.Email, "password-alice"); err != nil || u.ID != alice.ID {
+		t.Errorf("VerifyPassword: got %+v, %v", u, err)
+	}
+	if _, err := users.VerifyPassword(ctx, alice.Email, "wrong"); !errors.Is(err, core.ErrInvalidCredentials) {
+		t.Errorf("VerifyPassword with a wrong password: got %v, want ErrInvalidCredentials", err)
+	}
+	if _, err := users.VerifyPassword(ctx, "nobody@example.com", "wrong"); !errors.Is(err, core.ErrInvalidCredentials) {
+		t.Errorf("VerifyPassword of an unknown email: got %v, want ErrInvalidCredentials", err)
+	}
+
+	newGroup(t, r, alice, bob)
+	sendPrivate(t, r, carol, alice, "hi")
+	contacts, err := users.ListContacts(ctx, alice.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := sortedIDs(contacts), sortedIDs([]uuid.UUID{bob.ID, carol.ID}); !slices.Equal(got, want) {
+		t.Errorf("ListContacts: got %v, want %v", got, want)
+	}
+}
+
+func testGroups(t *testing.T, r core.Repositories) {
+	ctx := context.Background()
+	groups := r.GroupRepo()
+	alice, bob, carol := newUser(t, r, "alice"), newUser(t, r, "bob"), newUser(t, r, "carol")
+	g := newGroup(t, r, alice, bob)
+	// adding a member twice keeps the first role
+	if err := groups.AddGroupMember(ctx, g.ID, bob.ID, core.RoleAdmin); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, err := groups.GetGroup(ctx, g.ID); err != nil || got.Name != "group" || got.OwnerID != alice.ID {
+		t.Errorf("GetGroup: got %+v, %v", got, err)
+	}
+	if _, err := groups.GetGroup(ctx, uuid.New()); !errors.Is(err, core.ErrNotFound) {
+		t.Errorf("GetGroup of an unknown id: got %v, want ErrNotFound", err)
+	}
+	if m, err := groups.GetMember(ctx, g.ID, bob.ID); err != nil || m.Role != core.RoleMember {
+		t.Errorf("GetMember: got %+v, %v", m, err)
+	}
+	if _, err := groups.GetMember(ctx, g.ID, carol.ID); !errors.Is(err, core.ErrNotFound) {
+		t.Errorf("GetMember of a non-member: got %v, want ErrNotFound", err)
+	}
+	if ok, err := groups.IsMember(ctx, g.ID, carol.ID); err != nil || ok {
+		t.Errorf("IsMember of a non-member: got %v, %v", ok, err)
+	}
+
+	mine, err := groups.MyGroups(ctx, bob.ID)
+	if err != nil || len(mine) != 1 || mine[0].ID != g.ID || mine[0].Owner == nil || mine[0].Owner.ID != alice.ID {
+		t.Errorf("MyGroups: got %+v, %v", mine, err)
+	}
+	members, err := groups.ListGroupMembers(ctx, g.ID)
+	if err != nil || len(members) != 2 || members[0].UserID != alice.ID || members[1].User == nil || members[1].User.Username != "bob" {
+		t.Errorf("ListGroupMembers: got %+v, %v", members, err)
+	}
+
+	if err := groups.SetMemberRole(ctx, g.ID, carol.ID, core.RoleAdmin); !errors.Is(err, core.ErrNotFound) {
+		t.Errorf("SetMemberRole of a non-member: got %v, want ErrNotFound", err)
+	}
+	if err := groups.TransferOwnership(ctx, g.ID, carol.ID); !errors.Is(err, core.ErrNotFound) {
+		t.Errorf("TransferOwnership to a non-member: got %v, want ErrNotFound", err)
+	}
+	if m, _ := groups.GetMember(ctx, g.ID, alice.ID); m == nil || m.Role != core.RoleOwner {
+		t.Errorf("failed TransferOwnership changed the owner's role: %+v", m)
+	}
+	if err := groups.TransferOwnership(ctx, g.ID, bob.ID); err != nil {
+		t.Fatal(err)
+	}
+	if m, _ := groups.GetMember(ctx, g.ID, alice.ID); m == nil || m.Role != core.RoleAdmin {
+		t.Errorf("previous owner after TransferOwnership: %+v", m)
+	}
+	if m, _ := groups.GetMember(ctx, g.ID, bob.ID); m == nil || m.Role != core.RoleOwner {
+		t.Errorf("new owner after TransferOwnership: %+v", m)
+	}
+	if got, _ := groups.GetGroup(ctx, g.ID); got == nil || got.OwnerID != bob.ID {
+		t.Errorf("group after TransferOwnership: %+v", got)
+	}
+
+	g.Name, g.OwnerID, g.Visibility = "renamed", bob.ID, core.VisibilityPrivate
+	if err := groups.UpdateGroup(ctx, g); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := groups.GetGroup(ctx, g.ID); got == nil || got.Name != "renamed" || got.OwnerID != bob.ID || got.Visibility != core.VisibilityPrivate {
+		t.Errorf("UpdateGroup: got %+v", got)
+	}
+
+	if err := groups.RemoveGroupMember(ctx, g.ID, alice.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := groups.RemoveGroupMember(ctx, g.ID, alice.ID); err != nil {
+		t.Errorf("RemoveGroupMember of a non-member: %v", err)
+	}
+	if ok, _ := groups.IsMember(ctx, g.ID, alice.ID); ok {
+		t.Error("removed member is still a member")
+	}
+
+	m := sendGroup(t, r, bob, g, "bye")
+	if err := groups.DeleteGroup(ctx, g.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := groups.GetGroup(ctx, g.ID); !errors.Is(err, core.ErrNotFound) {
+		t.Errorf("GetGroup after DeleteGroup: got %v, want ErrNotFound", err)
+	}
+	if _, err := r.MessageRepo().GetMessage(ctx, m.ID); !errors.Is(err, core.ErrNotFound) {
+		t.Errorf("GetMessage after DeleteGroup: got %v, want ErrNotFound", err)
+	}
+	if mine, _ := groups.MyGroups(ctx, bob.ID); len(mine) != 0 {
+		t.Errorf("MyGroups after DeleteGroup: got %+v", mine)
+	}
+}
+
+func testInvitesAndJoinRequests(t *testing.T, r core.Repositories) {
+	ctx := context.Background()
+	groups := r.GroupRepo()
+	alice, bob := newUser(t, r, "alice"), newUser(t, r, "bob")
+	g, other := newGroup(t, r, alice), newGroup(t, r, bob)
+	now := time.Now()
+	past := now.Add(-time.Minute)
+
+	once := &core.GroupInvite{Token: "once", GroupID: g.ID, CreatedBy: alice.ID, MaxUses: 1}
+	expired := &core.GroupInvite{Token: "expired", GroupID: g.ID, CreatedBy: alice.ID, ExpiresAt: &past}
+	for _, inv := range []*core.GroupInvite{once, expired} {
+		time.Sleep(time.Microsecond)
+		if err := groups.CreateInvite(ctx, inv); err != nil {
+			t.Fatal(err)
+		}
+	}
+	invites, err := groups.ListInvites(ctx, g.ID)
+	if err != nil || len(invites) != 2 || invites[0].Token != "expired" {
+		t.Errorf("ListInvites: got %+v, %v, want newest first", invites, err)
+	}
+
+	if inv, err := groups.GetInvite(ctx, "once"); err != nil || inv.Uses != 0 || inv.GroupID != g.ID {
+		t.Errorf("GetInvite: got %+v, %v", inv, err)
+	}
+	if _, err := groups.GetInvite(ctx, "unknown"); !errors.Is(err, core.ErrInvalidInvite) {
+		t.Errorf("GetInvite of an unknown token: got %v, want ErrInvalidInvite", err)
+	}
+	if inv, err := groups.UseInvite(ctx, "once", now); err != nil || inv.Uses != 1 || inv.GroupID != g.ID {
+		t.Errorf("UseInvite: got %+v, %v", inv, err)
+	}
+	for _, token := range []string{"once", "expired", "unknown"} {
+		if _, err := groups.UseInvite(ctx, token, now); !errors.Is(err, core.ErrInvalidInvite) {
+			t.Errorf("UseInvite(%q): got %v, want ErrInvalidInvite", token, err)
+		}
+	}
+	if err := groups.DeleteInvite(ctx, other.ID, "once"); !errors.Is(err, core.ErrInvalidInvite) {
+		t.Errorf("DeleteInvite from another group: got %v, want ErrInvalidInvite", err)
+	}
+	if err := groups.DeleteInvite(ctx, g.ID, "once"); err != nil {
+		t.Fatal(err)
+	}
+	if invites, _ := groups.ListInvites(ctx, g.ID); len(invites) != 1 {
+		t.Errorf("ListInvites after DeleteInvite: got %+v", invites)
+	}
+
+	req := &core.GroupJoinRequest{GroupID: g.ID, UserID: bob.ID, Status: core.JoinRequestPending}
+	if err := groups.SaveJoinRequest(ctx, req); err != nil {
+		t.Fatal(err)
+	}
+	reqs, err := groups.ListJoinRequests(ctx, g.ID, core.JoinRequestPending)
+	if err != nil || len(reqs) != 1 || reqs[0].User == nil || reqs[0].User.ID != bob.ID {
+		t.Errorf("ListJoinRequests: got %+v, %v", reqs, err)
+	}
+	if err := groups.DecideJoinRequest(ctx, g.ID, bob.ID, alice.ID, core.JoinRequestRejected); err != nil {
+		t.Fatal(err)
+	}
+	if err := groups.DecideJoinRequest(ctx, g.ID, bob.ID, alice.ID, core.JoinRequestApproved); !errors.Is(err, core.ErrNoJoinRequest) {
+		t.Errorf("DecideJoinRequest of a decided request: got %v, want ErrNoJoinRequest", err)
+	}
+	reqs, _ = groups.ListJoinRequests(ctx, g.ID, core.JoinRequestRejected)
+	if len(reqs) != 1 || reqs[0].DecidedBy == nil || *reqs[0].DecidedBy != alice.ID || reqs[0].DecidedAt == nil {
+		t.Errorf("rejected requests: got %+v", reqs)
+	}
+	// asking again resets the request
+	req.DecidedBy, req.DecidedAt = nil, nil
+	if err := groups.SaveJoinRequest(ctx, req); err != nil {
+		t.Fatal(err)
+	}
+	reqs, _ = groups.ListJoinRequests(ctx, g.ID, core.JoinRequestPending)
+	if len(reqs) != 1 || reqs[0].DecidedBy != nil {
+		t.Errorf("pending requests after asking again: got %+v", reqs)
+	}
+}
+
+func testHistory(t *testing.T, r core.Repositories) {
+	ctx := context.Background()
+	msgs := r.MessageRepo()
+	alice, bob, carol := newUser(t, r, "alice"), newUser(t, r, "bob"), newUser(t, r, "carol")
+	g := newGroup(t, r, alice, bob)
+
+	var sent []*core.Message
+	for _, content := range []string{"1", "2", "3", "4", "5"} {
+		sent = append(sent, sendPrivate(t, r, alice, bob, content))
+		if content == "3" {
+			sendPrivate(t, r, alice, carol, "other conversation")
+			sendGroup(t, r, alice, g, "group")
+		}
+	}
+
+	page, err := msgs.GetPrivateHistory(ctx, bob.ID, alice.ID, core.HistoryQuery{Limit: 2})
+	if err != nil || !slices.Equal(contents(page), []string{"5", "4"}) {
+		t.Errorf("latest page: got %v, %v", contents(page), err)
+	}
+	page, err = msgs.GetPrivateHistory(ctx, alice.ID, bob.ID, core.HistoryQuery{Before: core.CursorOf(sent[3]), Limit: 2})
+	if err != nil || !slices.Equal(contents(page), []string{"3", "2"}) {
+		t.Errorf("page before 4: got %v, %v", contents(page), err)
+	}
+	page, err = msgs.GetPrivateHistory(ctx, alice.ID, bob.ID, core.HistoryQuery{After: core.CursorOf(sent[0]), Limit: 2})
+	if err != nil || !slices.Equal(contents(page), []string{"3", "2"}) {
+		t.Errorf("page after 1: got %v, %v, want the oldest ones newest first", contents(page), err)
+	}
+	page, err = msgs.GetGroupHistory(ctx, g.ID, core.HistoryQuery{Limit: 10})
+	if err != nil || !slices.Equal(contents(page), []string{"group"}) {
+		t.Errorf("group history: got %v, %v", contents(page), err)
+	}
+
+	root := sent[0]
+	reply := send(t, r, &core.Message{SenderID: bob.ID, RecipientID: &alice.ID, Content: "reply",
+		ReplyToID: &sent[1].ID, ThreadRootID: &root.ID})
+	send(t, r, &core.Message{SenderID: alice.ID, RecipientID: &bob.ID, Content: "reply 2", ThreadRootID: &root.ID})
+	if m, err := msgs.GetMessage(ctx, root.ID); err != nil || m.ReplyCount != 2 {
+		t.Errorf("root after two replies: got %+v, %v", m, err)
+	}
+	thread, err := msgs.GetThread(ctx, root.ID, core.HistoryQuery{Limit: 10})
+	if err != nil || !slices.Equal(contents(thread), []string{"reply 2", "reply"}) {
+		t.Fatalf("GetThread: got %v, %v", contents(thread), err)
+	}
+	if q := thread[1].ReplyTo; q == nil || q.ID != sent[1].ID || q.Content != "2" {
+		t.Errorf("quoted message of %s: got %+v", reply.ID, q)
+	}
+	// a deleted reply no longer counts, and only once
+	for range 2 {
+		_ = msgs.DeleteMessage(ctx, &core.Message{ID: reply.ID}, bob.ID, time.Now())
+	}
+	if m, err := msgs.GetMessage(ctx, root.ID); err != nil || m.ReplyCount != 1 {
+		t.Errorf("root after deleting a reply: got %+v, %v", m, err)
+	}
+	if _, err := msgs.GetMessage(ctx, uuid.New()); !errors.Is(err, core.ErrNotFound) {
+		t.Errorf("GetMessage of an unknown id: got %v, want ErrNotFound", err)
+	}
+}
+
+func testEditAndDelete(t *testing.T, r core.Repositories) {
+	ctx := context.Background()
+	msgs := r.MessageRepo()
+	alice, bob := newUser(t, r, "alice"), newUser(t, r, "bob")
+	m := sendPrivate(t, r, alice, bob, "first")
+
+	at := time.Now().Truncate(time.Microsecond)
+	if err := msgs.EditMessage(ctx, m, "second", at); err != nil {
+		t.Fatal(err)
+	}
+	if err := msgs.EditMessage(ctx, m, "third", at.Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if m.Content != "third" || m.EditedAt == nil {
+		t.Errorf("EditMessage left %+v", m)
+	}
+	got, err := msgs.GetMessage(ctx, m.ID)
+	if err != nil || got.Content != "third" || got.EditedAt == nil || !got.EditedAt.Equal(at.Add(time.Second)) {
+		t.Errorf("GetMessage after EditMessage: got %+v, %v", got, err)
+	}
+	edits, err := msgs.ListEdits(ctx, m.ID)
+	if err != nil || len(edits) != 2 || edits[0].Content != "first" || edits[1].Content != "second" {
+		t.Errorf("ListEdits: got %+v, %v", edits, err)
+	}
+	if err := msgs.EditMessage(ctx, &core.Message{ID: uuid.New()}, "x", at); !errors.Is(err, core.ErrNotFound) {
+		t.Errorf("EditMessage of an unknown id: got %v, want ErrNotFound", err)
+	}
+
+	if _, err := r.ReactionRepo().AddReaction(ctx, &core.Reaction{MessageID: m.ID, UserID: bob.ID, Emoji: "👍"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := msgs.DeleteMessage(ctx, m, alice.ID, at); err != nil {
+		t.Fatal(err)
+	}
+	got, err = msgs.GetMessage(ctx, m.ID)
+	if err != nil || got.Content != "" || got.DeletedAt == nil || got.DeletedBy == nil || *got.DeletedBy != alice.ID {
+		t.Errorf("GetMessage after DeleteMessage: got %+v, %v", got, err)
+	}
+	if edits, _ := msgs.ListEdits(ctx, m.ID); len(edits) != 0 {
+		t.Errorf("edits survived DeleteMessage: %+v", edits)
+	}
+	if counts, _ := r.ReactionRepo().CountReactions(ctx, []uuid.UUID{m.ID}, bob.ID); len(counts[m.ID]) != 0 {
+		t.Errorf("reactions survived DeleteMessage: %+v", counts)
+	}
+	if err := msgs.EditMessage(ctx, m, "again", at); !errors.Is(err, core.ErrMessageDeleted) {
+		t.Errorf("EditMessage of a deleted message: got %v, want ErrMessageDeleted", err)
+	}
+	if err := msgs.DeleteMessage(ctx, m, alice.ID, at); !errors.Is(err, core.ErrMessageDeleted) {
+		t.Errorf("DeleteMessage twice: got %v, want ErrMessageDeleted", err)
+	}
+	// the tombstone stays in history
+	if page, _ := msgs.GetPrivateHistory(ctx, alice.ID, bob.ID, core.HistoryQuery{Limit: 10}); len(page) != 1 || page[0].DeletedAt == nil {
+		t.Errorf("history after DeleteMessage: got %+v", page)
+	}
+}
+
+func testAttachments(t *testing.T, r core.Repositories) {
+	ctx := context.Background()
+	atts, msgs := r.AttachmentRepo(), r.MessageRepo()
+	alice, bob := newUser(t, r, "alice"), newUser(t, r, "bob")
+	upload := func(by *core.User, name string) *core.Attachment {
+		t.Helper()
+		a := &core.Attachment{ID: uuid.New(), UploaderID: by.ID, FileName: name, ContentType: "text/plain", Size: 1}
+		a.StorageKey = "attachments/" + a.ID.String()
+		time.Sleep(time.Microsecond)
+		if err := atts.CreateAttachment(ctx, a); err != nil {
+			t.Fatal(err)
+		}
+		return a
+	}
+	a1, a2, bobs := upload(alice, "a1.txt"), upload(alice, "a2.txt"), upload(bob, "b.txt")
+
+	if got, err := atts.GetAttachment(ctx, a1.ID); err != nil || got.FileName != "a1.txt" || got.MessageID != nil {
+		t.Errorf("GetAttachment: got %+v, %v", got, err)
+	}
+	if _, err := atts.GetAttachment(ctx, uuid.New()); !errors.Is(err, core.ErrNotFound) {
+		t.Errorf("GetAttachment of an unknown id: got %v, want ErrNotFound", err)
+	}
+	listed, err := atts.ListAttachments(ctx, []uuid.UUID{a2.ID, uuid.New(), a1.ID})
+	if err != nil || len(listed) != 2 || listed[0].ID != a1.ID || listed[1].ID != a2.ID {
+		t.Errorf("ListAttachments: got %+v, %v", listed, err)
+	}
+
+	stolen := &core.Message{SenderID: alice.ID, RecipientID: &bob.ID, Content: "x", Attachments: []core.Attachment{*a1, *bobs}}
+	if err := msgs.SaveMessage(ctx, stolen); !errors.Is(err, core.ErrInvalidAttachment) {
+		t.Errorf("SaveMessage with someone else's attachment: got %v, want ErrInvalidAttachment", err)
+	}
+	if page, _ := msgs.GetPrivateHistory(ctx, alice.ID, bob.ID, core.HistoryQuery{Limit: 10}); len(page) != 0 {
+		t.Errorf("failed SaveMessage left a message: %+v", page)
+	}
+	if got, _ := atts.GetAttachment(ctx, a1.ID); got == nil || got.MessageID != nil {
+		t.Errorf("failed SaveMessage linked an attachment: %+v", got)
+	}
+
+	m := send(t, r, &core.Message{SenderID: alice.ID, RecipientID: &bob.ID, Attachments: []core.Attachment{*a2, *a1}})
+	linked, err := atts.MessageAttachments(ctx, m.ID)
+	if err != nil || len(linked) != 2 || linked[0].ID != a1.ID || linked[1].MessageID == nil || *linked[1].MessageID != m.ID {
+		t.Errorf("MessageAttachments: got %+v, %v", linked, err)
+	}
+	again := &core.Message{SenderID: alice.ID, RecipientID: &bob.ID, Attachments: []core.Attachment{*a1}}
+	if err := msgs.SaveMessage(ctx, again); !errors.Is(err, core.ErrInvalidAttachment) {
+		t.Errorf("SaveMessage with a sent attachment: got %v, want ErrInvalidAttachment", err)
+	}
+	page, err := msgs.GetPrivateHistory(ctx, bob.ID, alice.ID, core.HistoryQuery{Limit: 10})
+	if err != nil || len(page) != 1 || len(page[0].Attachments) != 2 || page[0].Attachments[0].ID != a1.ID {
+		t.Errorf("history with attachments: got %+v, %v", page, err)
+	}
+
+	got, err := atts.SetAttachmentPreview(ctx, a1.ID, 640, 480, true)
+	if err != nil || got.Width != 640 || got.Height != 480 || !got.Thumbnail || got.MessageID == nil {
+		t.Errorf("SetAttachmentPreview: got %+v, %v", got, err)
+	}
+	if _, err := atts.SetAttachmentPreview(ctx, uuid.New(), 1, 1, false); !errors.Is(err, core.ErrNotFound) {
+		t.Errorf("SetAttachmentPreview of an unknown id: got %v, want ErrNotFound", err)
+	}
+
+	if err := msgs.DeleteMessage(ctx, m, alice.ID, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := atts.GetAttachment(ctx, a1.ID); !errors.Is(err, core.ErrNotFound) {
+		t.Errorf("GetAttachment after DeleteMessage: got %v, want ErrNotFound", err)
+	}
+
+	g := newGroup(t, r, alice, bob)
+	ga, private := upload(alice, "g.txt"), upload(alice, "p.txt")
+	send(t, r, &core.Message{SenderID: alice.ID, GroupID: &g.ID, Attachments: []core.Attachment{*ga}})
+	send(t, r, &core.Message{SenderID: alice.ID, RecipientID: &bob.ID, Attachments: []core.Attachment{*private}})
+	inGroup, err := atts.GroupAttachments(ctx, g.ID)
+	if err != nil || len(inGroup) != 1 || inGroup[0].ID != ga.ID {
+		t.Errorf("GroupAttachments: got %+v, %v", inGroup, err)
+	}
+}
+
+func testReactions(t *testing.T, r core.Repositories) {
+	ctx := context.Background()
+	reactions := r.ReactionRepo()
+	alice, bob, carol := newUser(t, r, "alice"), newUser(t, r, "bob"), newUser(t, r, "carol")
+	g := newGroup(t, r, alice, bob, carol)
+	m, other := sendGroup(t, r, alice, g, "hi"), sendGroup(t, r, alice, g, "other")
+
+	add := func(u *core.User, emoji string, want bool) {
+		t.Helper()
+		time.Sleep(time.Microsecond)
+		added, err := reactions.AddReaction(ctx, &core.Reaction{MessageID: m.ID, UserID: u.ID, Emoji: emoji})
+		if err != nil || added != want {
+			t.Errorf("AddReaction(%s, %s): got %v, %v, want %v", u.Username, emoji, added, err, want)
+		}
+	}
+	add(alice, "🎉", true)
+	add(bob, "👍", true)
+	add(carol, "👍", true)
+	add(bob, "❤️", true)
+	add(bob, "👍", false)
+
+	counts, err := reactions.CountReactions(ctx, []uuid.UUID{m.ID, other.ID}, bob.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []core.ReactionCount{{Emoji: "👍", Count: 2, Me: true}, {Emoji: "🎉", Count: 1}, {Emoji: "❤️", Count: 1, Me: true}}
+	if !slices.Equal(counts[m.ID], want) || len(counts[other.ID]) != 0 {
+		t.Errorf("CountReactions: got %+v, want %+v", counts, want)
+	}
+
+	if removed, err := reactions.RemoveReaction(ctx, m.ID, bob.ID, "👍"); err != nil || !removed {
+		t.Errorf("RemoveReaction: got %v, %v", removed, err)
+	}
+	if removed, err := reactions.RemoveReaction(ctx, m.ID, bob.ID, "👍"); err != nil || removed {
+		t.Errorf("RemoveReaction twice: got %v, %v", removed, err)
+	}
+}
+
+func testReceiptsAndConversations(t *testing.T, r core.Repositories) {
+	ctx := context.Background()
+	receipts := r.ReceiptRepo()
+	alice, bob, carol := newUser(t, r, "alice"), newUser(t, r, "bob"), newUser(t, r, "carol")
+	g := newGroup(t, r, carol, bob)
+	p1 := sendPrivate(t, r, alice, bob, "1")
+	p2 := sendPrivate(t, r, alice, bob, "2")
+	sendPrivate(t, r, bob, alice, "mine")
+	p3 := sendPrivate(t, r, alice, bob, "3")
+	sendGroup(t, r, carol, g, "group")
+
+	convs, err := r.MessageRepo().ListConversations(ctx, bob.ID)
+	if err != nil || len(convs) != 2 {
+		t.Fatalf("ListConversations: got %+v, %v", convs, err)
+	}
+	if convs[0].Group == nil || convs[0].Group.ID != g.ID || convs[0].UnreadCount != 1 || convs[0].LastMessage.Content != "group" {
+		t.Errorf("group conversation: got %+v", convs[0])
+	}
+	if convs[1].Peer == nil || convs[1].Peer.ID != alice.ID || convs[1].UnreadCount != 3 || convs[1].LastMessage.ID != p3.ID {
+		t.Errorf("private conversation: got %+v", convs[1])
+	}
+	if !convs[1].LastActivity.Equal(p3.CreatedAt) {
+		t.Errorf("LastActivity: got %v, want %v", convs[1].LastActivity, p3.CreatedAt)
+	}
+
+	at := time.Now().Truncate(time.Microsecond)
+	if first, err := receipts.MarkDelivered(ctx, p3.ID, bob.ID, at); err != nil || !first {
+		t.Errorf("MarkDelivered: got %v, %v", first, err)
+	}
+	if first, err := receipts.MarkDelivered(ctx, p3.ID, bob.ID, at); err != nil || first {
+		t.Errorf("MarkDelivered twice: got %v, %v", first, err)
+	}
+
+	read, err := receipts.MarkRead(ctx, bob.ID, p2, at, 10)
+	if err != nil || !slices.Equal(contents(read), []string{"2", "1"}) {
+		t.Errorf("MarkRead up to 2: got %v, %v", contents(read), err)
+	}
+	if read, err := receipts.MarkRead(ctx, bob.ID, p1, at, 10); err != nil || len(read) != 0 {
+		t.Errorf("MarkRead behind the cursor: got %v, %v", contents(read), err)
+	}
+	later := at.Add(time.Second)
+	read, err = receipts.MarkRead(ctx, bob.ID, p3, later, 10)
+	if err != nil || !slices.Equal(contents(read), []string{"3"}) {
+		t.Errorf("MarkRead up to 3: got %v, %v, want only the messages it passed", contents(read), err)
+	}
+
+	list, err := receipts.ListReceipts(ctx, p3.ID)
+	if err != nil || len(list) != 1 || list[0].User == nil || list[0].User.ID != bob.ID ||
+		list[0].DeliveredAt == nil || !list[0].DeliveredAt.Equal(at) || list[0].ReadAt == nil || !list[0].ReadAt.Equal(later) {
+		t.Errorf("ListReceipts: got %+v, %v", list, err)
+	}
+	counts, err := receipts.CountReceipts(ctx, []uuid.UUID{p1.ID, p3.ID})
+	if err != nil || counts[p1.ID] != (core.ReceiptCounts{Delivered: 1, Read: 1}) || counts[p3.ID] != (core.ReceiptCounts{Delivered: 1, Read: 1}) {
+		t.Errorf("CountReceipts: got %+v, %v", counts, err)
+	}
+
+	convs, _ = r.MessageRepo().ListConversations(ctx, bob.ID)
+	if len(convs) != 2 || convs[1].UnreadCount != 0 {
+		t.Errorf("ListConversations after MarkRead: got %+v", convs)
+	}
+}
+
+func testSearch(t *testing.T, r core.Repositories) {
+	ctx := context.Background()
+	msgs := r.MessageRepo()
+	alice, bob, carol := newUser(t, r, "alice"), newUser(t, r, "bob"), newUser(t, r, "carol")
+	g := newGroup(t, r, alice, bob)
+	sendPrivate(t, r, alice, bob, "hello world")
+	sendGroup(t, r, bob, g, "goodbye cruel world")
+	sendPrivate(t, r, alice, carol, "hello carol")
+	deleted := sendPrivate(t, r, bob, alice, "hello again")
+	if err := msgs.DeleteMessage(ctx, deleted, bob.ID, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	search := func(user *core.User, text string, q core.SearchQuery) []string {
+		t.Helper()
+		q.Text, q.Limit = text, 10
+		hits, err := msgs.SearchMessages(ctx, user.ID, q)
+		if err != nil {
+			t.Fatalf("SearchMessages(%q): %v", text, err)
+		}
+		out := make([]string, len(hits))
+		for i, h := range hits {
+			out[i] = h.Message.Content
+		}
+		return out
+	}
+	cases := []struct {
+		user *core.User
+		text string
+		q    core.SearchQuery
+		want []string
+	}{
+		{bob, "hello", core.SearchQuery{}, []string{"hello world"}},
+		{alice, "HELLO", core.SearchQuery{}, []string{"hello carol", "hello world"}},
+		{bob, "world", core.SearchQuery{}, []string{"goodbye cruel world", "hello world"}},
+		{bob, "world -goodbye", core.SearchQuery{}, []string{"hello world"}},
+		{bob, `"cruel world"`, core.SearchQuery{}, []string{"goodbye cruel world"}},
+		{bob, `"world cruel"`, core.SearchQuery{}, []string{}},
+		{alice, "carol or goodbye", core.SearchQuery{}, []string{"hello carol", "goodbye cruel world"}},
+		{bob, "world", core.SearchQuery{GroupID: &g.ID}, []string{"goodbye cruel world"}},
+		{bob, "world", core.SearchQuery{SenderID: &alice.ID}, []string{"hello world"}},
+		{carol, "world", core.SearchQuery{}, []string{}},
+		{alice, "again", core.SearchQuery{}, []string{}},
+	}
+	for _, c := range cases {
+		if got := search(c.user, c.text, c.q); !slices.Equal(got, c.want) {
+			t.Errorf("%s searching %q with %+v: got %q, want %q", c.user.Username, c.text, c.q, got, c.want)
+		}
+	}
+
+	hits, err := msgs.SearchMessages(ctx, bob.ID, core.SearchQuery{Text: "hello", HistoryQuery: core.HistoryQuery{Limit: 10}})
+	if err != nil || len(hits) != 1 || !strings.Contains(hits[0].Snippet, "<mark>hello</mark>") {
+		t.Errorf("snippet: got %+v, %v", hits, err)
+	}
+}
+
+func testSessions(t *testing.T, r core.Repositories) {
+	ctx := context.Background()
+	sessions := r.SessionRepo()
+	alice := newUser(t, r, "alice")
+	now := time.Now().Truncate(time.Microsecond)
+	session := func(lastUsed time.Time) *core.Session {
+		t.Helper()
+		s := &core.Session{ID: uuid.New(), UserID: alice.ID, UserAgent: "test", CreatedAt: now, LastUsedAt: lastUsed, ExpiresAt: now.Add(time.Hour)}
+		if err := sessions.CreateSession(ctx, s); err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	older, newer := session(now.Add(-time.Minute)), session(now)
+	expired := session(now)
+	if err := sessions.TouchSession(ctx, expired.ID, now.Add(-2*time.Hour), now.Add(-time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	list, err := sessions.ListSessions(ctx, alice.ID, now)
+	if err != nil || len(list) != 2 || list[0].ID != newer.ID || list[1].ID != older.ID {
+		t.Errorf("ListSessions: got %+v, %v, want the newer session first", list, err)
+	}
+	if got, err := sessions.GetSession(ctx, expired.ID); err != nil || !got.ExpiresAt.Equal(now.Add(-time.Hour)) {
+		t.Errorf("GetSession after TouchSession: got %+v, %v", got, err)
+	}
+	if _, err := sessions.GetSession(ctx, uuid.New()); !errors.Is(err, core.ErrNotFound) {
+		t.Errorf("GetSession of an unknown id: got %v, want ErrNotFound", err)
+	}
+	if err := sessions.RevokeSession(ctx, older.ID, now); err != nil {
+		t.Fatal(err)
+	}
+	if err := sessions.RevokeSession(ctx, older.ID, now); !errors.Is(err, core.ErrNotFound) {
+		t.Errorf("RevokeSession twice: got %v, want ErrNotFound", err)
+	}
+	if list, _ := sessions.ListSessions(ctx, alice.ID, now); len(list) != 1 {
+		t.Errorf("ListSessions after RevokeSession: got %+v", list)
+	}
+
+	hash := strings.Repeat("a", 64)
+	err = sessions.SaveRefreshToken(ctx, &core.RefreshToken{Hash: hash, SessionID: newer.ID, ExpiresAt: now.Add(time.Hour), CreatedAt: now})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tok, err := sessions.ConsumeRefreshToken(ctx, hash, now); err != nil || tok.SessionID != newer.ID || tok.UsedAt == nil {
+		t.Errorf("ConsumeRefreshToken: got %+v, %v", tok, err)
+	}
+	if tok, err := sessions.ConsumeRefreshToken(ctx, hash, now); !errors.Is(err, core.ErrRefreshTokenReused) || tok == nil || tok.SessionID != newer.ID {
+		t.Errorf("ConsumeRefreshToken twice: got %+v, %v, want ErrRefreshTokenReused", tok, err)
+	}
+	if _, err := sessions.ConsumeRefreshToken(ctx, strings.Repeat("b", 64), now); !errors.Is(err, core.ErrInvalidRefreshToken) {
+		t.Errorf("ConsumeRefreshToken of an unknown token: got %v, want ErrInvalidRefreshToken", err)
+	}
+}
@@ -0,0 +1,93 @@
+package drivers
+
+import (
+	"context"
+	"io"
+	"mime"
+	"net/url"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+
+	"example.com/go-chat/internal/core"
+)
+
+// S3Config points an S3Store at AWS S3 or any compatible service such as MinIO.
+type S3Config struct {
+	Endpoint  string // host[:port], without scheme
+	AccessKey string
+	SecretKey string
+	Bucket    string
+	Region    string
+	UseSSL    bool
+}
+
+// S3Store is an AttachmentStore backed by an S3 compatible bucket. It also
+// signs download URLs so clients fetch content straight from the bucket.
+type S3Store struct {
+	c      *minio.Client
+	bucket string
+}
+
+// NewS3Store connects to the bucket, creating it when it doesn't exist.
+func NewS3Store(ctx context.Context, cfg S3Config) (*S3Store, error) {
+	c, err := minio.New(cfg.Endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(cfg.AccessKey, cfg.SecretKey, ""),
+		Secure: cfg.UseSSL,
+		Region: cfg.Region,
+	})
+	if err != nil {
+		return nil, err
+	}
+	exists, err := c.BucketExists(ctx, cfg.Bucket)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		if err := c.MakeBucket(ctx, cfg.Bucket, minio.MakeBucketOptions{Region: cfg.Region}); err != nil {
+			return nil, err
+		}
+	}
+	return &S3Store{c: c, bucket: cfg.Bucket}, nil
+}
+
+func (s *S3Store) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error {
+	_, err := s.c.PutObject(ctx, s.bucket, key, r, size, minio.PutObjectOptions{ContentType: contentType})
+	return err
+}
+
+func (s *S3Store) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	obj, err := s.c.GetObject(ctx, s.bucket, key, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, s3Error(err)
+	}
+	// GetObject is lazy; Stat surfaces a missing key before any byte is served
+	if _, err := obj.Stat(); err != nil {
+		obj.Close()
+		return nil, s3Error(err)
+	}
+	return obj, nil
+}
+
+func (s *S3Store) Delete(ctx context.Context, key string) error {
+	return s.c.RemoveObject(ctx, s.bucket, key, minio.RemoveObjectOptions{})
+}
+
+// SignedURL returns a presigned GET URL that downloads the object as fileName.
+func (s *S3Store) SignedURL(ctx context.Context, key, fileName string, ttl time.Duration) (string, error) {
+	params := url.Values{}
+	params.Set("response-content-disposition", mime.FormatMediaType("attachment", map[string]string{"filename": fileName}))
+	u, err := s.c.PresignedGetObject(ctx, s.bucket, key, ttl, params)
+	if err != nil {
+		return "", err
+	}
+	return u.String(), nil
+}
+
+func s3Error(err error) error {
+	if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+		return core.ErrNotFound
+	}
+	return err
+}
@@ -0,0 +1,58 @@
+package drivers
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+)
+
+// TestS3Store needs an S3 compatible service, e.g.
+//
+//	docker run -p 9000:9000 minio/minio server /data
+//	S3_TEST_ENDPOINT=localhost:9000 go test ./internal/drivers
+//
+// S3_TEST_ACCESS_KEY and S3_TEST_SECRET_KEY default to MinIO's.
+func TestS3Store(t *testing.T) {
+	endpoint := os.Getenv("S3_TEST_ENDPOINT")
+	if endpoint == "" {
+		t.Skip("S3_TEST_ENDPOINT not set")
+	}
+	cfg := S3Config{
+		Endpoint:  endpoint,
+		AccessKey: envOr("S3_TEST_ACCESS_KEY", "minioadmin"),
+		SecretKey: envOr("S3_TEST_SECRET_KEY", "minioadmin"),
+		Bucket:    "go-chat-test",
+	}
+	ctx := context.Background()
+	store, err := NewS3Store(ctx, cfg)
+	if err != nil {
+		t.Fatalf("NewS3Store: %v", err)
+	}
+	testAttachmentStore(t, store)
+
+	if err := store.Put(ctx, "attachments/signed", http.NoBody, 0, "text/plain"); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	defer store.Delete(ctx, "attachments/signed")
+	u, err := store.SignedURL(ctx, "attachments/signed", "a.txt", time.Minute)
+	if err != nil {
+		t.Fatalf("SignedURL: %v", err)
+	}
+	resp, err := http.Get(u)
+	if err != nil {
+		t.Fatalf("GET signed URL: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET signed URL: status %d", resp.StatusCode)
+	}
+}
+
+func envOr(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
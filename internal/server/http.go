@@ -1,7 +1,12 @@
 package server
 
 import (
+	"errors"
+	"mime"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
@@ -12,15 +17,19 @@ import (
 )
 
 type Handler struct {
-	repos core.Repositories
-	rds   *drivers.RedisClient
-	jwt   *drivers.JWTManager
-	authU *usecases.AuthUsecase
-	chatU *usecases.ChatUsecase
+	repos       core.Repositories
+	cluster     core.Cluster
+	jwt         *drivers.JWTManager
+	authU       *usecases.AuthUsecase
+	chatU       *usecases.ChatUsecase
+	groupU      *usecases.GroupUsecase
+	presenceU   *usecases.PresenceUsecase
+	receiptU    *usecases.ReceiptUsecase
+	attachmentU *usecases.AttachmentUsecase
 }
 
-func NewHandler(repos core.Repositories, rds *drivers.RedisClient, jwt *drivers.JWTManager) *Handler {
-	return &Handler{repos: repos, rds: rds, jwt: jwt, authU: usecases.NewAuthUsecase(repos, jwt), chatU: usecases.NewChatUsecase(repos, rds)}
+func NewHandler(repos core.Repositories, cluster core.Cluster, jwt *drivers.JWTManager, store core.AttachmentStore, thumbs *usecases.ThumbnailWorker) *Handler {
+	return &Handler{repos: repos, cluster: cluster, jwt: jwt, authU: usecases.NewAuthUsecase(repos, jwt, cluster, cluster), chatU: usecases.NewChatUsecase(repos, cluster, store), attachmentU: usecases.NewAttachmentUsecase(repos, store, thumbs), groupU: usecases.NewGroupUsecase(repos, cluster, store), presenceU: usecases.NewPresenceUsecase(repos, cluster, cluster), receiptU: usecases.NewReceiptUsecase(repos, cluster)}
 }
 
 func (h *Handler) SignUp(c *gin.Context) {
@@ -31,7 +40,7 @@ func (h *Handler) SignUp(c *gin.Context) {
 	}
 	u, err := h.authU.SignUp(c.Request.Context(), body.Username, body.Email, body.Password)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		c.JSON(errorStatus(err), gin.H{"error": err.Error()})
 		return
 	}
 	c.JSON(http.StatusCreated, u)
@@ -43,12 +52,78 @@ func (h *Handler) Login(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	token, user, err := h.authU.Login(c.Request.Context(), body.Email, body.Password)
+	device := usecases.Device{UserAgent: c.Request.UserAgent(), IP: c.ClientIP()}
+	pair, user, err := h.authU.Login(c.Request.Context(), body.Email, body.Password, device)
 	if err != nil {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
 		return
 	}
-	c.JSON(http.StatusOK, gin.H{"token": token, "user": user})
+	c.JSON(http.StatusOK, gin.H{"token": pair.AccessToken, "refresh_token": pair.RefreshToken, "expires_in": pair.ExpiresIn, "user": user})
+}
+
+func (h *Handler) Refresh(c *gin.Context) {
+	var body struct {
+		RefreshToken string `json:"refresh_token" binding:"required"`
+	}
+	if err := c.BindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	pair, err := h.authU.Refresh(c.Request.Context(), body.RefreshToken)
+	if err != nil {
+		c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, pair)
+}
+
+func (h *Handler) Logout(c *gin.Context) {
+	var body struct {
+		RefreshToken string `json:"refresh_token" binding:"required"`
+	}
+	if err := c.BindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := h.authU.Logout(c.Request.Context(), body.RefreshToken); err != nil {
+		c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	// the access token used for logout, if any, stops working right away
+	if tok, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer "); ok {
+		if claims, err := h.jwt.Verify(tok); err == nil {
+			h.authU.RevokeAccessToken(c.Request.Context(), claims)
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"ok": true})
+}
+
+func (h *Handler) ListSessions(c *gin.Context) {
+	idI, _ := c.Get("user_id")
+	uid := idI.(uuid.UUID)
+	sidI, _ := c.Get("session_id")
+	sid := sidI.(uuid.UUID)
+	sessions, err := h.authU.Sessions(c.Request.Context(), uid, sid)
+	if err != nil {
+		c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, sessions)
+}
+
+func (h *Handler) RevokeSession(c *gin.Context) {
+	sid, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return
+	}
+	idI, _ := c.Get("user_id")
+	uid := idI.(uuid.UUID)
+	if err := h.authU.RevokeSession(c.Request.Context(), uid, sid); err != nil {
+		c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"ok": true})
 }
 
 func (h *Handler) Me(c *gin.Context) {
@@ -62,29 +137,69 @@ func (h *Handler) Me(c *gin.Context) {
 	c.JSON(http.StatusOK, u)
 }
 
+func (h *Handler) GetPresence(c *gin.Context) {
+	uid, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return
+	}
+	idI, _ := c.Get("user_id")
+	p, err := h.presenceU.Get(c.Request.Context(), idI.(uuid.UUID), []uuid.UUID{uid})
+	if err != nil {
+		c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, p[0])
+}
+
+// BatchPresence looks up ?user_ids=a,b,c (at most usecases.MaxPresenceBatch).
+func (h *Handler) BatchPresence(c *gin.Context) {
+	var ids []uuid.UUID
+	for _, s := range strings.Split(c.Query("user_ids"), ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		id, err := uuid.Parse(s)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid user id"})
+			return
+		}
+		ids = append(ids, id)
+	}
+	idI, _ := c.Get("user_id")
+	p, err := h.presenceU.Get(c.Request.Context(), idI.(uuid.UUID), ids)
+	if err != nil {
+		c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, p)
+}
+
 func (h *Handler) CreateGroup(c *gin.Context) {
-	var body struct{ Name string }
+	var body struct {
+		Name       string
+		Visibility core.GroupVisibility
+	}
 	if err := c.BindJSON(&body); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 	idI, _ := c.Get("user_id")
 	owner := idI.(uuid.UUID)
-	g := &core.Group{Name: body.Name, OwnerID: owner}
-	if err := h.repos.GroupRepo().CreateGroup(c.Request.Context(), g); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	g, err := h.groupU.Create(c.Request.Context(), owner, body.Name, body.Visibility)
+	if err != nil {
+		c.JSON(errorStatus(err), gin.H{"error": err.Error()})
 		return
 	}
-	_ = h.repos.GroupRepo().AddGroupMember(c.Request.Context(), g.ID, owner)
 	c.JSON(http.StatusCreated, g)
 }
-func (h *Handler) MyGroups(c *gin.Context){
-	
+func (h *Handler) MyGroups(c *gin.Context) {
+
 	idI, _ := c.Get("user_id")
 	uid := idI.(uuid.UUID)
-	groups,err := h.repos.GroupRepo().MyGroups(c.Request.Context(),uid)
-	if err!=nil{
-		c.JSON(http.StatusNotFound, gin.H{"message":err.Error()})
+	groups, err := h.repos.GroupRepo().MyGroups(c.Request.Context(), uid)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"message": err.Error()})
 		return
 	}
 	c.JSON(http.StatusOK, groups)
@@ -97,13 +212,28 @@ func (h *Handler) JoinGroup(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
 		return
 	}
+	// the body is optional; it only carries an invite token for private groups
+	var body struct {
+		Token string `json:"token"`
+	}
+	if c.Request.ContentLength > 0 {
+		if err := c.BindJSON(&body); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
 	idI, _ := c.Get("user_id")
 	uid := idI.(uuid.UUID)
-	if err := h.repos.GroupRepo().AddGroupMember(c.Request.Context(), gid, uid); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	status, err := h.groupU.Join(c.Request.Context(), gid, uid, body.Token)
+	if err != nil {
+		c.JSON(errorStatus(err), gin.H{"error": err.Error()})
 		return
 	}
-	c.JSON(http.StatusOK, gin.H{"ok": true})
+	if status == usecases.JoinPending {
+		c.JSON(http.StatusAccepted, gin.H{"status": status})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"ok": true, "status": status})
 }
 
 func (h *Handler) ListGroupMembers(c *gin.Context) {
@@ -112,14 +242,127 @@ func (h *Handler) ListGroupMembers(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
 		return
 	}
-	members, err := h.repos.GroupRepo().ListGroupMembers(c.Request.Context(), gid)
+	idI, _ := c.Get("user_id")
+	uid := idI.(uuid.UUID)
+	members, err := h.groupU.Members(c.Request.Context(), uid, gid)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		c.JSON(errorStatus(err), gin.H{"error": err.Error()})
 		return
 	}
 	c.JSON(http.StatusOK, members)
 }
 
+func (h *Handler) UpdateGroup(c *gin.Context) {
+	gid, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return
+	}
+	var body struct {
+		Name       *string               `json:"name"`
+		Visibility *core.GroupVisibility `json:"visibility"`
+	}
+	if err := c.BindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	idI, _ := c.Get("user_id")
+	uid := idI.(uuid.UUID)
+	g, err := h.groupU.Update(c.Request.Context(), uid, gid, usecases.GroupChanges{Name: body.Name, Visibility: body.Visibility})
+	if err != nil {
+		c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, g)
+}
+
+func (h *Handler) DeleteGroup(c *gin.Context) {
+	gid, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return
+	}
+	idI, _ := c.Get("user_id")
+	uid := idI.(uuid.UUID)
+	if err := h.groupU.Delete(c.Request.Context(), uid, gid); err != nil {
+		c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"ok": true})
+}
+
+func (h *Handler) SetMemberRole(c *gin.Context) {
+	gid, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return
+	}
+	target, err := uuid.Parse(c.Param("user_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid user id"})
+		return
+	}
+	var body struct {
+		Role core.GroupRole `json:"role" binding:"required"`
+	}
+	if err := c.BindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	idI, _ := c.Get("user_id")
+	uid := idI.(uuid.UUID)
+	if err := h.groupU.SetRole(c.Request.Context(), uid, gid, target, body.Role); err != nil {
+		c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"ok": true})
+}
+
+func (h *Handler) TransferGroupOwnership(c *gin.Context) {
+	gid, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return
+	}
+	var body struct {
+		UserID uuid.UUID `json:"user_id" binding:"required"`
+	}
+	if err := c.BindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	idI, _ := c.Get("user_id")
+	uid := idI.(uuid.UUID)
+	if err := h.groupU.TransferOwnership(c.Request.Context(), uid, gid, body.UserID); err != nil {
+		c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"ok": true})
+}
+
+func (h *Handler) RemoveGroupMember(c *gin.Context) {
+	gid, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return
+	}
+	idI, _ := c.Get("user_id")
+	uid := idI.(uuid.UUID)
+	// "me" leaves the group
+	target := uid
+	if p := c.Param("user_id"); p != "me" {
+		if target, err = uuid.Parse(p); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid user id"})
+			return
+		}
+	}
+	if err := h.groupU.RemoveMember(c.Request.Context(), uid, gid, target); err != nil {
+		c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"ok": true})
+}
+
 func (h *Handler) GetPrivateHistory(c *gin.Context) {
 	other := c.Query("user_id")
 	if other == "" {
@@ -131,12 +374,16 @@ func (h *Handler) GetPrivateHistory(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid user id"})
 		return
 	}
+	q, err := historyQuery(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
 	idI, _ := c.Get("user_id")
 	selfID := idI.(uuid.UUID)
-	limit := 50
-	msgs, err := h.chatU.GetPrivateHistory(c.Request.Context(), selfID, otherID, limit)
+	msgs, err := h.chatU.GetPrivateHistory(c.Request.Context(), selfID, otherID, q)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		c.JSON(errorStatus(err), gin.H{"error": err.Error()})
 		return
 	}
 	c.JSON(http.StatusOK, msgs)
@@ -148,10 +395,325 @@ func (h *Handler) GetGroupHistory(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
 		return
 	}
-	msgs, err := h.chatU.GetGroupHistory(c.Request.Context(), gid, 50)
+	q, err := historyQuery(c)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	idI, _ := c.Get("user_id")
+	uid := idI.(uuid.UUID)
+	msgs, err := h.chatU.GetGroupHistory(c.Request.Context(), uid, gid, q)
+	if err != nil {
+		c.JSON(errorStatus(err), gin.H{"error": err.Error()})
 		return
 	}
 	c.JSON(http.StatusOK, msgs)
 }
+
+// SearchMessages takes the search text in q and optionally sender_id,
+// group_id, and since/until as RFC 3339 times, plus the history paging params.
+func (h *Handler) SearchMessages(c *gin.Context) {
+	hq, err := historyQuery(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	q := core.SearchQuery{Text: c.Query("q"), HistoryQuery: hq}
+	for param, dst := range map[string]**uuid.UUID{"sender_id": &q.SenderID, "group_id": &q.GroupID} {
+		if v := c.Query(param); v != "" {
+			id, err := uuid.Parse(v)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "invalid " + param})
+				return
+			}
+			*dst = &id
+		}
+	}
+	for param, dst := range map[string]**time.Time{"since": &q.Since, "until": &q.Until} {
+		if v := c.Query(param); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "invalid " + param})
+				return
+			}
+			*dst = &t
+		}
+	}
+	idI, _ := c.Get("user_id")
+	uid := idI.(uuid.UUID)
+	page, err := h.chatU.Search(c.Request.Context(), uid, q)
+	if err != nil {
+		c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, page)
+}
+
+func (h *Handler) ReplyToMessage(c *gin.Context) {
+	mid, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return
+	}
+	var req struct {
+		Content string `json:"content" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	idI, _ := c.Get("user_id")
+	uid := idI.(uuid.UUID)
+	m, err := h.chatU.Reply(c.Request.Context(), uid, mid, req.Content)
+	if err != nil {
+		c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusCreated, m)
+}
+
+func (h *Handler) GetThread(c *gin.Context) {
+	mid, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return
+	}
+	q, err := historyQuery(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	idI, _ := c.Get("user_id")
+	uid := idI.(uuid.UUID)
+	page, err := h.chatU.Thread(c.Request.Context(), uid, mid, q)
+	if err != nil {
+		c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, page)
+}
+
+func (h *Handler) EditMessage(c *gin.Context) {
+	mid, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return
+	}
+	var req struct {
+		Content string `json:"content" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	idI, _ := c.Get("user_id")
+	uid := idI.(uuid.UUID)
+	m, err := h.chatU.Edit(c.Request.Context(), uid, mid, req.Content)
+	if err != nil {
+		c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, m)
+}
+
+func (h *Handler) DeleteMessage(c *gin.Context) {
+	mid, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return
+	}
+	idI, _ := c.Get("user_id")
+	uid := idI.(uuid.UUID)
+	if _, err := h.chatU.Delete(c.Request.Context(), uid, mid); err != nil {
+		c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"ok": true})
+}
+
+func (h *Handler) ListMessageEdits(c *gin.Context) {
+	mid, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return
+	}
+	idI, _ := c.Get("user_id")
+	uid := idI.(uuid.UUID)
+	edits, err := h.chatU.Edits(c.Request.Context(), uid, mid)
+	if err != nil {
+		c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, edits)
+}
+
+// AddReaction and RemoveReaction take the emoji from the path, e.g.
+// PUT /api/messages/:id/reactions/%F0%9F%91%8D
+func (h *Handler) AddReaction(c *gin.Context)    { h.react(c, true) }
+func (h *Handler) RemoveReaction(c *gin.Context) { h.react(c, false) }
+
+func (h *Handler) react(c *gin.Context, add bool) {
+	mid, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return
+	}
+	idI, _ := c.Get("user_id")
+	uid := idI.(uuid.UUID)
+	if err := h.chatU.React(c.Request.Context(), uid, mid, c.Param("emoji"), add); err != nil {
+		c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"ok": true})
+}
+
+// UploadAttachment takes a multipart form with the file in "file" and returns
+// the attachment to reference when sending a message.
+func (h *Handler) UploadAttachment(c *gin.Context) {
+	// leave room for the multipart framing around the file
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, usecases.MaxAttachmentSize+1<<20)
+	fh, err := c.FormFile("file")
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": core.ErrAttachmentTooLarge.Error()})
+			return
+		}
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	f, err := fh.Open()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	defer f.Close()
+	idI, _ := c.Get("user_id")
+	uid := idI.(uuid.UUID)
+	att, err := h.attachmentU.Upload(c.Request.Context(), uid, fh.Filename, fh.Size, f)
+	if err != nil {
+		c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusCreated, att)
+}
+
+// DownloadAttachment redirects to a signed URL when the store supports them
+// and streams the file otherwise.
+func (h *Handler) DownloadAttachment(c *gin.Context) {
+	aid, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return
+	}
+	idI, _ := c.Get("user_id")
+	uid := idI.(uuid.UUID)
+	d, err := h.attachmentU.Download(c.Request.Context(), uid, aid)
+	if err != nil {
+		c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	serveDownload(c, d)
+}
+
+// DownloadThumbnail serves the thumbnail of an image attachment once it has
+// been made.
+func (h *Handler) DownloadThumbnail(c *gin.Context) {
+	aid, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return
+	}
+	idI, _ := c.Get("user_id")
+	uid := idI.(uuid.UUID)
+	d, err := h.attachmentU.Thumbnail(c.Request.Context(), uid, aid)
+	if err != nil {
+		c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	serveDownload(c, d)
+}
+
+func serveDownload(c *gin.Context, d *usecases.Download) {
+	if d.URL != "" {
+		c.Redirect(http.StatusFound, d.URL)
+		return
+	}
+	defer d.Body.Close()
+	c.DataFromReader(http.StatusOK, d.Size, d.ContentType, d.Body, map[string]string{
+		"Content-Disposition": mime.FormatMediaType("attachment", map[string]string{"filename": d.FileName}),
+	})
+}
+
+func (h *Handler) ListConversations(c *gin.Context) {
+	idI, _ := c.Get("user_id")
+	uid := idI.(uuid.UUID)
+	convs, err := h.chatU.Conversations(c.Request.Context(), uid)
+	if err != nil {
+		c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, convs)
+}
+
+func (h *Handler) ListReceipts(c *gin.Context) {
+	mid, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return
+	}
+	idI, _ := c.Get("user_id")
+	uid := idI.(uuid.UUID)
+	receipts, err := h.receiptU.Receipts(c.Request.Context(), uid, mid)
+	if err != nil {
+		c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, receipts)
+}
+
+// historyQuery reads the before/after cursors and limit shared by history endpoints.
+func historyQuery(c *gin.Context) (core.HistoryQuery, error) {
+	var q core.HistoryQuery
+	before, after := c.Query("before"), c.Query("after")
+	if before != "" && after != "" {
+		return q, errors.New("before and after are mutually exclusive")
+	}
+	var err error
+	if before != "" {
+		if q.Before, err = core.ParseCursor(before); err != nil {
+			return q, err
+		}
+	}
+	if after != "" {
+		if q.After, err = core.ParseCursor(after); err != nil {
+			return q, err
+		}
+	}
+	if l := c.Query("limit"); l != "" {
+		if q.Limit, err = strconv.Atoi(l); err != nil || q.Limit <= 0 {
+			return q, errors.New("invalid limit")
+		}
+	}
+	return q, nil
+}
+
+// errorStatus maps usecase errors to HTTP status codes.
+func errorStatus(err error) int {
+	switch {
+	case errors.Is(err, core.ErrUnauthorized):
+		return http.StatusUnauthorized
+	case errors.Is(err, core.ErrForbidden):
+		return http.StatusForbidden
+	case errors.Is(err, core.ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, core.ErrAttachmentTooLarge):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, core.ErrUnsupportedMediaType):
+		return http.StatusUnsupportedMediaType
+	case errors.Is(err, core.ErrInvalidInput):
+		return http.StatusBadRequest
+	default:
+		return http.StatusInternalServerError
+	}
+}
@@ -0,0 +1,91 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+
+	"example.com/go-chat/internal/core"
+	"example.com/go-chat/internal/core/usecases"
+	"example.com/go-chat/internal/drivers"
+)
+
+type stubRepos struct {
+	core.Repositories
+	groups *stubGroups
+}
+
+func (r *stubRepos) GroupRepo() core.GroupRepository { return r.groups }
+
+// stubGroups reports nobody as a group member.
+type stubGroups struct{ core.GroupRepository }
+
+func (stubGroups) IsMember(ctx context.Context, groupID, userID uuid.UUID) (bool, error) {
+	return false, nil
+}
+
+func TestGroupEndpointsForbidNonMembers(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	h := NewHandler(&stubRepos{groups: &stubGroups{}}, nil, nil, nil, nil)
+	r := gin.New()
+	r.Use(func(c *gin.Context) { c.Set("user_id", uuid.New()) })
+	r.GET("/groups/:id/messages", h.GetGroupHistory)
+	r.GET("/groups/:id/members", h.ListGroupMembers)
+
+	for _, path := range []string{"/groups/%s/messages", "/groups/%s/members"} {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, fmt.Sprintf(path, uuid.New()), nil)
+		r.ServeHTTP(w, req)
+		if w.Code != http.StatusForbidden {
+			t.Errorf("GET %s: status %d, want 403", path, w.Code)
+		}
+	}
+}
+
+func TestPrivateHistoryChecksThePeer(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	repos := drivers.NewMemory()
+	me := &core.User{Username: "me", Email: "me@example.com"}
+	if err := repos.UserRepo().CreateUser(context.Background(), me, "password"); err != nil {
+		t.Fatal(err)
+	}
+	h := NewHandler(repos, nil, nil, nil, nil)
+	r := gin.New()
+	r.Use(func(c *gin.Context) { c.Set("user_id", me.ID) })
+	r.GET("/messages", h.GetPrivateHistory)
+
+	for peer, want := range map[uuid.UUID]int{me.ID: http.StatusBadRequest, uuid.New(): http.StatusNotFound} {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/messages?user_id="+peer.String(), nil))
+		if w.Code != want {
+			t.Errorf("history with %s: status %d, want %d", peer, w.Code, want)
+		}
+	}
+}
+
+func TestWSGroupSendForbidsNonMembers(t *testing.T) {
+	chatU := usecases.NewChatUsecase(&stubRepos{groups: &stubGroups{}}, nil, nil)
+	c := &Client{send: make(chan []byte, 1), userID: uuid.New()}
+	gid := uuid.New()
+	payload, _ := json.Marshal(SendMessagePayload{GroupID: &gid, Content: "hi"})
+
+	c.handle(chatU, Envelope{V: ProtocolVersion, Type: FrameMessageSend, ID: "req-1", Payload: payload})
+
+	var env Envelope
+	if err := json.Unmarshal(<-c.send, &env); err != nil {
+		t.Fatal(err)
+	}
+	var p ErrorPayload
+	if err := json.Unmarshal(env.Payload, &p); err != nil {
+		t.Fatal(err)
+	}
+	if env.Type != FrameError || env.ID != "req-1" || p.Code != ErrCodeForbidden {
+		t.Fatalf("got %s id=%q code=%q, want error id=req-1 code=%s", env.Type, env.ID, p.Code, ErrCodeForbidden)
+	}
+}
@@ -0,0 +1,118 @@
+package server
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+func (h *Handler) CreateInvite(c *gin.Context) {
+	gid, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return
+	}
+	// expires_in is in seconds; zero values mean no expiry and unlimited uses
+	var body struct {
+		ExpiresIn int `json:"expires_in"`
+		MaxUses   int `json:"max_uses"`
+	}
+	if c.Request.ContentLength > 0 {
+		if err := c.BindJSON(&body); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	idI, _ := c.Get("user_id")
+	uid := idI.(uuid.UUID)
+	inv, err := h.groupU.CreateInvite(c.Request.Context(), uid, gid, time.Duration(body.ExpiresIn)*time.Second, body.MaxUses)
+	if err != nil {
+		c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusCreated, inv)
+}
+
+func (h *Handler) ListInvites(c *gin.Context) {
+	gid, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return
+	}
+	idI, _ := c.Get("user_id")
+	uid := idI.(uuid.UUID)
+	invites, err := h.groupU.Invites(c.Request.Context(), uid, gid)
+	if err != nil {
+		c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, invites)
+}
+
+func (h *Handler) RevokeInvite(c *gin.Context) {
+	gid, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return
+	}
+	idI, _ := c.Get("user_id")
+	uid := idI.(uuid.UUID)
+	if err := h.groupU.RevokeInvite(c.Request.Context(), uid, gid, c.Param("token")); err != nil {
+		c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"ok": true})
+}
+
+// AcceptInvite joins the group an invite link points to.
+func (h *Handler) AcceptInvite(c *gin.Context) {
+	idI, _ := c.Get("user_id")
+	uid := idI.(uuid.UUID)
+	g, err := h.groupU.JoinWithInvite(c.Request.Context(), uid, c.Param("token"))
+	if err != nil {
+		c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, g)
+}
+
+func (h *Handler) ListJoinRequests(c *gin.Context) {
+	gid, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return
+	}
+	idI, _ := c.Get("user_id")
+	uid := idI.(uuid.UUID)
+	reqs, err := h.groupU.JoinRequests(c.Request.Context(), uid, gid)
+	if err != nil {
+		c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, reqs)
+}
+
+func (h *Handler) ApproveJoinRequest(c *gin.Context) { h.decideJoinRequest(c, true) }
+func (h *Handler) RejectJoinRequest(c *gin.Context)  { h.decideJoinRequest(c, false) }
+
+func (h *Handler) decideJoinRequest(c *gin.Context, approve bool) {
+	gid, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return
+	}
+	target, err := uuid.Parse(c.Param("user_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid user id"})
+		return
+	}
+	idI, _ := c.Get("user_id")
+	uid := idI.(uuid.UUID)
+	if err := h.groupU.DecideJoinRequest(c.Request.Context(), uid, gid, target, approve); err != nil {
+		c.JSON(errorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"ok": true})
+}
@@ -1,16 +1,20 @@
 package server
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"net/http"
 	"strings"
 
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
 
+	"example.com/go-chat/internal/core"
 	"example.com/go-chat/internal/drivers"
 )
 
-func AuthMiddleware(jwt *drivers.JWTManager) gin.HandlerFunc {
+func AuthMiddleware(jwt *drivers.JWTManager, denylist core.TokenDenylist) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		auth := c.GetHeader("Authorization")
 		if auth == "" {
@@ -23,20 +27,53 @@ func AuthMiddleware(jwt *drivers.JWTManager) gin.HandlerFunc {
 			auth = after
 		}
 
-		// verify token -> returns uuid.UUID
-		userID, err := jwt.Verify(auth)
+		// verify token -> returns the user and session it was issued for
+		claims, err := authenticate(c.Request.Context(), jwt, denylist, auth)
 		if err != nil {
-			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+			c.AbortWithStatusJSON(authStatus(err), gin.H{"error": err.Error()})
 			return
 		}
 
 		// store uuid directly (NO type assertion)
-		if userID == uuid.Nil {
+		if claims.UserID == uuid.Nil {
 			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid user id"})
 			return
 		}
 
-		c.Set("user_id", userID)
+		c.Set("user_id", claims.UserID)
+		c.Set("session_id", claims.SessionID)
 		c.Next()
 	}
 }
+
+// authenticate verifies an access token and checks it against the revocation denylist.
+func authenticate(ctx context.Context, jwt *drivers.JWTManager, denylist core.TokenDenylist, token string) (*drivers.Claims, error) {
+	claims, err := jwt.Verify(token)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", core.ErrUnauthorized, err)
+	}
+	revoked, err := denylist.IsRevoked(ctx, claims.ID, claims.SessionID.String())
+	if err != nil {
+		return nil, fmt.Errorf("revocation check: %w", err)
+	}
+	if revoked {
+		return nil, core.ErrTokenRevoked
+	}
+	return claims, nil
+}
+
+// authStatus fails closed: a token that cannot be checked against the denylist is not accepted.
+func authStatus(err error) int {
+	if errors.Is(err, core.ErrUnauthorized) {
+		return http.StatusUnauthorized
+	}
+	return http.StatusServiceUnavailable
+}
+
+// JWKSHandler serves the public keys used to sign access tokens.
+func JWKSHandler(jwt *drivers.JWTManager) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Header("Cache-Control", "public, max-age=300")
+		c.JSON(http.StatusOK, gin.H{"keys": jwt.JWKS()})
+	}
+}
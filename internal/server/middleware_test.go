@@ -0,0 +1,52 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+
+	"example.com/go-chat/internal/drivers"
+)
+
+func TestAuthMiddlewareRejectsRevokedTokens(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	rds := drivers.NewRedis(miniredis.RunT(t).Addr())
+	jwt := drivers.NewJWTManager("test-secret")
+	r := gin.New()
+	r.GET("/me", AuthMiddleware(jwt, rds), func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	get := func(token string) int {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/me", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	session := uuid.New()
+	token, _ := jwt.Generate(uuid.New(), session, time.Minute)
+	other, _ := jwt.Generate(uuid.New(), uuid.New(), time.Minute)
+	if code := get(token); code != http.StatusOK {
+		t.Fatalf("valid token: status %d", code)
+	}
+
+	claims, _ := jwt.Verify(other)
+	if err := rds.RevokeToken(context.Background(), claims.ID, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if err := rds.RevokeSessionTokens(context.Background(), session.String(), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if code := get(token); code != http.StatusUnauthorized {
+		t.Errorf("token of revoked session: status %d, want 401", code)
+	}
+	if code := get(other); code != http.StatusUnauthorized {
+		t.Errorf("revoked token: status %d, want 401", code)
+	}
+}
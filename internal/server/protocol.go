@@ -0,0 +1,98 @@
+package server
+
+import (
+	"encoding/json"
+
+	"github.com/google/uuid"
+)
+
+// ProtocolVersion is the websocket protocol version spoken by this server.
+// Clients may omit "v"; any other value than the current version is rejected.
+const ProtocolVersion = 1
+
+// Envelope is the frame exchanged over the websocket in both directions.
+// Requests sent by a client carry an "id" which is echoed back on the
+// matching ack or error frame. Server pushed events have no id.
+type Envelope struct {
+	V       int             `json:"v"`
+	Type    string          `json:"type"`
+	ID      string          `json:"id,omitempty"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// Frame types sent by clients.
+const (
+	FrameMessageSend    = "message.send"
+	FrameMessageEdit    = "message.edit"
+	FrameMessageDelete  = "message.delete"
+	FrameReactionAdd    = "reaction.add"
+	FrameReactionRemove = "reaction.remove"
+	FrameTypingStart    = "typing.start"
+	FrameTypingStop     = "typing.stop"
+	FrameRead           = "read"
+)
+
+// Frame types sent by the server in reply to a client request. Server pushed
+// events use the core.Event* types.
+const (
+	FrameAck   = "ack"
+	FrameError = "error"
+)
+
+// Error codes carried by error frames.
+const (
+	ErrCodeBadRequest         = "bad_request"
+	ErrCodeUnsupportedVersion = "unsupported_version"
+	ErrCodeUnknownType        = "unknown_type"
+	ErrCodeForbidden          = "forbidden"
+	ErrCodeNotFound           = "not_found"
+	ErrCodeRateLimited        = "rate_limited"
+	ErrCodeInternal           = "internal"
+)
+
+// SendMessagePayload is the payload of a message.send frame. Exactly one of
+// To and GroupID must be set, and Content or Attachments.
+type SendMessagePayload struct {
+	To      *uuid.UUID `json:"to,omitempty"`
+	GroupID *uuid.UUID `json:"group_id,omitempty"`
+	Content string     `json:"content"`
+	ReplyTo *uuid.UUID `json:"reply_to_id,omitempty"`
+	// Attachments are ids returned by the upload endpoint
+	Attachments []uuid.UUID `json:"attachment_ids,omitempty"`
+}
+
+// EditMessagePayload is the payload of a message.edit frame.
+type EditMessagePayload struct {
+	MessageID uuid.UUID `json:"message_id"`
+	Content   string    `json:"content"`
+}
+
+// DeleteMessagePayload is the payload of a message.delete frame.
+type DeleteMessagePayload struct {
+	MessageID uuid.UUID `json:"message_id"`
+}
+
+// ReactionPayload is the payload of reaction.add and reaction.remove frames.
+type ReactionPayload struct {
+	MessageID uuid.UUID `json:"message_id"`
+	Emoji     string    `json:"emoji"`
+}
+
+// TypingPayload is the payload of typing.start and typing.stop frames.
+// Exactly one of To and GroupID must be set.
+type TypingPayload struct {
+	To      *uuid.UUID `json:"to,omitempty"`
+	GroupID *uuid.UUID `json:"group_id,omitempty"`
+}
+
+// ReadPayload is the payload of a read frame: the conversation is read up to
+// and including MessageID.
+type ReadPayload struct {
+	MessageID uuid.UUID `json:"message_id"`
+}
+
+// ErrorPayload is the payload of an error frame.
+type ErrorPayload struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
@@ -0,0 +1,153 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+
+	"example.com/go-chat/internal/core"
+	"example.com/go-chat/internal/core/usecases"
+)
+
+const (
+	// typingRefresh is the minimum time between two typing.start relays for
+	// the same conversation; starts in between only extend the indicator.
+	typingRefresh = 3 * time.Second
+	// typingBurst and typingRate bound how many conversations a client can
+	// start typing in: a token bucket of typingBurst refilled at typingRate/s.
+	typingBurst = 10
+	typingRate  = 1.0
+)
+
+var errTypingThrottled = errors.New("typing indicators are sent too often")
+
+// typingTracker holds the typing indicators a client has started. An indicator
+// stops by itself once it is not refreshed for ttl, and all of them stop when
+// the client disconnects, so a crashed client doesn't stay "typing".
+type typingTracker struct {
+	mu      sync.Mutex
+	user    uuid.UUID
+	typingU *usecases.TypingUsecase
+	ttl     time.Duration
+	active  map[string]*typingEntry
+
+	tokens float64
+	filled time.Time
+}
+
+type typingEntry struct {
+	to, group *uuid.UUID
+	relayed   time.Time
+	timer     *time.Timer
+}
+
+func newTypingTracker(user uuid.UUID, typingU *usecases.TypingUsecase) *typingTracker {
+	return &typingTracker{
+		user:    user,
+		typingU: typingU,
+		ttl:     usecases.TypingTTL,
+		active:  map[string]*typingEntry{},
+		tokens:  typingBurst,
+		filled:  time.Now(),
+	}
+}
+
+func typingKey(to, group *uuid.UUID) string {
+	if to != nil {
+		return core.PrivateChannel(*to)
+	}
+	return core.GroupChannel(*group)
+}
+
+// start, stop and the rest only hold the lock to update the tracker; the
+// indicators are relayed after it is released so the broker never holds up
+// other conversations. Starts and stops come from the client's read loop one
+// at a time.
+func (t *typingTracker) start(ctx context.Context, to, group *uuid.UUID) error {
+	key := typingKey(to, group)
+	now := time.Now()
+	t.mu.Lock()
+	if e, ok := t.active[key]; ok {
+		e.timer.Reset(t.ttl)
+		relay := now.Sub(e.relayed) >= typingRefresh
+		if relay {
+			e.relayed = now
+		}
+		t.mu.Unlock()
+		if !relay {
+			return nil
+		}
+		return t.typingU.Typing(ctx, t.user, to, group, true)
+	}
+	allowed := t.allow(now)
+	t.mu.Unlock()
+	if !allowed {
+		return errTypingThrottled
+	}
+	if err := t.typingU.Typing(ctx, t.user, to, group, true); err != nil {
+		return err
+	}
+	e := &typingEntry{to: to, group: group, relayed: now}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	e.timer = time.AfterFunc(t.ttl, func() { t.expire(key, e) })
+	t.active[key] = e
+	return nil
+}
+
+func (t *typingTracker) stop(ctx context.Context, to, group *uuid.UUID) error {
+	key := typingKey(to, group)
+	t.mu.Lock()
+	e, ok := t.active[key]
+	if ok {
+		e.timer.Stop()
+		delete(t.active, key)
+	}
+	t.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	return t.typingU.Typing(ctx, t.user, to, group, false)
+}
+
+// stopAll stops every indicator; it is called when the client disconnects.
+func (t *typingTracker) stopAll(ctx context.Context) {
+	t.mu.Lock()
+	stopped := make([]*typingEntry, 0, len(t.active))
+	for key, e := range t.active {
+		e.timer.Stop()
+		delete(t.active, key)
+		stopped = append(stopped, e)
+	}
+	t.mu.Unlock()
+	for _, e := range stopped {
+		_ = t.typingU.Typing(ctx, t.user, e.to, e.group, false)
+	}
+}
+
+func (t *typingTracker) expire(key string, e *typingEntry) {
+	t.mu.Lock()
+	current := t.active[key] == e
+	if current {
+		delete(t.active, key)
+	}
+	t.mu.Unlock()
+	if current {
+		_ = t.typingU.Typing(context.Background(), t.user, e.to, e.group, false)
+	}
+}
+
+// allow takes a token from the bucket. Stops and refreshes are free: each one
+// follows a start that was already paid for.
+func (t *typingTracker) allow(now time.Time) bool {
+	t.tokens = min(typingBurst, t.tokens+now.Sub(t.filled).Seconds()*typingRate)
+	t.filled = now
+	if t.tokens < 1 {
+		return false
+	}
+	t.tokens--
+	return true
+}
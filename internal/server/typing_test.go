@@ -0,0 +1,92 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/google/uuid"
+
+	"example.com/go-chat/internal/core"
+	"example.com/go-chat/internal/core/usecases"
+	"example.com/go-chat/internal/drivers"
+)
+
+type typingRepos struct {
+	core.Repositories
+	users *typingUsers
+}
+
+func (r *typingRepos) UserRepo() core.UserRepository { return r.users }
+
+// typingUsers gives every user the same contacts.
+type typingUsers struct {
+	core.UserRepository
+	contacts []uuid.UUID
+}
+
+func (u *typingUsers) ListContacts(ctx context.Context, userID uuid.UUID) ([]uuid.UUID, error) {
+	return u.contacts, nil
+}
+
+func TestTypingTracker(t *testing.T) {
+	ctx := context.Background()
+	rds := drivers.NewRedis(miniredis.RunT(t).Addr())
+	user, to := uuid.New(), uuid.New()
+	ps := rds.Subscribe(ctx, core.PrivateChannel(to))
+	defer ps.Close()
+	next := func() core.Typing {
+		t.Helper()
+		select {
+		case msg := <-ps.Channel():
+			var ev core.Event
+			var typing core.Typing
+			if err := json.Unmarshal([]byte(msg.Payload), &ev); err != nil {
+				t.Fatal(err)
+			}
+			if err := json.Unmarshal(ev.Payload, &typing); err != nil {
+				t.Fatal(err)
+			}
+			return typing
+		case <-time.After(time.Second):
+			t.Fatal("no typing event")
+			return core.Typing{}
+		}
+	}
+
+	repos := &typingRepos{users: &typingUsers{contacts: []uuid.UUID{to}}}
+	tr := newTypingTracker(user, usecases.NewTypingUsecase(repos, rds))
+	tr.ttl = 50 * time.Millisecond
+
+	// a repeated start within typingRefresh is not relayed again
+	for range 2 {
+		if err := tr.start(ctx, &to, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if ev := next(); !ev.Typing || ev.UserID != user {
+		t.Fatalf("got %+v, want typing start", ev)
+	}
+	// without a refresh the indicator expires
+	if ev := next(); ev.Typing {
+		t.Fatalf("got %+v, want typing stop", ev)
+	}
+
+	tr.tokens = 0
+	if err := tr.start(ctx, &to, nil); !errors.Is(err, errTypingThrottled) {
+		t.Fatalf("got %v, want errTypingThrottled", err)
+	}
+
+	// typing to someone without a shared conversation is refused
+	tr.tokens = typingBurst
+	stranger := uuid.New()
+	if err := tr.start(ctx, &stranger, nil); !errors.Is(err, core.ErrNotContact) {
+		t.Fatalf("got %v, want ErrNotContact", err)
+	}
+	if len(tr.active) != 0 {
+		t.Errorf("refused start left %d indicators active", len(tr.active))
+	}
+}
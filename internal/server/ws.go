@@ -3,9 +3,10 @@ package server
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
-	"sync"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -19,10 +20,11 @@ import (
 
 var upgrader = websocket.Upgrader{CheckOrigin: func(r *http.Request) bool { return true }}
 
-// WSHandler is the entrypoint used in main: WSHandler(rds, jwt, repos)
-func WSHandler(rds *drivers.RedisClient, jwt *drivers.JWTManager, repos core.Repositories) gin.HandlerFunc {
-	hub := NewHub(rds)
-	chatU := usecases.NewChatUsecase(repos, rds)
+// WSHandler is the entrypoint used in main: WSHandler(cluster, jwt, repos, store)
+func WSHandler(cluster core.Cluster, jwt *drivers.JWTManager, repos core.Repositories, store core.AttachmentStore) gin.HandlerFunc {
+	hub := NewHub(cluster, repos)
+	chatU := usecases.NewChatUsecase(repos, cluster, store)
+	typingU := usecases.NewTypingUsecase(repos, cluster)
 
 	go hub.Run(context.Background())
 
@@ -39,9 +41,9 @@ func WSHandler(rds *drivers.RedisClient, jwt *drivers.JWTManager, repos core.Rep
 		if len(tok) > 7 && tok[:7] == "Bearer " {
 			tok = tok[7:]
 		}
-		uid, err := jwt.Verify(tok)
+		claims, err := authenticate(c.Request.Context(), jwt, cluster, tok)
 		if err != nil {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+			c.JSON(authStatus(err), gin.H{"error": err.Error()})
 			return
 		}
 
@@ -51,7 +53,8 @@ func WSHandler(rds *drivers.RedisClient, jwt *drivers.JWTManager, repos core.Rep
 			return
 		}
 
-		client := &Client{hub: hub, conn: ws, send: make(chan []byte, 256), userID: uid}
+		client := &Client{hub: hub, conn: ws, send: make(chan []byte, 256), userID: claims.UserID, claims: claims}
+		client.typing = newTypingTracker(claims.UserID, typingU)
 		hub.Register(client)
 
 		go client.writePump()
@@ -59,67 +62,301 @@ func WSHandler(rds *drivers.RedisClient, jwt *drivers.JWTManager, repos core.Rep
 	}
 }
 
-// Hub holds local clients and maps userID to clients. It also subscribes to redis channels for incoming messages.
+// Hub holds local clients and maps userID to clients. It owns a single broker
+// subscription and subscribes to a user's private channel and group channels
+// while at least one local client needs them.
 type Hub struct {
 	clients    map[uuid.UUID]map[*Client]bool
-	mu         sync.RWMutex
-	rds        *drivers.RedisClient
-	register   chan *Client
+	userGroups map[uuid.UUID]map[uuid.UUID]bool // userID -> groupIDs, for users with live clients
+	subs       map[string]map[*Client]bool      // broker channel -> local clients
+	broker     core.Broker
+	repos      core.Repositories
+	ps         core.Subscription
+	register   chan registration
 	unregister chan *Client
 	ctx        context.Context
+
+	// presence changes and delivery receipts run in order on a single worker
+	// so that the hub loop never waits on the cluster or the database
+	jobs       chan job
+	presence   *usecases.PresenceUsecase
+	receipts   *usecases.ReceiptUsecase
+	instanceID string
+}
+
+type job struct {
+	name string
+	run  func(context.Context) error
+}
+
+// registration carries a new client along with the groups its user belonged to when it connected.
+// done is closed once the client is subscribed to its channels.
+type registration struct {
+	client *Client
+	groups []uuid.UUID
+	done   chan struct{}
 }
 
-func NewHub(rds *drivers.RedisClient) *Hub {
-	return &Hub{clients: make(map[uuid.UUID]map[*Client]bool), rds: rds, register: make(chan *Client), unregister: make(chan *Client)}
+func NewHub(cluster core.Cluster, repos core.Repositories) *Hub {
+	return &Hub{
+		clients:    make(map[uuid.UUID]map[*Client]bool),
+		userGroups: make(map[uuid.UUID]map[uuid.UUID]bool),
+		subs:       make(map[string]map[*Client]bool),
+		broker:     cluster,
+		repos:      repos,
+		register:   make(chan registration),
+		unregister: make(chan *Client),
+
+		jobs:       make(chan job, 1024),
+		presence:   usecases.NewPresenceUsecase(repos, cluster, cluster),
+		receipts:   usecases.NewReceiptUsecase(repos, cluster),
+		instanceID: uuid.NewString(),
+	}
 }
 
+// authCheckInterval is how often the hub looks for clients whose access token has expired.
+const authCheckInterval = 15 * time.Second
+
+// Run owns all hub state: registrations, subscription changes and message
+// routing happen on this goroutine only.
 func (h *Hub) Run(ctx context.Context) {
 	h.ctx = ctx
+	h.ps = h.broker.Subscribe(ctx, usecases.MembershipChannel, usecases.RevocationChannel)
+	defer h.ps.Close()
+	msgs := h.ps.Channel()
+	ticker := time.NewTicker(authCheckInterval)
+	defer ticker.Stop()
+	sweep := time.NewTicker(usecases.PresenceSweepInterval)
+	defer sweep.Stop()
+	go h.worker(ctx)
 	for {
 		select {
-		case c := <-h.register:
-			h.mu.Lock()
-			if _, ok := h.clients[c.userID]; !ok {
-				h.clients[c.userID] = make(map[*Client]bool)
-			}
-			h.clients[c.userID][c] = true
-			h.mu.Unlock()
-			go h.subscribePrivate(c.userID)
+		case now := <-ticker.C:
+			h.expireClients(now)
+		case <-sweep.C:
+			h.queue("presence sweep", h.presence.Sweep)
+		case r := <-h.register:
+			h.addClient(r)
 		case c := <-h.unregister:
-			h.mu.Lock()
-			if conns, ok := h.clients[c.userID]; ok {
-				delete(conns, c)
-				if len(conns) == 0 {
-					delete(h.clients, c.userID)
-				}
+			h.removeClient(c)
+		case msg, ok := <-msgs:
+			if !ok {
+				return
 			}
-			h.mu.Unlock()
+			h.dispatch(msg)
+		case <-ctx.Done():
+			return
 		}
 	}
 }
 
-func (h *Hub) Register(c *Client)   { h.register <- c }
+// Register returns once c receives the events of its user and groups, so
+// anything published after a reply to one of its frames reaches it.
+func (h *Hub) Register(c *Client) {
+	groups, err := h.repos.GroupRepo().MyGroups(context.Background(), c.userID)
+	if err != nil {
+		log.Println("load groups", err)
+	}
+	r := registration{client: c, done: make(chan struct{})}
+	for _, g := range groups {
+		r.groups = append(r.groups, g.ID)
+	}
+	h.register <- r
+	<-r.done
+}
+
 func (h *Hub) Unregister(c *Client) { h.unregister <- c }
 
-func (h *Hub) subscribePrivate(userID uuid.UUID) {
-	channel := "private:" + userID.String()
-	ps := h.rds.Subscribe(h.ctx, channel)
-	ch := ps.Channel()
-	for msg := range ch {
-		var m core.Message
-		if err := json.Unmarshal([]byte(msg.Payload), &m); err != nil {
+// Heartbeat keeps the user's presence alive; clients call it on every pong.
+func (h *Hub) Heartbeat(userID uuid.UUID) { h.setPresence(userID, true) }
+
+func (h *Hub) setPresence(userID uuid.UUID, online bool) {
+	h.queue("presence", func(ctx context.Context) error {
+		if online {
+			return h.presence.Connected(ctx, userID, h.instanceID)
+		}
+		return h.presence.Disconnected(ctx, userID, h.instanceID)
+	})
+}
+
+// queue hands work to the worker, dropping it if the worker is not keeping up.
+func (h *Hub) queue(name string, run func(context.Context) error) {
+	select {
+	case h.jobs <- job{name: name, run: run}:
+	default:
+		log.Println("job queue full, dropping", name)
+	}
+}
+
+func (h *Hub) worker(ctx context.Context) {
+	for {
+		select {
+		case j := <-h.jobs:
+			if err := j.run(ctx); err != nil {
+				log.Println(j.name, err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (h *Hub) addClient(r registration) {
+	c := r.client
+	if _, ok := h.clients[c.userID]; !ok {
+		h.clients[c.userID] = make(map[*Client]bool)
+		h.userGroups[c.userID] = make(map[uuid.UUID]bool)
+		for _, gid := range r.groups {
+			h.userGroups[c.userID][gid] = true
+		}
+		h.setPresence(c.userID, true)
+	}
+	h.clients[c.userID][c] = true
+	h.subscribe(c, core.PrivateChannel(c.userID))
+	for gid := range h.userGroups[c.userID] {
+		h.subscribe(c, core.GroupChannel(gid))
+	}
+	close(r.done)
+}
+
+func (h *Hub) removeClient(c *Client) {
+	conns, ok := h.clients[c.userID]
+	if !ok || !conns[c] {
+		return
+	}
+	h.unsubscribe(c, core.PrivateChannel(c.userID))
+	for gid := range h.userGroups[c.userID] {
+		h.unsubscribe(c, core.GroupChannel(gid))
+	}
+	delete(conns, c)
+	if len(conns) == 0 {
+		delete(h.clients, c.userID)
+		delete(h.userGroups, c.userID)
+		h.setPresence(c.userID, false)
+	}
+}
+
+// subscribe adds c to the channel index, subscribing on the broker for the first local client.
+func (h *Hub) subscribe(c *Client, channel string) {
+	if _, ok := h.subs[channel]; !ok {
+		h.subs[channel] = make(map[*Client]bool)
+		if err := h.ps.Subscribe(h.ctx, channel); err != nil {
+			log.Println("subscribe", channel, err)
+		}
+	}
+	h.subs[channel][c] = true
+}
+
+// unsubscribe removes c from the channel index, unsubscribing on the broker once no local client is left.
+func (h *Hub) unsubscribe(c *Client, channel string) {
+	conns, ok := h.subs[channel]
+	if !ok {
+		return
+	}
+	delete(conns, c)
+	if len(conns) == 0 {
+		delete(h.subs, channel)
+		if err := h.ps.Unsubscribe(h.ctx, channel); err != nil {
+			log.Println("unsubscribe", channel, err)
+		}
+	}
+}
+
+func (h *Hub) dispatch(msg *core.BrokerMessage) {
+	if msg.Channel == usecases.RevocationChannel {
+		var ev usecases.RevocationEvent
+		if err := json.Unmarshal([]byte(msg.Payload), &ev); err != nil {
+			return
+		}
+		h.revokeClients(ev)
+		return
+	}
+	if msg.Channel == usecases.MembershipChannel {
+		var ev usecases.MembershipEvent
+		if err := json.Unmarshal([]byte(msg.Payload), &ev); err != nil {
+			return
+		}
+		h.applyMembership(ev)
+		return
+	}
+	var ev core.Event
+	if err := json.Unmarshal([]byte(msg.Payload), &ev); err != nil {
+		return
+	}
+	b, err := json.Marshal(Envelope{V: ProtocolVersion, Type: ev.Type, Payload: ev.Payload})
+	if err != nil {
+		return
+	}
+	delivered := map[uuid.UUID]bool{}
+	for c := range h.subs[msg.Channel] {
+		if c.write(b) {
+			delivered[c.userID] = true
+		}
+	}
+	if ev.Type == core.EventMessageNew {
+		h.markDelivered(ev.Payload, delivered)
+	}
+}
+
+// markDelivered records a delivery receipt for every user a new message was pushed to.
+func (h *Hub) markDelivered(payload json.RawMessage, users map[uuid.UUID]bool) {
+	var m core.Message
+	if err := json.Unmarshal(payload, &m); err != nil {
+		return
+	}
+	for user := range users {
+		if user == m.SenderID {
 			continue
 		}
-		h.mu.RLock()
-		cons := h.clients[userID]
-		for c := range cons {
-			select {
-			case c.send <- []byte(msg.Payload):
-			default:
-				// drop if blocked
+		h.queue("receipt", func(ctx context.Context) error { return h.receipts.Delivered(ctx, user, &m) })
+	}
+}
+
+// applyMembership updates group subscriptions for users with live clients on
+// this hub and tells those clients about the change. A removed member stops
+// receiving the group's messages as soon as the event is applied.
+func (h *Hub) applyMembership(ev usecases.MembershipEvent) {
+	groups, ok := h.userGroups[ev.UserID]
+	if !ok || groups[ev.GroupID] == ev.Joined {
+		return
+	}
+	p, _ := json.Marshal(ev)
+	b, _ := json.Marshal(Envelope{V: ProtocolVersion, Type: core.EventGroupMembership, Payload: p})
+	channel := core.GroupChannel(ev.GroupID)
+	for c := range h.clients[ev.UserID] {
+		if ev.Joined {
+			h.subscribe(c, channel)
+		} else {
+			h.unsubscribe(c, channel)
+		}
+		c.write(b)
+	}
+	if ev.Joined {
+		groups[ev.GroupID] = true
+	} else {
+		delete(groups, ev.GroupID)
+	}
+}
+
+// expireClients disconnects clients whose access token expired while connected.
+func (h *Hub) expireClients(now time.Time) {
+	for _, conns := range h.clients {
+		for c := range conns {
+			if !now.Before(c.claims.ExpiresAt) {
+				go c.kick("token expired")
+			}
+		}
+	}
+}
+
+// revokeClients disconnects clients that authenticated with a revoked token or session.
+func (h *Hub) revokeClients(ev usecases.RevocationEvent) {
+	for _, conns := range h.clients {
+		for c := range conns {
+			if c.claims.ID == ev.TokenID || c.claims.SessionID == ev.SessionID {
+				go c.kick("token revoked")
 			}
 		}
-		h.mu.RUnlock()
 	}
 }
 
@@ -129,56 +366,219 @@ type Client struct {
 	conn   *websocket.Conn
 	send   chan []byte
 	userID uuid.UUID
+	claims *drivers.Claims
+	typing *typingTracker
+}
+
+// kick closes the connection with a policy violation; readPump then unregisters the client.
+func (c *Client) kick(reason string) {
+	msg := websocket.FormatCloseMessage(websocket.ClosePolicyViolation, reason)
+	_ = c.conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+	c.conn.Close()
 }
 
 func (c *Client) readPump(chatU *usecases.ChatUsecase) {
 	defer func() {
+		c.typing.stopAll(context.Background())
 		c.hub.Unregister(c)
 		c.conn.Close()
 	}()
-	c.conn.SetReadLimit(1024)
+	c.conn.SetReadLimit(4096)
 	c.conn.SetReadDeadline(time.Now().Add(60 * time.Second))
-	c.conn.SetPongHandler(func(string) error { c.conn.SetReadDeadline(time.Now().Add(60 * time.Second)); return nil })
+	c.conn.SetPongHandler(func(string) error {
+		c.conn.SetReadDeadline(time.Now().Add(60 * time.Second))
+		c.hub.Heartbeat(c.userID)
+		return nil
+	})
 	for {
-		var raw map[string]any
-		if err := c.conn.ReadJSON(&raw); err != nil {
+		_, data, err := c.conn.ReadMessage()
+		if err != nil {
 			break
 		}
-		typeStr, _ := raw["type"].(string)
-		switch typeStr {
-		case "private_message":
-			toStr, _ := raw["to"].(string)
-			content, _ := raw["content"].(string)
-			if toStr == "" || content == "" {
-				continue
-			}
-			toID, _ := uuid.Parse(toStr)
-			m, err := chatU.SendPrivate(context.Background(), c.userID, toID, content)
-			if err == nil {
-				b, _ := json.Marshal(m)
-				// send to sender locally (ack)
-				select {
-				case c.send <- b:
-				default:
-				}
-			}
-		case "group_message":
-			gidStr, _ := raw["group_id"].(string)
-			content, _ := raw["content"].(string)
-			if gidStr == "" || content == "" {
-				continue
-			}
-			gid, _ := uuid.Parse(gidStr)
-			m, err := chatU.SendGroup(context.Background(), c.userID, gid, content)
-			if err == nil {
-				b, _ := json.Marshal(m)
-				// local send (ack). Group distribution happens via redis subscription for members.
-				select {
-				case c.send <- b:
-				default:
-				}
-			}
+		var env Envelope
+		if err := json.Unmarshal(data, &env); err != nil {
+			c.fail("", ErrCodeBadRequest, "malformed frame")
+			continue
+		}
+		if env.V != 0 && env.V != ProtocolVersion {
+			c.fail(env.ID, ErrCodeUnsupportedVersion, fmt.Sprintf("protocol version %d is not supported", env.V))
+			continue
+		}
+		c.handle(chatU, env)
+	}
+}
+
+func (c *Client) handle(chatU *usecases.ChatUsecase, env Envelope) {
+	ctx := context.Background()
+	switch env.Type {
+	case FrameMessageSend:
+		var p SendMessagePayload
+		if err := json.Unmarshal(env.Payload, &p); err != nil {
+			c.fail(env.ID, ErrCodeBadRequest, err.Error())
+			return
+		}
+		if (p.Content == "" && len(p.Attachments) == 0) || (p.To == nil) == (p.GroupID == nil) {
+			c.fail(env.ID, ErrCodeBadRequest, "content or attachment_ids and exactly one of to or group_id are required")
+			return
+		}
+		d := usecases.Draft{Content: p.Content, ReplyTo: p.ReplyTo, Attachments: p.Attachments}
+		var m *core.Message
+		var err error
+		if p.To != nil {
+			m, err = chatU.SendPrivate(ctx, c.userID, *p.To, d)
+		} else {
+			m, err = chatU.SendGroup(ctx, c.userID, *p.GroupID, d)
+		}
+		if err != nil {
+			c.failErr(env.ID, err)
+			return
+		}
+		c.ack(env.ID, m)
+	case FrameMessageEdit:
+		var p EditMessagePayload
+		if err := json.Unmarshal(env.Payload, &p); err != nil {
+			c.fail(env.ID, ErrCodeBadRequest, err.Error())
+			return
+		}
+		if p.MessageID == uuid.Nil || p.Content == "" {
+			c.fail(env.ID, ErrCodeBadRequest, "message_id and content are required")
+			return
+		}
+		m, err := chatU.Edit(ctx, c.userID, p.MessageID, p.Content)
+		if err != nil {
+			c.failErr(env.ID, err)
+			return
+		}
+		c.ack(env.ID, m)
+	case FrameMessageDelete:
+		var p DeleteMessagePayload
+		if err := json.Unmarshal(env.Payload, &p); err != nil {
+			c.fail(env.ID, ErrCodeBadRequest, err.Error())
+			return
+		}
+		if p.MessageID == uuid.Nil {
+			c.fail(env.ID, ErrCodeBadRequest, "message_id is required")
+			return
+		}
+		m, err := chatU.Delete(ctx, c.userID, p.MessageID)
+		if err != nil {
+			c.failErr(env.ID, err)
+			return
+		}
+		c.ack(env.ID, m)
+	case FrameReactionAdd, FrameReactionRemove:
+		var p ReactionPayload
+		if err := json.Unmarshal(env.Payload, &p); err != nil {
+			c.fail(env.ID, ErrCodeBadRequest, err.Error())
+			return
+		}
+		if p.MessageID == uuid.Nil || p.Emoji == "" {
+			c.fail(env.ID, ErrCodeBadRequest, "message_id and emoji are required")
+			return
+		}
+		if err := chatU.React(ctx, c.userID, p.MessageID, p.Emoji, env.Type == FrameReactionAdd); err != nil {
+			c.failErr(env.ID, err)
+			return
+		}
+		c.ack(env.ID, nil)
+	case FrameTypingStart, FrameTypingStop:
+		var p TypingPayload
+		if err := json.Unmarshal(env.Payload, &p); err != nil {
+			c.fail(env.ID, ErrCodeBadRequest, err.Error())
+			return
+		}
+		if (p.To == nil) == (p.GroupID == nil) {
+			c.fail(env.ID, ErrCodeBadRequest, "exactly one of to or group_id is required")
+			return
+		}
+		var err error
+		if env.Type == FrameTypingStart {
+			err = c.typing.start(ctx, p.To, p.GroupID)
+		} else {
+			err = c.typing.stop(ctx, p.To, p.GroupID)
+		}
+		if err != nil {
+			c.failErr(env.ID, err)
+			return
+		}
+		// typing frames are fire and forget unless the client asks for an ack
+		if env.ID != "" {
+			c.ack(env.ID, nil)
+		}
+	case FrameRead:
+		var p ReadPayload
+		if err := json.Unmarshal(env.Payload, &p); err != nil {
+			c.fail(env.ID, ErrCodeBadRequest, err.Error())
+			return
+		}
+		if p.MessageID == uuid.Nil {
+			c.fail(env.ID, ErrCodeBadRequest, "message_id is required")
+			return
+		}
+		if err := c.hub.receipts.Read(ctx, c.userID, p.MessageID); err != nil {
+			c.failErr(env.ID, err)
+			return
+		}
+		if env.ID != "" {
+			c.ack(env.ID, nil)
+		}
+	default:
+		c.fail(env.ID, ErrCodeUnknownType, fmt.Sprintf("unknown frame type %q", env.Type))
+	}
+}
+
+// ack confirms the request identified by id; a nil payload is left out.
+func (c *Client) ack(id string, payload any) {
+	env := Envelope{V: ProtocolVersion, Type: FrameAck, ID: id}
+	if payload != nil {
+		p, err := json.Marshal(payload)
+		if err != nil {
+			c.fail(id, ErrCodeInternal, err.Error())
+			return
 		}
+		env.Payload = p
+	}
+	c.push(env)
+}
+
+func (c *Client) fail(id, code, message string) {
+	p, _ := json.Marshal(ErrorPayload{Code: code, Message: message})
+	c.push(Envelope{V: ProtocolVersion, Type: FrameError, ID: id, Payload: p})
+}
+
+// failErr reports a usecase error on the request identified by id.
+func (c *Client) failErr(id string, err error) {
+	code := ErrCodeInternal
+	switch {
+	case errors.Is(err, core.ErrForbidden):
+		code = ErrCodeForbidden
+	case errors.Is(err, core.ErrNotFound):
+		code = ErrCodeNotFound
+	case errors.Is(err, core.ErrInvalidInput):
+		code = ErrCodeBadRequest
+	case errors.Is(err, errTypingThrottled):
+		code = ErrCodeRateLimited
+	}
+	c.fail(id, code, err.Error())
+}
+
+func (c *Client) push(env Envelope) {
+	b, err := json.Marshal(env)
+	if err != nil {
+		return
+	}
+	c.write(b)
+}
+
+// write queues a serialized frame, dropping it if the client is not keeping up.
+// It reports whether the frame was queued.
+func (c *Client) write(b []byte) bool {
+	select {
+	case c.send <- b:
+		return true
+	default:
+		// drop if blocked
+		return false
 	}
 }
 